@@ -0,0 +1,173 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package redact hides secrets and identifiers in recordings, logs and error messages.
+package redact
+
+import (
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Redacted replaces the values of sensitive query parameters.
+const Redacted = "REDACTED"
+
+var (
+	dateMatcher   = regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|((\+|\-)\d{2}(:?\d{2})?(:?\d{2})?))?`)
+	sshKeyMatcher = regexp.MustCompile("ssh-rsa [0-9a-zA-Z+/=]+")
+
+	// This is pretty involved, here's the breakdown of what each bit means:
+	// [p|P]assword":\s*" - find any JSON field that ends in the string password, followed by any number of spaces and another quote.
+	// ((?:[^\\"]*?(?:(\\\\)|(\\"))*?)*?) - The outer group is a capturing group, which selects the actual password
+	// [^\\"]*? - this matches any characters that aren't \ or " (need to handle them specially because of escaped quotes)
+	// (?:(?:\\\\)|(?:\\")|(?:\\))*? - lazily match any number of escaped backslahes or escaped quotes.
+	// The above two sections are repeated until the first unescaped "s
+	passwordMatcher = regexp.MustCompile(`[p|P]assword":\s*"((?:[^\\"]*?(?:(?:\\\\)|(?:\\")|(?:\\))*?)*?)"`)
+
+	// keyMatcher matches any valid base64 value with at least 10 sets of 4 bytes of data that ends in = or ==.
+	// Both storage account keys and Redis account keys are longer than that and end in = or ==. Note that technically
+	// base64 values need not end in == or =, but allowing for that in the match will flag tons of false positives as
+	// any text (including long URLs) have strings of characters that meet this requirement. There are other base64 values
+	// in the payloads (such as operationResults URLs for polling async operations for some services) that seem to use
+	// very long base64 strings as well.
+	keyMatcher = regexp.MustCompile("(?:[A-Za-z0-9+/]{4}){10,}(?:[A-Za-z0-9+/]{2}==|[A-Za-z0-9+/]{3}=)")
+
+	// uuidMatcher matches any valid UUID
+	uuidMatcher = regexp.MustCompile("[0-9a-f]{8}-([0-9a-f]{4}-){3}[0-9a-f]{12}")
+	// guidMatcher matches any valid UUID regardless of case, as ARM does not normalize the case of subscription IDs in URLs
+	guidMatcher = regexp.MustCompile("(?i)[0-9a-f]{8}-([0-9a-f]{4}-){3}[0-9a-f]{12}")
+
+	// skipTokenMatcher and encodedSkipTokenMatcher match the base64 skiptoken of paged responses, as is and URL encoded
+	skipTokenMatcher        = regexp.MustCompile(`skiptoken=(?:[A-Za-z0-9+/]{4})*(?:[A-Za-z0-9+/]{2}==|[A-Za-z0-9+/]{3}=)?`)
+	encodedSkipTokenMatcher = regexp.MustCompile(`skiptoken=(?:[A-Za-z0-9+/]{4})*(?:[A-Za-z0-9+/]{2}%3D%3D|[A-Za-z0-9+/]{3}%3D)?`)
+)
+
+// sensitiveQueryParams are the query parameters whose values are credentials or opaque continuation state,
+// e.g. the signature of a SAS token.
+var sensitiveQueryParams = []string{
+	"sig",
+	"skiptoken",
+	"$skiptoken",
+	"code",
+	"client_secret",
+	"client_assertion",
+	"access_token",
+	"token",
+}
+
+// HideDates replaces all ISO8601 datetimes with a fixed value
+// this lets us match requests that may contain time-sensitive information (timestamps, etc)
+func HideDates(s string) string {
+	return dateMatcher.ReplaceAllLiteralString(s, "2001-02-03T04:05:06Z") // this should be recognizable/parseable as a fake date
+}
+
+// HideSSHKeys hides anything that looks like SSH keys
+func HideSSHKeys(s string) string {
+	return sshKeyMatcher.ReplaceAllLiteralString(s, "ssh-rsa {KEY}")
+}
+
+// HideUUIDs hides lower case UUIDs
+func HideUUIDs(s string) string {
+	return uuidMatcher.ReplaceAllLiteralString(s, uuid.Nil.String())
+}
+
+// HideGUIDs hides UUIDs of any case, such as subscription and tenant IDs
+func HideGUIDs(s string) string {
+	return guidMatcher.ReplaceAllLiteralString(s, uuid.Nil.String())
+}
+
+// HidePasswords hides anything that looks like a generated password
+func HidePasswords(s string) string {
+	matches := passwordMatcher.FindAllStringSubmatch(s, -1)
+	for _, match := range matches {
+		for n, submatch := range match {
+			if n%2 == 0 {
+				continue
+			}
+			s = strings.ReplaceAll(s, submatch, "{PASSWORD}")
+		}
+	}
+	return s
+}
+
+// HideKeys hides anything that looks like a storage or cache account key
+func HideKeys(s string) string {
+	return keyMatcher.ReplaceAllLiteralString(s, "{KEY}")
+}
+
+// HideSkipTokens hides the skiptoken of paged responses
+func HideSkipTokens(s string) string {
+	return skipTokenMatcher.ReplaceAllLiteralString(s, "skiptoken=skiptoken")
+}
+
+// HideEncodedSkipTokens hides the URL encoded skiptoken of paged requests
+func HideEncodedSkipTokens(s string) string {
+	return encodedSkipTokenMatcher.ReplaceAllLiteralString(s, "skiptoken=skiptoken")
+}
+
+// HideSecrets hides SSH keys, passwords and account keys
+func HideSecrets(s string) string {
+	result := HideSSHKeys(s)
+	result = HidePasswords(result)
+	result = HideKeys(result)
+	return result
+}
+
+// URLOptions configures URL.
+type URLOptions struct {
+	// StripQuery removes the query parameters that are not in AllowedQueryParams.
+	StripQuery bool
+	// AllowedQueryParams are the query parameters that are kept as is, compared case insensitively.
+	AllowedQueryParams []string
+	// MaskGUIDs replaces UUIDs with the nil UUID.
+	MaskGUIDs bool
+}
+
+// URL returns the redacted string form of u. The values of sensitive query parameters,
+// such as the signature of SAS tokens, are replaced unless they are allowed.
+func URL(u *url.URL, opts URLOptions) string {
+	if u == nil {
+		return ""
+	}
+	redacted := *u
+	redacted.User = nil
+	if redacted.RawQuery != "" {
+		query := redacted.Query()
+		for name := range query {
+			switch {
+			case isQueryParamIn(name, opts.AllowedQueryParams):
+			case opts.StripQuery:
+				query.Del(name)
+			case isQueryParamIn(name, sensitiveQueryParams):
+				query[name] = []string{Redacted}
+			}
+		}
+		redacted.RawQuery = query.Encode()
+	}
+	result := redacted.String()
+	if opts.MaskGUIDs {
+		result = HideGUIDs(result)
+	}
+	return result
+}
+
+func isQueryParamIn(name string, params []string) bool {
+	return slices.ContainsFunc(params, func(param string) bool {
+		return strings.EqualFold(param, name)
+	})
+}
@@ -101,3 +101,96 @@ func IsInsufficientSubnetSizeErrorDetails(errorDetail armcontainerservice.ErrorD
 	code, _ := extractErrorDetailDetails(errorDetail)
 	return isInsufficientSubnetSize(code)
 }
+
+// ExtractAllocationFailureContextFromErrorDetail extracts the details of an allocation failure from the ErrorDetail.
+// It returns nil if the ErrorDetail is not an allocation failure.
+func ExtractAllocationFailureContextFromErrorDetail(errorDetail armcontainerservice.ErrorDetail) *AllocationFailureContext {
+	code, message := extractErrorDetailDetails(errorDetail)
+	// the Target of the ErrorDetail is the field or resource in error, not the path of the request,
+	// the location is only looked for in the message
+	return newAllocationFailureContext(code, message, "")
+}
+
+// IsResourceGroupNotFoundInErrorDetail occurs when the resource group of the request does not exist.
+func IsResourceGroupNotFoundInErrorDetail(errorDetail armcontainerservice.ErrorDetail) bool {
+	code, _ := extractErrorDetailDetails(errorDetail)
+	return isResourceGroupNotFound(code)
+}
+
+// IsResourceNotFoundInErrorDetail occurs when the requested resource does not exist, but its resource group and parent do.
+func IsResourceNotFoundInErrorDetail(errorDetail armcontainerservice.ErrorDetail) bool {
+	code, _ := extractErrorDetailDetails(errorDetail)
+	return isResourceNotFound(code)
+}
+
+// IsParentResourceNotFoundInErrorDetail occurs when the parent of a nested resource does not exist.
+func IsParentResourceNotFoundInErrorDetail(errorDetail armcontainerservice.ErrorDetail) bool {
+	code, _ := extractErrorDetailDetails(errorDetail)
+	return isParentResourceNotFound(code)
+}
+
+// IsConflictInErrorDetail occurs when the request conflicts with the current state of the resource or with a concurrent request.
+func IsConflictInErrorDetail(errorDetail armcontainerservice.ErrorDetail) bool {
+	code, _ := extractErrorDetailDetails(errorDetail)
+	return isConflict(code)
+}
+
+// IsAnotherOperationInProgressInErrorDetail occurs when another operation on the resource or a dependent resource is still running.
+func IsAnotherOperationInProgressInErrorDetail(errorDetail armcontainerservice.ErrorDetail) bool {
+	code, _ := extractErrorDetailDetails(errorDetail)
+	return isAnotherOperationInProgress(code)
+}
+
+// IsPreconditionFailedInErrorDetail occurs when the If-Match or If-None-Match condition (ETag) of the request is not met.
+func IsPreconditionFailedInErrorDetail(errorDetail armcontainerservice.ErrorDetail) bool {
+	code, _ := extractErrorDetailDetails(errorDetail)
+	return isPreconditionFailed(code)
+}
+
+// IsInvalidParameterInErrorDetail occurs when a parameter of the request is invalid.
+func IsInvalidParameterInErrorDetail(errorDetail armcontainerservice.ErrorDetail) bool {
+	code, _ := extractErrorDetailDetails(errorDetail)
+	return isInvalidParameter(code)
+}
+
+// ResourceQuotaHasBeenReachedInErrorDetail communicates if we have reached the quota limit for a resource type.
+func ResourceQuotaHasBeenReachedInErrorDetail(errorDetail armcontainerservice.ErrorDetail) bool {
+	code, _ := extractErrorDetailDetails(errorDetail)
+	return isResourceQuotaExceeded(code)
+}
+
+// IsSubnetFullInErrorDetail occurs when a subnet does not have enough free IP addresses for the request.
+func IsSubnetFullInErrorDetail(errorDetail armcontainerservice.ErrorDetail) bool {
+	code, _ := extractErrorDetailDetails(errorDetail)
+	return isSubnetFull(code)
+}
+
+// PublicIPCountLimitHasBeenReachedInErrorDetail communicates if we have reached the public IP address limit of a subscription in a region.
+func PublicIPCountLimitHasBeenReachedInErrorDetail(errorDetail armcontainerservice.ErrorDetail) bool {
+	code, _ := extractErrorDetailDetails(errorDetail)
+	return isPublicIPCountLimitReached(code)
+}
+
+// IsRequestDisallowedByPolicyInErrorDetail occurs when an Azure Policy assignment denied the request.
+func IsRequestDisallowedByPolicyInErrorDetail(errorDetail armcontainerservice.ErrorDetail) bool {
+	code, _ := extractErrorDetailDetails(errorDetail)
+	return isRequestDisallowedByPolicy(code)
+}
+
+// IsReadOnlyDisabledSubscriptionInErrorDetail occurs when the subscription is disabled, and therefore read only.
+func IsReadOnlyDisabledSubscriptionInErrorDetail(errorDetail armcontainerservice.ErrorDetail) bool {
+	code, _ := extractErrorDetailDetails(errorDetail)
+	return isReadOnlyDisabledSubscription(code)
+}
+
+// IsMissingSubscriptionRegistrationInErrorDetail occurs when the subscription is not registered with the resource provider.
+func IsMissingSubscriptionRegistrationInErrorDetail(errorDetail armcontainerservice.ErrorDetail) bool {
+	code, _ := extractErrorDetailDetails(errorDetail)
+	return isMissingSubscriptionRegistration(code)
+}
+
+// IsOperationPreemptedInErrorDetail occurs when an operation was canceled in favor of a more recent operation on the same resource.
+func IsOperationPreemptedInErrorDetail(errorDetail armcontainerservice.ErrorDetail) bool {
+	code, _ := extractErrorDetailDetails(errorDetail)
+	return isOperationPreempted(code)
+}
@@ -145,3 +145,34 @@ func TestIsInsufficientSubnetSizeDetails(t *testing.T) {
 	)
 	checkErrorDetails(t, "IsInsufficientSubnetSizeErrorDetails", testCases, IsInsufficientSubnetSizeErrorDetails)
 }
+
+// Common ARM Error Tests
+func TestCommonArmErrorsInErrorDetail(t *testing.T) {
+	tests := []struct {
+		name      string
+		errorCode string
+		testFunc  errorDetailTestFunc
+	}{
+		{"IsResourceGroupNotFoundInErrorDetail", ResourceGroupNotFoundErrorCode, IsResourceGroupNotFoundInErrorDetail},
+		{"IsResourceNotFoundInErrorDetail", ResourceNotFoundErrorCode, IsResourceNotFoundInErrorDetail},
+		{"IsParentResourceNotFoundInErrorDetail", ParentResourceNotFoundErrorCode, IsParentResourceNotFoundInErrorDetail},
+		{"IsConflictInErrorDetail", ConflictErrorCode, IsConflictInErrorDetail},
+		{"IsAnotherOperationInProgressInErrorDetail", AnotherOperationInProgressErrorCode, IsAnotherOperationInProgressInErrorDetail},
+		{"IsPreconditionFailedInErrorDetail", PreconditionFailedErrorCode, IsPreconditionFailedInErrorDetail},
+		{"IsInvalidParameterInErrorDetail", InvalidParameterErrorCode, IsInvalidParameterInErrorDetail},
+		{"ResourceQuotaHasBeenReachedInErrorDetail", ResourceQuotaExceededErrorCode, ResourceQuotaHasBeenReachedInErrorDetail},
+		{"IsSubnetFullInErrorDetail", SubnetIsFullErrorCode, IsSubnetFullInErrorDetail},
+		{"PublicIPCountLimitHasBeenReachedInErrorDetail", PublicIPCountLimitReachedErrorCode, PublicIPCountLimitHasBeenReachedInErrorDetail},
+		{"IsRequestDisallowedByPolicyInErrorDetail", RequestDisallowedByPolicyErrorCode, IsRequestDisallowedByPolicyInErrorDetail},
+		{"IsReadOnlyDisabledSubscriptionInErrorDetail", ReadOnlyDisabledSubscriptionErrorCode, IsReadOnlyDisabledSubscriptionInErrorDetail},
+		{"IsMissingSubscriptionRegistrationInErrorDetail", MissingSubscriptionRegistrationErrorCode, IsMissingSubscriptionRegistrationInErrorDetail},
+		{"IsOperationPreemptedInErrorDetail", OperationPreemptedErrorCode, IsOperationPreemptedInErrorDetail},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testCases := createSimpleErrorDetailCodeTests(tt.errorCode, tt.errorCode)
+			checkErrorDetails(t, tt.name, testCases, tt.testFunc)
+		})
+	}
+}
@@ -0,0 +1,216 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package errors
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+)
+
+// AllocationConstraint is a placement constraint that Azure reported as contributing to an allocation failure.
+type AllocationConstraint string
+
+const (
+	AllocationConstraintAcceleratedNetworking   AllocationConstraint = "AcceleratedNetworking"
+	AllocationConstraintProximityPlacementGroup AllocationConstraint = "ProximityPlacementGroup"
+	AllocationConstraintIPv6                    AllocationConstraint = "IPv6"
+	AllocationConstraintUltraSSD                AllocationConstraint = "UltraSSD"
+	AllocationConstraintAvailabilitySet         AllocationConstraint = "AvailabilitySet"
+	AllocationConstraintDedicatedHost           AllocationConstraint = "DedicatedHost"
+	AllocationConstraintEphemeralOSDisk         AllocationConstraint = "EphemeralOSDisk"
+	AllocationConstraintCapacityReservation     AllocationConstraint = "CapacityReservation"
+)
+
+// allocationConstraintTerms maps lower-cased phrases found in allocation failure messages to constraints.
+// The order is the order constraints are reported in.
+var allocationConstraintTerms = []struct {
+	term       string
+	constraint AllocationConstraint
+}{
+	{"accelerated networking", AllocationConstraintAcceleratedNetworking},
+	{"proximity placement group", AllocationConstraintProximityPlacementGroup},
+	{"ipv6", AllocationConstraintIPv6},
+	{"ultrassd", AllocationConstraintUltraSSD},
+	{"ultra ssd", AllocationConstraintUltraSSD},
+	{"ultra disk", AllocationConstraintUltraSSD},
+	{"availability set", AllocationConstraintAvailabilitySet},
+	{"dedicated host", AllocationConstraintDedicatedHost},
+	{"ephemeral os disk", AllocationConstraintEphemeralOSDisk},
+	{"capacity reservation", AllocationConstraintCapacityReservation},
+}
+
+var (
+	// vmSizeMatcher matches VM size names such as Standard_D2s_v3 or Standard_M416-208s_v2
+	vmSizeMatcher = regexp.MustCompile(`\b((?:Standard|Basic)_[A-Za-z0-9_-]+)`)
+	// zoneMatcher matches zone references such as "zone '1'", "zone: 2" or "zones 1, 3"
+	zoneMatcher = regexp.MustCompile(`(?i)\bzones?(?:\(s\))?['"]?\s*[:=]?\s*\[?\s*['"]?([1-9](?:['"]?\s*,\s*['"]?[1-9])*)`)
+	// messageLocationMatcher matches quoted locations such as "region 'eastus'" or "location: 'westus2'"
+	messageLocationMatcher = regexp.MustCompile(`(?i)\b(?:region|location)\s*[:=]?\s*'([a-z0-9]+)'`)
+	// urlLocationMatcher matches the location segment of ARM URLs such as async operation status URLs
+	urlLocationMatcher = regexp.MustCompile(`(?i)/locations/([^/?]+)`)
+	zoneDigitMatcher   = regexp.MustCompile(`[1-9]`)
+)
+
+// AllocationFailureContext describes an allocation failure in enough detail to decide where to retry.
+// All fields are best effort: Azure does not return allocation failures in a structured form,
+// so values are extracted from the error message and the request URL.
+type AllocationFailureContext struct {
+	// Code is the ARM error code that reported the failure, e.g. ZonalAllocationFailed.
+	Code string
+	// Zones are the availability zones the allocation failed in, if reported.
+	Zones []string
+	// VMSize is the requested VM size, if reported.
+	VMSize string
+	// Location is the region the allocation failed in, if reported.
+	Location string
+	// Constraints are the placement constraints Azure reported as too restrictive.
+	Constraints []AllocationConstraint
+	// ResourceID is the ARM resource the failed request targeted, if known.
+	ResourceID string
+}
+
+// IsZonal tells us if the failure is scoped to a zone, in which case another zone in the same region may succeed.
+func (c *AllocationFailureContext) IsZonal() bool {
+	return c != nil && (isZonalAllocationFailed(c.Code) || isOverconstrainedZonalAllocationFailed(c.Code))
+}
+
+// IsOverconstrained tells us if the failure was caused by the constraints of the request rather than by capacity alone.
+func (c *AllocationFailureContext) IsOverconstrained() bool {
+	return c != nil && (isOverconstrainedAllocationFailed(c.Code) || isOverconstrainedZonalAllocationFailed(c.Code))
+}
+
+// AllocationTarget is a location, and optionally a zone within it, where an allocation can be attempted.
+// An empty Location refers to the location of the failed request.
+type AllocationTarget struct {
+	Location string
+	Zone     string
+}
+
+// FallbackPlan orders candidates by how likely they are to succeed after this failure.
+// Targets that match the failed location and zones are removed. For zonal failures the other zones of the same
+// region are tried first, then the same region without a zone, then other regions. For regional failures only
+// other regions are kept. Candidates keep their relative order within each group.
+// A nil context returns the candidates unchanged.
+func (c *AllocationFailureContext) FallbackPlan(candidates []AllocationTarget) []AllocationTarget {
+	if c == nil {
+		return append([]AllocationTarget(nil), candidates...)
+	}
+
+	var otherZones, sameRegion, otherRegions []AllocationTarget
+	seen := map[AllocationTarget]bool{}
+	for _, candidate := range candidates {
+		key := AllocationTarget{Location: strings.ToLower(candidate.Location), Zone: candidate.Zone}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if !c.isSameLocation(candidate.Location) {
+			otherRegions = append(otherRegions, candidate)
+			continue
+		}
+		if !c.IsZonal() {
+			// the whole region failed to allocate
+			continue
+		}
+		switch {
+		case candidate.Zone == "":
+			sameRegion = append(sameRegion, candidate)
+		case !c.hasFailedZone(candidate.Zone):
+			otherZones = append(otherZones, candidate)
+		}
+	}
+
+	plan := make([]AllocationTarget, 0, len(otherZones)+len(sameRegion)+len(otherRegions))
+	plan = append(plan, otherZones...)
+	plan = append(plan, sameRegion...)
+	plan = append(plan, otherRegions...)
+	return plan
+}
+
+func (c *AllocationFailureContext) isSameLocation(location string) bool {
+	return location == "" || strings.EqualFold(location, c.Location)
+}
+
+func (c *AllocationFailureContext) hasFailedZone(zone string) bool {
+	// when the failed zones are unknown no zone can be ruled out
+	return slices.Contains(c.Zones, zone)
+}
+
+// ExtractAllocationFailureContext extracts the details of an allocation failure from the error body and request URL.
+// It returns nil if the error is not an allocation failure.
+// To learn more about allocation failures, visit: http://aka.ms/allocation-guidance
+func ExtractAllocationFailureContext(err error) *AllocationFailureContext {
+	azErr := IsResponseError(err)
+	if azErr == nil {
+		return nil
+	}
+
+	requestURL := ""
+	if azErr.RawResponse != nil && azErr.RawResponse.Request != nil && azErr.RawResponse.Request.URL != nil {
+		requestURL = azErr.RawResponse.Request.URL.Path
+	}
+	return newAllocationFailureContext(errorCode(azErr), azErr.Error(), requestURL)
+}
+
+func isAnyAllocationFailure(code string) bool {
+	return isZonalAllocationFailed(code) || isAllocationFailed(code) ||
+		isOverconstrainedAllocationFailed(code) || isOverconstrainedZonalAllocationFailed(code)
+}
+
+// newAllocationFailureContext is the single source of truth for allocation failure extraction.
+func newAllocationFailureContext(code, message, requestPath string) *AllocationFailureContext {
+	if !isAnyAllocationFailure(code) {
+		return nil
+	}
+
+	failure := &AllocationFailureContext{Code: code}
+
+	if match := vmSizeMatcher.FindStringSubmatch(message); match != nil {
+		failure.VMSize = match[1]
+	}
+
+	for _, match := range zoneMatcher.FindAllStringSubmatch(message, -1) {
+		for _, zone := range zoneDigitMatcher.FindAllString(match[1], -1) {
+			if !failure.hasFailedZone(zone) {
+				failure.Zones = append(failure.Zones, zone)
+			}
+		}
+	}
+
+	if match := urlLocationMatcher.FindStringSubmatch(requestPath); match != nil {
+		failure.Location = strings.ToLower(match[1])
+	} else if match := messageLocationMatcher.FindStringSubmatch(message); match != nil {
+		failure.Location = strings.ToLower(match[1])
+	}
+
+	lowerMessage := strings.ToLower(message)
+	for _, t := range allocationConstraintTerms {
+		if strings.Contains(lowerMessage, t.term) && !slices.Contains(failure.Constraints, t.constraint) {
+			failure.Constraints = append(failure.Constraints, t.constraint)
+		}
+	}
+
+	if requestPath != "" {
+		if resID, err := arm.ParseResourceID(requestPath); err == nil {
+			failure.ResourceID = resID.String()
+		}
+	}
+
+	return failure
+}
@@ -0,0 +1,152 @@
+package errors
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerservice/armcontainerservice/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func createResponseErrorWithRequest(errorCode string, statusCode int, body, path string) *azcore.ResponseError {
+	return &azcore.ResponseError{
+		ErrorCode:  errorCode,
+		StatusCode: statusCode,
+		RawResponse: &http.Response{
+			StatusCode: statusCode,
+			Body:       io.NopCloser(bytes.NewBufferString(body)),
+			Request: &http.Request{
+				Method: http.MethodPut,
+				URL: &url.URL{
+					Scheme: "https",
+					Host:   "management.azure.com",
+					Path:   path,
+				},
+			},
+		},
+	}
+}
+
+func TestExtractAllocationFailureContext(t *testing.T) {
+	vmPath := "/subscriptions/12345/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm"
+
+	t.Run("zonal allocation failure", func(t *testing.T) {
+		body := `{"error": {"code": "ZonalAllocationFailed", "message": "Allocation failed. We do not have sufficient capacity for the requested VM size Standard_NC24ads_A100_v4 in zone '2'. Read more about improving likelihood of allocation success at http://aka.ms/allocation-guidance"}}`
+		failure := ExtractAllocationFailureContext(createResponseErrorWithRequest(ZoneAllocationFailed, http.StatusConflict, body, vmPath))
+
+		assert.NotNil(t, failure)
+		assert.Equal(t, ZoneAllocationFailed, failure.Code)
+		assert.Equal(t, []string{"2"}, failure.Zones)
+		assert.Equal(t, "Standard_NC24ads_A100_v4", failure.VMSize)
+		assert.Equal(t, vmPath, failure.ResourceID)
+		assert.True(t, failure.IsZonal())
+		assert.False(t, failure.IsOverconstrained())
+	})
+
+	t.Run("overconstrained allocation failure with constraints", func(t *testing.T) {
+		body := `{"error": {"code": "OverconstrainedAllocationRequest", "message": "Allocation failed. VM(s) with the following constraints cannot be allocated, because the condition is too restrictive. Please remove some constraints and try again. Constraints applied are:\n  - Networking Constraints (such as Accelerated Networking or IPv6)\n  - Proximity Placement Group\n  - VM Size 'Standard_D16s_v5' in region 'westeurope'"}}`
+		failure := ExtractAllocationFailureContext(createResponseErrorWithRequest(OverconstrainedAllocationRequest, http.StatusConflict, body, vmPath))
+
+		assert.NotNil(t, failure)
+		assert.Equal(t, "Standard_D16s_v5", failure.VMSize)
+		assert.Equal(t, "westeurope", failure.Location)
+		assert.Empty(t, failure.Zones)
+		assert.Equal(t, []AllocationConstraint{
+			AllocationConstraintAcceleratedNetworking,
+			AllocationConstraintProximityPlacementGroup,
+			AllocationConstraintIPv6,
+		}, failure.Constraints)
+		assert.False(t, failure.IsZonal())
+		assert.True(t, failure.IsOverconstrained())
+	})
+
+	t.Run("location from async operation URL", func(t *testing.T) {
+		body := `{"error": {"code": "AllocationFailed", "message": "Allocation failed. We do not have sufficient capacity for the requested VM size in this region."}}`
+		failure := ExtractAllocationFailureContext(createResponseErrorWithRequest(AllocationFailed, http.StatusOK, body,
+			"/subscriptions/12345/providers/Microsoft.Compute/locations/EastUS2/operations/abc"))
+
+		assert.NotNil(t, failure)
+		assert.Equal(t, "eastus2", failure.Location)
+		assert.Empty(t, failure.VMSize)
+	})
+
+	t.Run("multiple zones", func(t *testing.T) {
+		body := `{"error": {"code": "OverconstrainedZonalAllocationRequest", "message": "Allocation failed for zones: 1, 3."}}`
+		failure := ExtractAllocationFailureContext(createResponseErrorWithRequest(OverconstrainedZonalAllocationRequest, http.StatusConflict, body, vmPath))
+
+		assert.NotNil(t, failure)
+		assert.Equal(t, []string{"1", "3"}, failure.Zones)
+		assert.True(t, failure.IsZonal())
+		assert.True(t, failure.IsOverconstrained())
+	})
+
+	t.Run("not an allocation failure", func(t *testing.T) {
+		assert.Nil(t, ExtractAllocationFailureContext(createResponseError(SKUNotAvailableErrorCode, http.StatusConflict, "irrelevant message")))
+		assert.Nil(t, ExtractAllocationFailureContext(errors.New("some other error")))
+		assert.Nil(t, ExtractAllocationFailureContext(nil))
+	})
+}
+
+func TestExtractAllocationFailureContextFromErrorDetail(t *testing.T) {
+	errorDetail := createErrorDetail(ZoneAllocationFailed, "Allocation failed. We do not have sufficient capacity for the requested VM size Standard_D4s_v3 in zone '1'.")
+	// the target is not a request path, the location is not taken from it
+	errorDetail.Target = to.Ptr("/subscriptions/sub/providers/Microsoft.Compute/locations/westus2/vmSizes")
+	failure := ExtractAllocationFailureContextFromErrorDetail(errorDetail)
+
+	assert.NotNil(t, failure)
+	assert.Equal(t, []string{"1"}, failure.Zones)
+	assert.Equal(t, "Standard_D4s_v3", failure.VMSize)
+	assert.Empty(t, failure.Location)
+
+	assert.Nil(t, ExtractAllocationFailureContextFromErrorDetail(armcontainerservice.ErrorDetail{}))
+}
+
+func TestAllocationFailureContext_FallbackPlan(t *testing.T) {
+	candidates := []AllocationTarget{
+		{Location: "westus2"},
+		{Location: "eastus", Zone: "1"},
+		{Location: "eastus", Zone: "2"},
+		{Location: "eastus"},
+		{Location: "westus2", Zone: "1"},
+		{Location: "EastUS", Zone: "3"},
+		{Location: "eastus", Zone: "2"},
+	}
+
+	t.Run("zonal failure prefers other zones of the same region", func(t *testing.T) {
+		failure := &AllocationFailureContext{Code: ZoneAllocationFailed, Location: "eastus", Zones: []string{"2"}}
+		assert.Equal(t, []AllocationTarget{
+			{Location: "eastus", Zone: "1"},
+			{Location: "EastUS", Zone: "3"},
+			{Location: "eastus"},
+			{Location: "westus2"},
+			{Location: "westus2", Zone: "1"},
+		}, failure.FallbackPlan(candidates))
+	})
+
+	t.Run("regional failure only keeps other regions", func(t *testing.T) {
+		failure := &AllocationFailureContext{Code: AllocationFailed, Location: "eastus"}
+		assert.Equal(t, []AllocationTarget{
+			{Location: "westus2"},
+			{Location: "westus2", Zone: "1"},
+		}, failure.FallbackPlan(candidates))
+	})
+
+	t.Run("empty candidate location refers to the failed region", func(t *testing.T) {
+		failure := &AllocationFailureContext{Code: ZoneAllocationFailed, Zones: []string{"1"}}
+		assert.Equal(t, []AllocationTarget{
+			{Zone: "2"},
+			{Location: "westus2"},
+		}, failure.FallbackPlan([]AllocationTarget{{Zone: "1"}, {Location: "westus2"}, {Zone: "2"}}))
+	})
+
+	t.Run("nil context keeps candidates", func(t *testing.T) {
+		var failure *AllocationFailureContext
+		assert.Equal(t, candidates, failure.FallbackPlan(candidates))
+	})
+}
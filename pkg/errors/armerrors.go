@@ -35,6 +35,19 @@ func IsResponseError(err error) *azcore.ResponseError {
 	return nil
 }
 
+// errorCode returns the error code of the response error. Data plane services do not all set the
+// x-ms-error-code header azcore reads the code from, in which case the code is parsed from the body.
+func errorCode(azErr *azcore.ResponseError) string {
+	if azErr.ErrorCode != "" {
+		return azErr.ErrorCode
+	}
+	result, err := parseAzureErrorResponse(responseBody(azErr))
+	if err != nil {
+		return ""
+	}
+	return result.azureError().Code
+}
+
 // IsNotFoundErr is used to determine if we are failing to find a resource within azure.
 func IsNotFoundErr(err error) bool {
 	azErr := IsResponseError(err)
@@ -52,65 +65,150 @@ func IsAuthorizationErr(err error) bool {
 // To learn more about zonal allocation failures, visit: http://aka.ms/allocation-guidance
 func ZonalAllocationFailureOccurred(err error) bool {
 	azErr := IsResponseError(err)
-	return azErr != nil && isZonalAllocationFailed(azErr.ErrorCode)
+	return azErr != nil && isZonalAllocationFailed(errorCode(azErr))
 }
 
 // AllocationFailureOccurred communicates if we have failed to allocate a resource in a region, and should try another region.
 func AllocationFailureOccurred(err error) bool {
 	azErr := IsResponseError(err)
-	return azErr != nil && isAllocationFailed(azErr.ErrorCode)
+	return azErr != nil && isAllocationFailed(errorCode(azErr))
 }
 
 // OverconstrainedAllocationFailureOccurred communicates if we have failed to allocate a resource that meets constraints specified in the request, and should try another region.
 func OverconstrainedAllocationFailureOccurred(err error) bool {
 	azErr := IsResponseError(err)
-	return azErr != nil && isOverconstrainedAllocationFailed(azErr.ErrorCode)
+	return azErr != nil && isOverconstrainedAllocationFailed(errorCode(azErr))
 }
 
 // OverconstrainedZonalAllocationFailureOccurred communicates if we have failed to allocate a resource that meets constraints specified in the request, and should try another zone.
 func OverconstrainedZonalAllocationFailureOccurred(err error) bool {
 	azErr := IsResponseError(err)
-	return azErr != nil && isOverconstrainedZonalAllocationFailed(azErr.ErrorCode)
+	return azErr != nil && isOverconstrainedZonalAllocationFailed(errorCode(azErr))
 }
 
 // SKUFamilyQuotaHasBeenReached tells us if we have exceeded our Quota.
 func SKUFamilyQuotaHasBeenReached(err error) bool {
 	azErr := IsResponseError(err)
-	return azErr != nil && isSKUFamilyQuotaExceeded(azErr.ErrorCode, azErr.Error())
+	return azErr != nil && isSKUFamilyQuotaExceeded(errorCode(azErr), azErr.Error())
 }
 
 // SubscriptionQuotaHasBeenReached tells us if we have exceeded our Quota.
 func SubscriptionQuotaHasBeenReached(err error) bool {
 	azErr := IsResponseError(err)
-	return azErr != nil && isSubscriptionQuotaExceeded(azErr.ErrorCode, azErr.Error())
+	return azErr != nil && isSubscriptionQuotaExceeded(errorCode(azErr), azErr.Error())
 }
 
 // RegionalQuotaHasBeenReached communicates if we have reached the quota limit for a given region under a specific subscription
 func RegionalQuotaHasBeenReached(err error) bool {
 	azErr := IsResponseError(err)
-	return azErr != nil && isRegionalQuotaExceeded(azErr.ErrorCode, azErr.Error())
+	return azErr != nil && isRegionalQuotaExceeded(errorCode(azErr), azErr.Error())
 }
 
 // LowPriorityQuotaHasBeenReached communicates if we have reached the quota limit for low priority VMs under a specific subscription
 // Low priority VMs are generally Spot VMs, but can also be low priority VMs created via the Azure CLI or Azure Portal
 func LowPriorityQuotaHasBeenReached(err error) bool {
 	azErr := IsResponseError(err)
-	return azErr != nil && isLowPriorityQuotaExceeded(azErr.ErrorCode, azErr.Error())
+	return azErr != nil && isLowPriorityQuotaExceeded(errorCode(azErr), azErr.Error())
 }
 
 // IsNicReservedForAnotherVM occurs when a NIC is associated with another VM during deletion. See https://aka.ms/deletenic
 func IsNicReservedForAnotherVM(err error) bool {
 	azErr := IsResponseError(err)
-	return azErr != nil && isNicReservedForVM(azErr.ErrorCode)
+	return azErr != nil && isNicReservedForVM(errorCode(azErr))
 }
 
 // IsSKUNotAvailable https://aka.ms/azureskunotavailable: either not available for a location or zone, or out of capacity for Spot.
 func IsSKUNotAvailable(err error) bool {
 	azErr := IsResponseError(err)
-	return azErr != nil && isSKUNotAvailable(azErr.ErrorCode)
+	return azErr != nil && isSKUNotAvailable(errorCode(azErr))
 }
 
 func IsInsufficientSubnetSizeError(err error) bool {
 	azErr := IsResponseError(err)
-	return azErr != nil && isInsufficientSubnetSize(azErr.ErrorCode)
+	return azErr != nil && isInsufficientSubnetSize(errorCode(azErr))
+}
+
+// IsResourceGroupNotFound occurs when the resource group of the request does not exist.
+func IsResourceGroupNotFound(err error) bool {
+	azErr := IsResponseError(err)
+	return azErr != nil && isResourceGroupNotFound(errorCode(azErr))
+}
+
+// IsResourceNotFound occurs when the requested resource does not exist, but its resource group and parent do.
+func IsResourceNotFound(err error) bool {
+	azErr := IsResponseError(err)
+	return azErr != nil && isResourceNotFound(errorCode(azErr))
+}
+
+// IsParentResourceNotFound occurs when the parent of a nested resource does not exist, e.g. the virtual network of a subnet.
+func IsParentResourceNotFound(err error) bool {
+	azErr := IsResponseError(err)
+	return azErr != nil && isParentResourceNotFound(errorCode(azErr))
+}
+
+// IsConflict occurs when the request conflicts with the current state of the resource or with a concurrent request.
+func IsConflict(err error) bool {
+	azErr := IsResponseError(err)
+	return azErr != nil && isConflict(errorCode(azErr))
+}
+
+// IsAnotherOperationInProgress occurs when another operation on the resource or a dependent resource is still running.
+// Retrying once the other operation completes is expected to succeed.
+func IsAnotherOperationInProgress(err error) bool {
+	azErr := IsResponseError(err)
+	return azErr != nil && isAnotherOperationInProgress(errorCode(azErr))
+}
+
+// IsPreconditionFailed occurs when the If-Match or If-None-Match condition (ETag) of the request is not met.
+func IsPreconditionFailed(err error) bool {
+	azErr := IsResponseError(err)
+	return azErr != nil && (isPreconditionFailed(errorCode(azErr)) || azErr.StatusCode == http.StatusPreconditionFailed)
+}
+
+// IsInvalidParameter occurs when a parameter of the request is invalid. Retrying the same request will not succeed.
+func IsInvalidParameter(err error) bool {
+	azErr := IsResponseError(err)
+	return azErr != nil && isInvalidParameter(errorCode(azErr))
+}
+
+// ResourceQuotaHasBeenReached communicates if we have reached the quota limit for a resource type, e.g. per resource group.
+func ResourceQuotaHasBeenReached(err error) bool {
+	azErr := IsResponseError(err)
+	return azErr != nil && isResourceQuotaExceeded(errorCode(azErr))
+}
+
+// IsSubnetFull occurs when a subnet does not have enough free IP addresses for the request.
+func IsSubnetFull(err error) bool {
+	azErr := IsResponseError(err)
+	return azErr != nil && isSubnetFull(errorCode(azErr))
+}
+
+// PublicIPCountLimitHasBeenReached communicates if we have reached the public IP address limit of a subscription in a region.
+func PublicIPCountLimitHasBeenReached(err error) bool {
+	azErr := IsResponseError(err)
+	return azErr != nil && isPublicIPCountLimitReached(errorCode(azErr))
+}
+
+// IsRequestDisallowedByPolicy occurs when an Azure Policy assignment denied the request.
+func IsRequestDisallowedByPolicy(err error) bool {
+	azErr := IsResponseError(err)
+	return azErr != nil && isRequestDisallowedByPolicy(errorCode(azErr))
+}
+
+// IsReadOnlyDisabledSubscription occurs when the subscription is disabled, and therefore read only.
+func IsReadOnlyDisabledSubscription(err error) bool {
+	azErr := IsResponseError(err)
+	return azErr != nil && isReadOnlyDisabledSubscription(errorCode(azErr))
+}
+
+// IsMissingSubscriptionRegistration occurs when the subscription is not registered with the resource provider. See https://aka.ms/rps-not-found
+func IsMissingSubscriptionRegistration(err error) bool {
+	azErr := IsResponseError(err)
+	return azErr != nil && isMissingSubscriptionRegistration(errorCode(azErr))
+}
+
+// IsOperationPreempted occurs when an operation was canceled in favor of a more recent operation on the same resource.
+func IsOperationPreempted(err error) bool {
+	azErr := IsResponseError(err)
+	return azErr != nil && isOperationPreempted(errorCode(azErr))
 }
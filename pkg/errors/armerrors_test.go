@@ -187,3 +187,161 @@ func TestIsInsufficientSubnetSizeError(t *testing.T) {
 	)
 	checkErrors(t, "IsInsufficientSubnetSizeError", testCases, IsInsufficientSubnetSizeError)
 }
+
+// Common ARM Error Tests
+func TestIsResourceGroupNotFound(t *testing.T) {
+	testCases := createMessageContainsTests(
+		ResourceGroupNotFoundErrorCode,
+		http.StatusNotFound,
+		"Resource group 'my-rg' could not be found.",
+		"Resource Group Not Found",
+		createResponseError,
+	)
+	checkErrors(t, "IsResourceGroupNotFound", testCases, IsResourceGroupNotFound)
+}
+
+func TestIsResourceNotFound(t *testing.T) {
+	testCases := createMessageContainsTests(
+		ResourceNotFoundErrorCode,
+		http.StatusNotFound,
+		"The Resource 'Microsoft.Compute/virtualMachines/myVM' under resource group 'my-rg' was not found. For more details please go to https://aka.ms/ARMResourceNotFoundFix",
+		"Resource Not Found",
+		createResponseError,
+	)
+	checkErrors(t, "IsResourceNotFound", testCases, IsResourceNotFound)
+	assert.False(t, IsResourceNotFound(createResponseError(ParentResourceNotFoundErrorCode, http.StatusNotFound, "")))
+}
+
+func TestIsParentResourceNotFound(t *testing.T) {
+	testCases := createMessageContainsTests(
+		ParentResourceNotFoundErrorCode,
+		http.StatusNotFound,
+		"Can not perform requested operation on nested resource. Parent resource 'my-vnet' not found.",
+		"Parent Resource Not Found",
+		createResponseError,
+	)
+	checkErrors(t, "IsParentResourceNotFound", testCases, IsParentResourceNotFound)
+	assert.False(t, IsParentResourceNotFound(createResponseError(ResourceNotFoundErrorCode, http.StatusNotFound, "")))
+}
+
+func TestIsConflict(t *testing.T) {
+	testCases := createMessageContainsTests(
+		ConflictErrorCode,
+		http.StatusConflict,
+		"The request failed due to conflict with a concurrent request. To resolve it, please refer to https://aka.ms/activitylog to get more details on the conflicting requests.",
+		"Conflict",
+		createResponseError,
+	)
+	checkErrors(t, "IsConflict", testCases, IsConflict)
+}
+
+func TestIsAnotherOperationInProgress(t *testing.T) {
+	testCases := createMessageContainsTests(
+		AnotherOperationInProgressErrorCode,
+		http.StatusConflict,
+		"Another operation on this or dependent resource is in progress. To retrieve status of the operation use uri: https://management.azure.com/subscriptions/12345/providers/Microsoft.Network/locations/eastus/operations/abc?api-version=2023-09-01.",
+		"Another Operation In Progress",
+		createResponseError,
+	)
+	checkErrors(t, "IsAnotherOperationInProgress", testCases, IsAnotherOperationInProgress)
+}
+
+func TestIsPreconditionFailed(t *testing.T) {
+	testCases := createMessageContainsTests(
+		PreconditionFailedErrorCode,
+		http.StatusPreconditionFailed,
+		"The condition specified using HTTP conditional header(s) is not met.",
+		"Precondition Failed",
+		createResponseError,
+	)
+	checkErrors(t, "IsPreconditionFailed", testCases, IsPreconditionFailed)
+	assert.True(t, IsPreconditionFailed(createResponseError("", http.StatusPreconditionFailed, "")))
+}
+
+func TestIsInvalidParameter(t *testing.T) {
+	testCases := createMessageContainsTests(
+		InvalidParameterErrorCode,
+		http.StatusBadRequest,
+		"The value of parameter linuxConfiguration.ssh.publicKeys.keyData is invalid.",
+		"Invalid Parameter",
+		createResponseError,
+	)
+	checkErrors(t, "IsInvalidParameter", testCases, IsInvalidParameter)
+}
+
+func TestResourceQuotaHasBeenReached(t *testing.T) {
+	testCases := createMessageContainsTests(
+		ResourceQuotaExceededErrorCode,
+		http.StatusConflict,
+		"Creating the resource of type 'Microsoft.Network/publicIPAddresses' would exceed the quota of '800' resources of type 'Microsoft.Network/publicIPAddresses' per resource group.",
+		"Resource Quota Exceeded",
+		createResponseError,
+	)
+	checkErrors(t, "ResourceQuotaHasBeenReached", testCases, ResourceQuotaHasBeenReached)
+}
+
+func TestIsSubnetFull(t *testing.T) {
+	testCases := createMessageContainsTests(
+		SubnetIsFullErrorCode,
+		http.StatusBadRequest,
+		"Subnet default with address prefix 10.0.0.0/24 does not have enough capacity for 5 IP addresses.",
+		"Subnet Is Full",
+		createResponseError,
+	)
+	checkErrors(t, "IsSubnetFull", testCases, IsSubnetFull)
+}
+
+func TestPublicIPCountLimitHasBeenReached(t *testing.T) {
+	testCases := createMessageContainsTests(
+		PublicIPCountLimitReachedErrorCode,
+		http.StatusBadRequest,
+		"Cannot create more than 1000 public IP addresses for this subscription in this region.",
+		"Public IP Count Limit Reached",
+		createResponseError,
+	)
+	checkErrors(t, "PublicIPCountLimitHasBeenReached", testCases, PublicIPCountLimitHasBeenReached)
+}
+
+func TestIsRequestDisallowedByPolicy(t *testing.T) {
+	testCases := createMessageContainsTests(
+		RequestDisallowedByPolicyErrorCode,
+		http.StatusForbidden,
+		"Resource 'my-vm' was disallowed by policy. Reasons: 'Allowed locations'. See error details for policy resource IDs.",
+		"Request Disallowed By Policy",
+		createResponseError,
+	)
+	checkErrors(t, "IsRequestDisallowedByPolicy", testCases, IsRequestDisallowedByPolicy)
+}
+
+func TestIsReadOnlyDisabledSubscription(t *testing.T) {
+	testCases := createMessageContainsTests(
+		ReadOnlyDisabledSubscriptionErrorCode,
+		http.StatusConflict,
+		"The subscription '12345' is disabled and therefore marked as read only. You cannot perform any write actions on this subscription until it is re-enabled.",
+		"Read Only Disabled Subscription",
+		createResponseError,
+	)
+	checkErrors(t, "IsReadOnlyDisabledSubscription", testCases, IsReadOnlyDisabledSubscription)
+}
+
+func TestIsMissingSubscriptionRegistration(t *testing.T) {
+	testCases := createMessageContainsTests(
+		MissingSubscriptionRegistrationErrorCode,
+		http.StatusConflict,
+		"The subscription is not registered to use namespace 'Microsoft.ContainerService'. See https://aka.ms/rps-not-found for how to register subscriptions.",
+		"Missing Subscription Registration",
+		createResponseError,
+	)
+	checkErrors(t, "IsMissingSubscriptionRegistration", testCases, IsMissingSubscriptionRegistration)
+}
+
+func TestIsOperationPreempted(t *testing.T) {
+	testCases := createMessageContainsTests(
+		OperationPreemptedErrorCode,
+		http.StatusConflict,
+		"Operation execution has been preempted by a more recent operation.",
+		"Operation Preempted",
+		createResponseError,
+	)
+	checkErrors(t, "IsOperationPreempted", testCases, IsOperationPreempted)
+}
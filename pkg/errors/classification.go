@@ -0,0 +1,187 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package errors
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerservice/armcontainerservice/v8"
+)
+
+// ErrorCategory groups ARM errors that call for the same handling.
+type ErrorCategory string
+
+const (
+	// ErrorCategoryUnknown is used for errors that could not be classified, including errors that are not ARM responses.
+	ErrorCategoryUnknown ErrorCategory = "Unknown"
+	// ErrorCategoryNotFound is used when the resource, its parent or its resource group does not exist.
+	ErrorCategoryNotFound ErrorCategory = "NotFound"
+	// ErrorCategoryConflict is used when the request conflicts with the state of the resource or another operation.
+	ErrorCategoryConflict ErrorCategory = "Conflict"
+	// ErrorCategoryPreconditionFailed is used when the ETag condition of the request is not met.
+	ErrorCategoryPreconditionFailed ErrorCategory = "PreconditionFailed"
+	// ErrorCategoryInvalidRequest is used when the request itself is invalid.
+	ErrorCategoryInvalidRequest ErrorCategory = "InvalidRequest"
+	// ErrorCategoryQuotaExceeded is used when a core, resource or public IP quota has been reached.
+	ErrorCategoryQuotaExceeded ErrorCategory = "QuotaExceeded"
+	// ErrorCategoryZonalAllocationFailed is used when capacity could not be allocated in a zone.
+	ErrorCategoryZonalAllocationFailed ErrorCategory = "ZonalAllocationFailed"
+	// ErrorCategoryAllocationFailed is used when capacity could not be allocated in a region.
+	ErrorCategoryAllocationFailed ErrorCategory = "AllocationFailed"
+	// ErrorCategorySKUNotAvailable is used when the SKU is not available in the location or zone.
+	ErrorCategorySKUNotAvailable ErrorCategory = "SKUNotAvailable"
+	// ErrorCategorySubnetFull is used when a subnet ran out of IP addresses.
+	ErrorCategorySubnetFull ErrorCategory = "SubnetFull"
+	// ErrorCategoryNicReserved is used when a NIC is still reserved for a deleted VM.
+	ErrorCategoryNicReserved ErrorCategory = "NicReserved"
+	// ErrorCategoryPolicyDisallowed is used when an Azure Policy assignment denied the request.
+	ErrorCategoryPolicyDisallowed ErrorCategory = "PolicyDisallowed"
+	// ErrorCategorySubscriptionDisabled is used when the subscription is disabled and read only.
+	ErrorCategorySubscriptionDisabled ErrorCategory = "SubscriptionDisabled"
+	// ErrorCategorySubscriptionNotRegistered is used when the subscription is not registered with the resource provider.
+	ErrorCategorySubscriptionNotRegistered ErrorCategory = "SubscriptionNotRegistered"
+	// ErrorCategoryAuthorization is used when the caller is not authenticated or not authorized.
+	ErrorCategoryAuthorization ErrorCategory = "Authorization"
+	// ErrorCategoryThrottled is used when the request was throttled.
+	ErrorCategoryThrottled ErrorCategory = "Throttled"
+	// ErrorCategoryPreempted is used when the operation was canceled in favor of a more recent one.
+	ErrorCategoryPreempted ErrorCategory = "Preempted"
+	// ErrorCategoryTransient is used for server side failures that are expected to go away on retry.
+	ErrorCategoryTransient ErrorCategory = "Transient"
+)
+
+// Sentinel errors for the categories, matched by ResponseErrorWrapper so that
+// errors.Is(err, ErrZonalAllocationFailed) works for wrapped ARM errors.
+var (
+	ErrNotFound                  = errors.New("resource not found")
+	ErrConflict                  = errors.New("conflict")
+	ErrPreconditionFailed        = errors.New("precondition failed")
+	ErrInvalidRequest            = errors.New("invalid request")
+	ErrQuotaExceeded             = errors.New("quota exceeded")
+	ErrZonalAllocationFailed     = errors.New("zonal allocation failed")
+	ErrAllocationFailed          = errors.New("allocation failed")
+	ErrSKUNotAvailable           = errors.New("SKU not available")
+	ErrSubnetFull                = errors.New("subnet full")
+	ErrNicReserved               = errors.New("NIC reserved for another VM")
+	ErrPolicyDisallowed          = errors.New("request disallowed by policy")
+	ErrSubscriptionDisabled      = errors.New("subscription disabled")
+	ErrSubscriptionNotRegistered = errors.New("subscription not registered with resource provider")
+	ErrAuthorization             = errors.New("authorization failed")
+	ErrThrottled                 = errors.New("throttled")
+	ErrPreempted                 = errors.New("operation preempted")
+	ErrTransient                 = errors.New("transient failure")
+)
+
+var categorySentinels = map[ErrorCategory]error{
+	ErrorCategoryNotFound:                  ErrNotFound,
+	ErrorCategoryConflict:                  ErrConflict,
+	ErrorCategoryPreconditionFailed:        ErrPreconditionFailed,
+	ErrorCategoryInvalidRequest:            ErrInvalidRequest,
+	ErrorCategoryQuotaExceeded:             ErrQuotaExceeded,
+	ErrorCategoryZonalAllocationFailed:     ErrZonalAllocationFailed,
+	ErrorCategoryAllocationFailed:          ErrAllocationFailed,
+	ErrorCategorySKUNotAvailable:           ErrSKUNotAvailable,
+	ErrorCategorySubnetFull:                ErrSubnetFull,
+	ErrorCategoryNicReserved:               ErrNicReserved,
+	ErrorCategoryPolicyDisallowed:          ErrPolicyDisallowed,
+	ErrorCategorySubscriptionDisabled:      ErrSubscriptionDisabled,
+	ErrorCategorySubscriptionNotRegistered: ErrSubscriptionNotRegistered,
+	ErrorCategoryAuthorization:             ErrAuthorization,
+	ErrorCategoryThrottled:                 ErrThrottled,
+	ErrorCategoryPreempted:                 ErrPreempted,
+	ErrorCategoryTransient:                 ErrTransient,
+}
+
+// Sentinel returns the sentinel error of the category, or nil for ErrorCategoryUnknown.
+func (c ErrorCategory) Sentinel() error {
+	return categorySentinels[c]
+}
+
+// ClassifyError returns the category of an ARM error.
+// Errors that are not *azcore.ResponseError are classified as ErrorCategoryUnknown.
+func ClassifyError(err error) ErrorCategory {
+	azErr := IsResponseError(err)
+	if azErr == nil {
+		return ErrorCategoryUnknown
+	}
+	return classifyError(azErr.StatusCode, errorCode(azErr), azErr.Error())
+}
+
+// ClassifyErrorDetail returns the category of an ErrorDetail.
+// As the ErrorDetail carries no HTTP status code, only the error code and message are considered.
+func ClassifyErrorDetail(errorDetail armcontainerservice.ErrorDetail) ErrorCategory {
+	code, message := extractErrorDetailDetails(errorDetail)
+	return classifyError(0, code, message)
+}
+
+// classifyError is the single source of truth for classification.
+// The error code takes precedence over the HTTP status code, which is only used for unknown codes.
+func classifyError(statusCode int, code, message string) ErrorCategory {
+	switch {
+	case isResourceGroupNotFound(code), isResourceNotFound(code), isParentResourceNotFound(code):
+		return ErrorCategoryNotFound
+	case isConflict(code), isAnotherOperationInProgress(code):
+		return ErrorCategoryConflict
+	case isPreconditionFailed(code):
+		return ErrorCategoryPreconditionFailed
+	case isInvalidParameter(code):
+		return ErrorCategoryInvalidRequest
+	case isResourceQuotaExceeded(code), isPublicIPCountLimitReached(code),
+		isLowPriorityQuotaExceeded(code, message), isSKUFamilyQuotaExceeded(code, message),
+		isSubscriptionQuotaExceeded(code, message), isRegionalQuotaExceeded(code, message):
+		return ErrorCategoryQuotaExceeded
+	case isZonalAllocationFailed(code), isOverconstrainedZonalAllocationFailed(code):
+		return ErrorCategoryZonalAllocationFailed
+	case isAllocationFailed(code), isOverconstrainedAllocationFailed(code):
+		return ErrorCategoryAllocationFailed
+	case isSKUNotAvailable(code):
+		return ErrorCategorySKUNotAvailable
+	case isSubnetFull(code), isInsufficientSubnetSize(code):
+		return ErrorCategorySubnetFull
+	case isNicReservedForVM(code):
+		return ErrorCategoryNicReserved
+	case isRequestDisallowedByPolicy(code):
+		return ErrorCategoryPolicyDisallowed
+	case isReadOnlyDisabledSubscription(code):
+		return ErrorCategorySubscriptionDisabled
+	case isMissingSubscriptionRegistration(code):
+		return ErrorCategorySubscriptionNotRegistered
+	case isOperationPreempted(code):
+		return ErrorCategoryPreempted
+	case isThrottled(code):
+		return ErrorCategoryThrottled
+	case isRetryable(code):
+		return ErrorCategoryTransient
+	}
+
+	switch {
+	case statusCode == http.StatusNotFound:
+		return ErrorCategoryNotFound
+	case statusCode == http.StatusConflict:
+		return ErrorCategoryConflict
+	case statusCode == http.StatusPreconditionFailed:
+		return ErrorCategoryPreconditionFailed
+	case statusCode == http.StatusUnauthorized, statusCode == http.StatusForbidden:
+		return ErrorCategoryAuthorization
+	case statusCode == http.StatusTooManyRequests:
+		return ErrorCategoryThrottled
+	case statusCode == http.StatusRequestTimeout, statusCode >= http.StatusInternalServerError:
+		return ErrorCategoryTransient
+	case statusCode == http.StatusBadRequest:
+		return ErrorCategoryInvalidRequest
+	}
+	return ErrorCategoryUnknown
+}
@@ -0,0 +1,100 @@
+package errors
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name       string
+		errorCode  string
+		statusCode int
+		message    string
+		expected   ErrorCategory
+	}{
+		{"resource group not found", ResourceGroupNotFoundErrorCode, http.StatusNotFound, "Resource group 'my-rg' could not be found.", ErrorCategoryNotFound},
+		{"parent resource not found", ParentResourceNotFoundErrorCode, http.StatusNotFound, "Parent resource 'my-vnet' not found.", ErrorCategoryNotFound},
+		{"another operation in progress", AnotherOperationInProgressErrorCode, http.StatusConflict, "Another operation on this or dependent resource is in progress.", ErrorCategoryConflict},
+		{"precondition failed", PreconditionFailedErrorCode, http.StatusPreconditionFailed, "The condition specified using HTTP conditional header(s) is not met.", ErrorCategoryPreconditionFailed},
+		{"invalid parameter", InvalidParameterErrorCode, http.StatusBadRequest, "The value of parameter osProfile.adminPassword is invalid.", ErrorCategoryInvalidRequest},
+		{"sku family quota", OperationNotAllowed, http.StatusForbidden, "Operation could not be completed as it results in exceeding approved standardDSv3Family Family Cores quota.", ErrorCategoryQuotaExceeded},
+		{"public ip count limit", PublicIPCountLimitReachedErrorCode, http.StatusBadRequest, "Cannot create more than 1000 public IP addresses for this subscription in this region.", ErrorCategoryQuotaExceeded},
+		{"zonal allocation failed", ZoneAllocationFailed, http.StatusConflict, "Allocation failed in zone '1'.", ErrorCategoryZonalAllocationFailed},
+		{"overconstrained allocation", OverconstrainedAllocationRequest, http.StatusConflict, "Allocation failed. Constraints applied are: Accelerated Networking", ErrorCategoryAllocationFailed},
+		{"sku not available", SKUNotAvailableErrorCode, http.StatusConflict, "The requested VM size Standard_D2s_v3 is currently not available in location 'westus'.", ErrorCategorySKUNotAvailable},
+		{"subnet is full", SubnetIsFullErrorCode, http.StatusBadRequest, "Subnet default does not have enough capacity for 5 IP addresses.", ErrorCategorySubnetFull},
+		{"nic reserved", NicReservedForAnotherVM, http.StatusBadRequest, "Nic is reserved for VM.", ErrorCategoryNicReserved},
+		{"policy", RequestDisallowedByPolicyErrorCode, http.StatusForbidden, "Resource 'my-vm' was disallowed by policy.", ErrorCategoryPolicyDisallowed},
+		{"disabled subscription", ReadOnlyDisabledSubscriptionErrorCode, http.StatusConflict, "The subscription is disabled and therefore marked as read only.", ErrorCategorySubscriptionDisabled},
+		{"unregistered subscription", MissingSubscriptionRegistrationErrorCode, http.StatusConflict, "The subscription is not registered to use namespace 'Microsoft.Compute'.", ErrorCategorySubscriptionNotRegistered},
+		{"preempted", OperationPreemptedErrorCode, http.StatusConflict, "Operation execution has been preempted by a more recent operation.", ErrorCategoryPreempted},
+		{"throttled code", SubscriptionRequestsThrottledErrorCode, http.StatusTooManyRequests, "Number of requests for subscription exceeded the limit.", ErrorCategoryThrottled},
+		{"retryable error", RetryableErrorCode, http.StatusConflict, "A retryable error occurred.", ErrorCategoryTransient},
+		{"operation not allowed without quota term falls back to status", OperationNotAllowed, http.StatusConflict, "Operation is not allowed.", ErrorCategoryConflict},
+		{"unknown code with 404", "SomethingNotFound", http.StatusNotFound, "", ErrorCategoryNotFound},
+		{"unknown code with 403", "AuthorizationFailed", http.StatusForbidden, "The client does not have authorization to perform action.", ErrorCategoryAuthorization},
+		{"unknown code with 429", "", http.StatusTooManyRequests, "", ErrorCategoryThrottled},
+		{"unknown code with 503", "ServiceUnavailable", http.StatusServiceUnavailable, "", ErrorCategoryTransient},
+		{"unknown code with 400", "BadRequest", http.StatusBadRequest, "", ErrorCategoryInvalidRequest},
+		{"unknown code with unexpected status", "Unexpected", http.StatusTeapot, "", ErrorCategoryUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, ClassifyError(createResponseError(tt.errorCode, tt.statusCode, tt.message)))
+		})
+	}
+
+	t.Run("non response errors are unknown", func(t *testing.T) {
+		assert.Equal(t, ErrorCategoryUnknown, ClassifyError(errors.New("some other error")))
+		assert.Equal(t, ErrorCategoryUnknown, ClassifyError(nil))
+	})
+}
+
+func TestClassifyErrorDetail(t *testing.T) {
+	assert.Equal(t, ErrorCategoryZonalAllocationFailed, ClassifyErrorDetail(createErrorDetail(ZoneAllocationFailed, "")))
+	assert.Equal(t, ErrorCategoryQuotaExceeded, ClassifyErrorDetail(createErrorDetail(OperationNotAllowed, "exceeding approved Total Regional Cores quota")))
+	assert.Equal(t, ErrorCategoryUnknown, ClassifyErrorDetail(createErrorDetail("Unexpected", "")))
+}
+
+func TestCategorySentinels(t *testing.T) {
+	zonalErr := createResponseError(ZoneAllocationFailed, http.StatusConflict, "Allocation failed in zone '1'.")
+
+	t.Run("wrapper matches the sentinel of its category", func(t *testing.T) {
+		wrapped := WrapResponseError(zonalErr)
+		assert.ErrorIs(t, wrapped, ErrZonalAllocationFailed)
+		assert.NotErrorIs(t, wrapped, ErrAllocationFailed)
+		assert.NotErrorIs(t, wrapped, ErrNotFound)
+	})
+
+	t.Run("wrapper wrapped by fmt.Errorf", func(t *testing.T) {
+		err := fmt.Errorf("creating node: %w", WrapResponseError(zonalErr))
+		assert.ErrorIs(t, err, ErrZonalAllocationFailed)
+		assert.Equal(t, zonalErr, IsResponseError(err))
+	})
+
+	t.Run("status code fallback", func(t *testing.T) {
+		assert.ErrorIs(t, WrapResponseError(createResponseError("", http.StatusTooManyRequests, "")), ErrThrottled)
+		assert.ErrorIs(t, WrapResponseError(createResponseError("Whatever", http.StatusServiceUnavailable, "")), ErrTransient)
+	})
+
+	t.Run("every category except unknown has a sentinel", func(t *testing.T) {
+		assert.Nil(t, ErrorCategoryUnknown.Sentinel())
+		assert.Equal(t, ErrQuotaExceeded, ErrorCategoryQuotaExceeded.Sentinel())
+		assert.Len(t, categorySentinels, 17)
+	})
+
+	t.Run("unknown errors match no sentinel", func(t *testing.T) {
+		wrapped := WrapResponseError(createResponseError("Whatever", http.StatusTeapot, ""))
+		for _, sentinel := range categorySentinels {
+			assert.NotErrorIs(t, wrapped, sentinel)
+		}
+		assert.NotErrorIs(t, NewResponseErrorWrapper(nil), ErrNotFound)
+		assert.NotErrorIs(t, errors.New("some other error"), ErrNotFound)
+	})
+}
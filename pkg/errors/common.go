@@ -60,3 +60,67 @@ func isInsufficientSubnetSize(code string) bool {
 func isNicReservedForVM(code string) bool {
 	return code == NicReservedForAnotherVM
 }
+
+func isResourceGroupNotFound(code string) bool {
+	return code == ResourceGroupNotFoundErrorCode
+}
+
+func isResourceNotFound(code string) bool {
+	return code == ResourceNotFoundErrorCode
+}
+
+func isParentResourceNotFound(code string) bool {
+	return code == ParentResourceNotFoundErrorCode
+}
+
+func isConflict(code string) bool {
+	return code == ConflictErrorCode
+}
+
+func isAnotherOperationInProgress(code string) bool {
+	return code == AnotherOperationInProgressErrorCode
+}
+
+func isPreconditionFailed(code string) bool {
+	return code == PreconditionFailedErrorCode
+}
+
+func isInvalidParameter(code string) bool {
+	return code == InvalidParameterErrorCode
+}
+
+func isResourceQuotaExceeded(code string) bool {
+	return code == ResourceQuotaExceededErrorCode
+}
+
+func isSubnetFull(code string) bool {
+	return code == SubnetIsFullErrorCode
+}
+
+func isPublicIPCountLimitReached(code string) bool {
+	return code == PublicIPCountLimitReachedErrorCode
+}
+
+func isRequestDisallowedByPolicy(code string) bool {
+	return code == RequestDisallowedByPolicyErrorCode
+}
+
+func isReadOnlyDisabledSubscription(code string) bool {
+	return code == ReadOnlyDisabledSubscriptionErrorCode
+}
+
+func isMissingSubscriptionRegistration(code string) bool {
+	return code == MissingSubscriptionRegistrationErrorCode
+}
+
+func isOperationPreempted(code string) bool {
+	return code == OperationPreemptedErrorCode
+}
+
+func isThrottled(code string) bool {
+	return code == TooManyRequestsErrorCode || code == SubscriptionRequestsThrottledErrorCode
+}
+
+func isRetryable(code string) bool {
+	return code == RetryableErrorCode
+}
@@ -12,6 +12,24 @@ const (
 	SKUNotAvailableErrorCode              = "SkuNotAvailable"
 	InsufficientSubnetSizeErrorCode       = "InsufficientSubnetSize"
 
+	ResourceGroupNotFoundErrorCode           = "ResourceGroupNotFound"
+	ResourceNotFoundErrorCode                = "ResourceNotFound"
+	ParentResourceNotFoundErrorCode          = "ParentResourceNotFound"
+	ConflictErrorCode                        = "Conflict"
+	AnotherOperationInProgressErrorCode      = "AnotherOperationInProgress"
+	PreconditionFailedErrorCode              = "PreconditionFailed"
+	InvalidParameterErrorCode                = "InvalidParameter"
+	ResourceQuotaExceededErrorCode           = "ResourceQuotaExceeded"
+	SubnetIsFullErrorCode                    = "SubnetIsFull"
+	PublicIPCountLimitReachedErrorCode       = "PublicIPCountLimitReached"
+	RequestDisallowedByPolicyErrorCode       = "RequestDisallowedByPolicy"
+	ReadOnlyDisabledSubscriptionErrorCode    = "ReadOnlyDisabledSubscription"
+	MissingSubscriptionRegistrationErrorCode = "MissingSubscriptionRegistration"
+	OperationPreemptedErrorCode              = "OperationPreempted"
+	TooManyRequestsErrorCode                 = "TooManyRequests"
+	SubscriptionRequestsThrottledErrorCode   = "SubscriptionRequestsThrottled"
+	RetryableErrorCode                       = "RetryableError"
+
 	// Error search terms
 	LowPriorityQuotaExceededTerm  = "LowPriorityCores"
 	SKUFamilyQuotaExceededTerm    = "Family Cores quota"
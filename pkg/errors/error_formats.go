@@ -0,0 +1,119 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package errors
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+)
+
+// Data plane services built on the same azcore pipeline do not all use the ARM error format.
+// The formats below are normalized into an AzureErrorResponse so that the wrapper and the predicates work for them too.
+
+// odataErrorResponse is the OData v3 format used by e.g. Table storage:
+// {"odata.error":{"code":"...","message":{"lang":"en-US","value":"..."}}}
+type odataErrorResponse struct {
+	Error *struct {
+		Code    string `json:"code"`
+		Message struct {
+			Value string `json:"value"`
+		} `json:"message"`
+	} `json:"odata.error"`
+}
+
+// oauthErrorResponse is the OAuth 2.0 format used by Microsoft Entra ID:
+// {"error":"invalid_client","error_description":"AADSTS7000215: Invalid client secret provided..."}
+type oauthErrorResponse struct {
+	Error            json.RawMessage `json:"error"`
+	ErrorDescription string          `json:"error_description"`
+}
+
+// xmlErrorResponse is the XML format used by e.g. Blob, Queue and File storage and Service Bus:
+// <Error><Code>BlobNotFound</Code><Message>The specified blob does not exist.</Message></Error>
+type xmlErrorResponse struct {
+	XMLName                   xml.Name `xml:"Error"`
+	Code                      string   `xml:"Code"`
+	Message                   string   `xml:"Message"`
+	Detail                    string   `xml:"Detail"`
+	AuthenticationErrorDetail string   `xml:"AuthenticationErrorDetail"`
+}
+
+// parseAzureErrorResponse parses an error body. Besides the ARM format, with and without the "error" wrapper,
+// it understands OData, OAuth and XML error bodies. Graph and Key Vault errors use the ARM format with an inner error.
+func parseAzureErrorResponse(body []byte) (*AzureErrorResponse, error) {
+	// storage prefixes its XML bodies with a byte order mark
+	trimmed := bytes.TrimPrefix(bytes.TrimSpace(body), []byte("\ufeff"))
+	if len(trimmed) > 0 && trimmed[0] == '<' {
+		return parseXMLErrorResponse(trimmed)
+	}
+
+	var result AzureErrorResponse
+	if err := unmarshalTolerant(body, &result); err != nil {
+		return nil, err
+	}
+	if azureError := result.azureError(); azureError.Code != "" || azureError.Message != "" {
+		return &result, nil
+	}
+
+	var odata odataErrorResponse
+	if err := unmarshalTolerant(body, &odata); err == nil && odata.Error != nil {
+		result.Error = AzureError{Code: odata.Error.Code, Message: odata.Error.Message.Value}
+		return &result, nil
+	}
+
+	var oauth oauthErrorResponse
+	if err := unmarshalTolerant(body, &oauth); err == nil {
+		var code string
+		if json.Unmarshal(oauth.Error, &code) == nil && code != "" {
+			result.Error = AzureError{Code: code, Message: oauth.ErrorDescription}
+		}
+	}
+	return &result, nil
+}
+
+func parseXMLErrorResponse(body []byte) (*AzureErrorResponse, error) {
+	var xmlError xmlErrorResponse
+	if err := xml.Unmarshal(body, &xmlError); err != nil {
+		return nil, err
+	}
+	message := xmlError.Message
+	if message == "" {
+		message = xmlError.Detail
+	}
+	if xmlError.AuthenticationErrorDetail != "" {
+		message += " " + xmlError.AuthenticationErrorDetail
+	}
+	return &AzureErrorResponse{Error: AzureError{Code: xmlError.Code, Message: message}}, nil
+}
+
+// ParseResponseError returns the error of the body of an *azcore.ResponseError in any of the formats
+// parseAzureErrorResponse understands, without consuming the body.
+// It returns nil if the error is not an *azcore.ResponseError or the body holds no error.
+func ParseResponseError(err error) *AzureError {
+	azErr := IsResponseError(err)
+	if azErr == nil {
+		return nil
+	}
+	result, parseErr := parseAzureErrorResponse(responseBody(azErr))
+	if parseErr != nil {
+		return nil
+	}
+	azureError := result.azureError()
+	if azureError.Code == "" && azureError.Message == "" {
+		return nil
+	}
+	return &azureError
+}
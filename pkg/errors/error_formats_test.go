@@ -0,0 +1,152 @@
+package errors
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAzureErrorResponse(t *testing.T) {
+	tests := []struct {
+		name            string
+		body            string
+		expectedCode    string
+		expectedMessage string
+		expectedInner   string
+	}{
+		{
+			name:            "ARM wrapped",
+			body:            `{"error": {"code": "SubnetIsFull", "message": "Subnet is full."}}`,
+			expectedCode:    "SubnetIsFull",
+			expectedMessage: "Subnet is full.",
+		},
+		{
+			name:            "ARM unwrapped",
+			body:            `{"code": "NotFound", "message": "Entity with the specified id does not exist in the system."}`,
+			expectedCode:    "NotFound",
+			expectedMessage: "Entity with the specified id does not exist in the system.",
+		},
+		{
+			name:            "OData",
+			body:            `{"odata.error": {"code": "TableNotFound", "message": {"lang": "en-US", "value": "The table specified does not exist.\nRequestId:abc\nTime:2023-07-03T12:00:00.0000000Z"}}}`,
+			expectedCode:    "TableNotFound",
+			expectedMessage: "The table specified does not exist.\nRequestId:abc\nTime:2023-07-03T12:00:00.0000000Z",
+		},
+		{
+			name:            "Storage XML",
+			body:            "\ufeff<?xml version=\"1.0\" encoding=\"utf-8\"?><Error><Code>ContainerNotFound</Code><Message>The specified container does not exist.\nRequestId:abc\nTime:2023-07-03T12:00:00.0000000Z</Message></Error>",
+			expectedCode:    "ContainerNotFound",
+			expectedMessage: "The specified container does not exist.\nRequestId:abc\nTime:2023-07-03T12:00:00.0000000Z",
+		},
+		{
+			name:            "Storage XML with authentication detail",
+			body:            `<?xml version="1.0" encoding="utf-8"?><Error><Code>AuthenticationFailed</Code><Message>Server failed to authenticate the request.</Message><AuthenticationErrorDetail>Signature did not match.</AuthenticationErrorDetail></Error>`,
+			expectedCode:    "AuthenticationFailed",
+			expectedMessage: "Server failed to authenticate the request. Signature did not match.",
+		},
+		{
+			name:            "Service Bus XML",
+			body:            `<Error><Code>401</Code><Detail>InvalidSignature: The token has an invalid signature.</Detail></Error>`,
+			expectedCode:    "401",
+			expectedMessage: "InvalidSignature: The token has an invalid signature.",
+		},
+		{
+			name:            "Graph",
+			body:            `{"error": {"code": "Request_ResourceNotFound", "message": "Resource '1234' does not exist or one of its queried reference-property objects are not present.", "innerError": {"date": "2023-07-03T12:00:00", "request-id": "abc", "client-request-id": "def"}}}`,
+			expectedCode:    "Request_ResourceNotFound",
+			expectedMessage: "Resource '1234' does not exist or one of its queried reference-property objects are not present.",
+		},
+		{
+			name:            "Key Vault",
+			body:            `{"error": {"code": "Forbidden", "message": "Operation get is not allowed on a disabled secret.", "innererror": {"code": "SecretDisabled"}}}`,
+			expectedCode:    "Forbidden",
+			expectedMessage: "Operation get is not allowed on a disabled secret.",
+			expectedInner:   "SecretDisabled",
+		},
+		{
+			name:            "OAuth",
+			body:            `{"error": "invalid_client", "error_description": "AADSTS7000215: Invalid client secret provided.", "error_codes": [7000215]}`,
+			expectedCode:    "invalid_client",
+			expectedMessage: "AADSTS7000215: Invalid client secret provided.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseAzureErrorResponse([]byte(tt.body))
+			require.NoError(t, err)
+			azureError := result.azureError()
+			assert.Equal(t, tt.expectedCode, azureError.Code)
+			assert.Equal(t, tt.expectedMessage, azureError.Message)
+			if tt.expectedInner != "" {
+				require.NotNil(t, azureError.InnerError)
+				assert.Equal(t, tt.expectedInner, azureError.InnerError.Code)
+			}
+		})
+	}
+
+	t.Run("invalid bodies", func(t *testing.T) {
+		_, err := parseAzureErrorResponse([]byte(`not an error`))
+		assert.Error(t, err)
+		_, err = parseAzureErrorResponse([]byte(`<Error><Code>Unclosed`))
+		assert.Error(t, err)
+	})
+}
+
+func TestDataPlaneErrorsWithoutErrorCodeHeader(t *testing.T) {
+	newResponseError := func(statusCode int, body string) *azcore.ResponseError {
+		return &azcore.ResponseError{
+			StatusCode: statusCode,
+			RawResponse: &http.Response{
+				StatusCode: statusCode,
+				Body:       io.NopCloser(bytes.NewBufferString(body)),
+				Request: &http.Request{
+					Method: http.MethodGet,
+					URL:    &url.URL{Scheme: "https", Host: "account.table.core.windows.net", Path: "/Tables('missing')"},
+				},
+			},
+		}
+	}
+
+	t.Run("wrapper uses the code of the body", func(t *testing.T) {
+		respErr := newResponseError(http.StatusNotFound, `{"odata.error": {"code": "TableNotFound", "message": {"lang": "en-US", "value": "The table specified does not exist."}}}`)
+		assert.Equal(t, "HTTP CODE: 404, ERROR CODE: TableNotFound, MESSAGE: The table specified does not exist., REQUEST: GET https://account.table.core.windows.net/Tables%28%27missing%27%29", NewResponseErrorWrapper(respErr).Error())
+	})
+
+	t.Run("predicates use the code of the body", func(t *testing.T) {
+		respErr := newResponseError(http.StatusBadRequest, `<?xml version="1.0" encoding="utf-8"?><Error><Code>SubnetIsFull</Code><Message>Subnet is full.</Message></Error>`)
+		assert.True(t, IsSubnetFull(respErr))
+		assert.Equal(t, ErrorCategorySubnetFull, ClassifyError(respErr))
+	})
+}
+
+func TestParseResponseError(t *testing.T) {
+	respErr := createResponseError(SubnetIsFullErrorCode, http.StatusBadRequest, "Subnet is full.")
+	azureError := ParseResponseError(respErr)
+	require.NotNil(t, azureError)
+	assert.Equal(t, SubnetIsFullErrorCode, azureError.Code)
+	assert.Equal(t, "Subnet is full.", azureError.Message)
+	// the body is left for other consumers
+	assert.Equal(t, azureError, ParseResponseError(respErr))
+	assert.Contains(t, respErr.Error(), "Subnet is full.")
+
+	assert.Nil(t, ParseResponseError(newResponseErrorWithBody(`not an error`)))
+	assert.Nil(t, ParseResponseError(newResponseErrorWithBody(`{}`)))
+	assert.Nil(t, ParseResponseError(nil))
+}
+
+func newResponseErrorWithBody(body string) *azcore.ResponseError {
+	return &azcore.ResponseError{
+		StatusCode: http.StatusBadRequest,
+		RawResponse: &http.Response{
+			StatusCode: http.StatusBadRequest,
+			Body:       io.NopCloser(bytes.NewBufferString(body)),
+		},
+	}
+}
@@ -0,0 +1,236 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package errors
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+// ProvisioningStateFailedErrorCode is used for resources that report a failed provisioningState without any error.
+const ProvisioningStateFailedErrorCode = "ProvisioningStateFailed"
+
+// embeddedCodeMatcher matches the inner errors some resource providers (e.g. AKS) embed in their messages,
+// such as: Code="ZonalAllocationFailed" Message="Allocation failed..."
+var embeddedCodeMatcher = regexp.MustCompile(`Code="(\w+)"(?:\s*Message="([^"]*)")?`)
+
+// LROFailure describes a failed long-running operation.
+type LROFailure struct {
+	// Status is the status of the Azure-AsyncOperation status body, e.g. Failed or Canceled.
+	Status string
+	// ProvisioningState is the provisioningState of the resource, for operations that poll the resource itself.
+	ProvisioningState string
+	// Error is the error reported by the operation, as returned by the service.
+	Error AzureError
+	// Code is the most specific error code of the failure: resource providers often wrap the root cause
+	// in a generic code (e.g. InternalOperationError), so this is the most deeply nested code that can be classified.
+	Code string
+	// Message is the message that belongs to Code.
+	Message string
+}
+
+// lroStatusBody covers both Azure-AsyncOperation status bodies and resources with a provisioningState.
+type lroStatusBody struct {
+	Status     string      `json:"status"`
+	Error      *AzureError `json:"error"`
+	Properties *struct {
+		ProvisioningState string      `json:"provisioningState"`
+		Error             *AzureError `json:"error"`
+		ProvisioningError *AzureError `json:"provisioningError"`
+		Status            *struct {
+			ProvisioningError *AzureError `json:"provisioningError"`
+		} `json:"status"`
+		InstanceView *struct {
+			Statuses []struct {
+				Code    string `json:"code"`
+				Level   string `json:"level"`
+				Message string `json:"message"`
+			} `json:"statuses"`
+		} `json:"instanceView"`
+	} `json:"properties"`
+}
+
+// ExtractLROFailure returns the failure of a long-running operation from an error returned by runtime.Poller.
+// It understands Azure-AsyncOperation status bodies ({"status":"Failed","error":{...}}) and resources whose
+// provisioningState is Failed or Canceled. It returns nil if the error is not a failed long-running operation.
+func ExtractLROFailure(err error) *LROFailure {
+	azErr := IsResponseError(err)
+	if azErr == nil {
+		return nil
+	}
+	return parseLROFailure(responseBody(azErr))
+}
+
+// NormalizeLROError rewrites a failed long-running operation into the shape the predicates of this package understand:
+// a *azcore.ResponseError with the most specific error code, and a body of the form {"error":{code,message,details}}
+// where the details contain the error as returned by the service.
+// The returned error wraps err, so that errors.Is and errors.As still match the errors err wraps, while
+// IsResponseError and errors.As return the normalized *azcore.ResponseError.
+// Errors that are not failed long-running operations are returned unchanged.
+func NormalizeLROError(err error) error {
+	azErr := IsResponseError(err)
+	if azErr == nil {
+		return err
+	}
+	failure := parseLROFailure(responseBody(azErr))
+	if failure == nil {
+		return err
+	}
+
+	normalized := AzureError{Code: failure.Code, Message: failure.Message}
+	if failure.Error.Code != failure.Code || failure.Error.Message != failure.Message || failure.Error.Details != nil {
+		normalized.Details = []AzureError{failure.Error}
+	}
+	body, marshalErr := json.Marshal(AzureErrorResponse{Error: normalized})
+	if marshalErr != nil {
+		return err
+	}
+
+	resp := *azErr.RawResponse
+	resp.Header = azErr.RawResponse.Header.Clone()
+	resp.Header.Del("x-ms-error-code")
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+
+	return &lroError{
+		err: err,
+		normalized: &azcore.ResponseError{
+			ErrorCode:   failure.Code,
+			StatusCode:  azErr.StatusCode,
+			RawResponse: &resp,
+		},
+	}
+}
+
+// lroError is a failed long-running operation normalized by NormalizeLROError.
+type lroError struct {
+	// err is the error as returned to the caller, with any wrapping of the caller.
+	err        error
+	normalized *azcore.ResponseError
+}
+
+func (e *lroError) Error() string {
+	return e.normalized.Error()
+}
+
+// Unwrap returns the error that was normalized.
+func (e *lroError) Unwrap() error {
+	return e.err
+}
+
+// As returns the normalized response error, before errors.As reaches the original one through Unwrap.
+func (e *lroError) As(target any) bool {
+	if azErr, ok := target.(**azcore.ResponseError); ok {
+		*azErr = e.normalized
+		return true
+	}
+	return false
+}
+
+func isFailedLROState(state string) bool {
+	return strings.EqualFold(state, "Failed") || strings.EqualFold(state, "Canceled")
+}
+
+func parseLROFailure(body []byte) *LROFailure {
+	var status lroStatusBody
+	if len(body) == 0 || unmarshalTolerant(body, &status) != nil {
+		return nil
+	}
+
+	failure := &LROFailure{Status: status.Status}
+	var operationError *AzureError
+	switch {
+	case isFailedLROState(status.Status):
+		operationError = status.Error
+	case status.Properties != nil && isFailedLROState(status.Properties.ProvisioningState):
+		failure.Status = ""
+		failure.ProvisioningState = status.Properties.ProvisioningState
+		operationError = provisioningError(status)
+	default:
+		return nil
+	}
+
+	if operationError != nil {
+		failure.Error = *operationError
+	} else {
+		failure.Error = AzureError{
+			Code:    ProvisioningStateFailedErrorCode,
+			Message: "The operation finished in state " + failure.Status + failure.ProvisioningState + " without reporting an error.",
+		}
+	}
+	failure.Code, failure.Message = mostSpecificError(failure.Error)
+	return failure
+}
+
+// provisioningError finds the error of a resource that failed provisioning, in the places resource providers report it.
+func provisioningError(status lroStatusBody) *AzureError {
+	properties := status.Properties
+	switch {
+	case status.Error != nil:
+		return status.Error
+	case properties.Error != nil:
+		return properties.Error
+	case properties.ProvisioningError != nil:
+		return properties.ProvisioningError
+	case properties.Status != nil && properties.Status.ProvisioningError != nil:
+		return properties.Status.ProvisioningError
+	case properties.InstanceView != nil:
+		for _, s := range properties.InstanceView.Statuses {
+			// compute reports failures as "ProvisioningState/failed/<ErrorCode>"
+			if strings.EqualFold(s.Level, "Error") {
+				code := s.Code
+				if i := strings.LastIndex(code, "/"); i >= 0 {
+					code = code[i+1:]
+				}
+				return &AzureError{Code: code, Message: s.Message}
+			}
+		}
+	}
+	return nil
+}
+
+// mostSpecificError returns the deepest code and message of the error tree that can be classified,
+// including inner errors embedded in messages. The top level code is used if none can be classified.
+func mostSpecificError(azureError AzureError) (code, message string) {
+	code, message = azureError.Code, azureError.Message
+	bestDepth := -1
+
+	var walk func(e AzureError, depth int)
+	consider := func(c, m string, depth int) {
+		if depth > bestDepth && classifyError(0, c, m) != ErrorCategoryUnknown {
+			code, message, bestDepth = c, m, depth
+		}
+	}
+	walk = func(e AzureError, depth int) {
+		consider(e.Code, e.Message, depth)
+		for _, match := range embeddedCodeMatcher.FindAllStringSubmatch(e.Message, -1) {
+			embeddedMessage := match[2]
+			if embeddedMessage == "" {
+				embeddedMessage = e.Message
+			}
+			consider(match[1], embeddedMessage, depth+1)
+		}
+		for _, detail := range e.DetailErrors() {
+			walk(detail, depth+1)
+		}
+	}
+	walk(azureError, 0)
+	return code, message
+}
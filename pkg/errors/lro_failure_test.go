@@ -0,0 +1,150 @@
+package errors
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// loadLROFailure builds the error runtime.Poller returns for a recorded terminal polling response.
+func loadLROFailure(t *testing.T, name string) error {
+	body, err := os.ReadFile(filepath.Join("testdata", "lro", name))
+	require.NoError(t, err)
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+		Request: &http.Request{
+			Method: http.MethodGet,
+			URL: &url.URL{
+				Scheme: "https",
+				Host:   "management.azure.com",
+				Path:   "/subscriptions/12345/providers/Microsoft.ContainerService/locations/eastus/operations/abc",
+			},
+		},
+	}
+	return runtime.NewResponseError(resp)
+}
+
+func TestExtractLROFailure(t *testing.T) {
+	tests := []struct {
+		name              string
+		file              string
+		status            string
+		provisioningState string
+		errorCode         string
+		code              string
+	}{
+		{
+			name:      "async operation with inner error embedded in message",
+			file:      "aks_agentpool_zonal_allocation_failed.json",
+			status:    "Failed",
+			errorCode: "ReconcileVMSSAgentPoolFailed",
+			code:      ZoneAllocationFailed,
+		},
+		{
+			name:      "async operation with nested details",
+			file:      "compute_async_operation_nested_details.json",
+			status:    "Failed",
+			errorCode: "InternalOperationError",
+			code:      OperationNotAllowed,
+		},
+		{
+			name:              "resource with failed instance view status",
+			file:              "vm_provisioning_state_failed.json",
+			provisioningState: "Failed",
+			errorCode:         SKUNotAvailableErrorCode,
+			code:              SKUNotAvailableErrorCode,
+		},
+		{
+			name:              "resource with provisioning error",
+			file:              "aks_managed_cluster_provisioning_state_failed.json",
+			provisioningState: "Failed",
+			errorCode:         InsufficientSubnetSizeErrorCode,
+			code:              InsufficientSubnetSizeErrorCode,
+		},
+		{
+			name:              "resource without error",
+			file:              "storage_provisioning_state_failed_without_error.json",
+			provisioningState: "Failed",
+			errorCode:         ProvisioningStateFailedErrorCode,
+			code:              ProvisioningStateFailedErrorCode,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failure := ExtractLROFailure(loadLROFailure(t, tt.file))
+			require.NotNil(t, failure)
+			assert.Equal(t, tt.status, failure.Status)
+			assert.Equal(t, tt.provisioningState, failure.ProvisioningState)
+			assert.Equal(t, tt.errorCode, failure.Error.Code)
+			assert.Equal(t, tt.code, failure.Code)
+			assert.NotEmpty(t, failure.Message)
+		})
+	}
+
+	t.Run("not a long-running operation failure", func(t *testing.T) {
+		assert.Nil(t, ExtractLROFailure(createResponseError(SubnetIsFullErrorCode, http.StatusBadRequest, "Subnet is full.")))
+		assert.Nil(t, ExtractLROFailure(errors.New("some other error")))
+		assert.Nil(t, ExtractLROFailure(nil))
+	})
+}
+
+func TestNormalizeLROError(t *testing.T) {
+	t.Run("predicates miss the failure before normalization", func(t *testing.T) {
+		err := loadLROFailure(t, "aks_agentpool_zonal_allocation_failed.json")
+		assert.False(t, ZonalAllocationFailureOccurred(err))
+		assert.True(t, ZonalAllocationFailureOccurred(NormalizeLROError(err)))
+	})
+
+	t.Run("quota message of nested detail is kept", func(t *testing.T) {
+		err := NormalizeLROError(loadLROFailure(t, "compute_async_operation_nested_details.json"))
+		assert.True(t, SubscriptionQuotaHasBeenReached(err))
+		assert.Equal(t, ErrorCategoryQuotaExceeded, ClassifyError(err))
+	})
+
+	t.Run("provisioning state failures", func(t *testing.T) {
+		assert.True(t, IsSKUNotAvailable(NormalizeLROError(loadLROFailure(t, "vm_provisioning_state_failed.json"))))
+		assert.True(t, IsInsufficientSubnetSizeError(NormalizeLROError(loadLROFailure(t, "aks_managed_cluster_provisioning_state_failed.json"))))
+	})
+
+	t.Run("normalized body keeps the original error", func(t *testing.T) {
+		err := NormalizeLROError(loadLROFailure(t, "compute_async_operation_nested_details.json"))
+		assert.Contains(t, IsResponseError(err).Error(), "InternalOperationError")
+		wrapper := NewResponseErrorWrapper(IsResponseError(err))
+		assert.Contains(t, wrapper.Error(), "ERROR CODE: OperationNotAllowed")
+	})
+
+	t.Run("wrapping of the caller is kept", func(t *testing.T) {
+		errCreate := errors.New("creating agent pool")
+		err := fmt.Errorf("%w: %w", errCreate, loadLROFailure(t, "aks_agentpool_zonal_allocation_failed.json"))
+		normalized := NormalizeLROError(err)
+		assert.ErrorIs(t, normalized, errCreate)
+		assert.Same(t, err, errors.Unwrap(normalized))
+		assert.True(t, ZonalAllocationFailureOccurred(normalized))
+		assert.Equal(t, ZoneAllocationFailed, IsResponseError(normalized).ErrorCode)
+		assert.ErrorIs(t, WrapResponseError(normalized), ErrZonalAllocationFailed)
+	})
+
+	t.Run("other errors are returned unchanged", func(t *testing.T) {
+		respErr := createResponseError(SubnetIsFullErrorCode, http.StatusBadRequest, "Subnet is full.")
+		assert.Same(t, respErr, NormalizeLROError(respErr))
+
+		otherErr := errors.New("some other error")
+		assert.Equal(t, otherErr, NormalizeLROError(otherErr))
+		assert.Nil(t, NormalizeLROError(nil))
+	})
+}
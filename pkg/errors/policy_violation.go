@@ -0,0 +1,174 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package errors
+
+import (
+	"encoding/json"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerservice/armcontainerservice/v8"
+)
+
+// PolicyViolationAdditionalInfoType is the additionalInfo type ARM uses for policy evaluation details.
+const PolicyViolationAdditionalInfoType = "PolicyViolation"
+
+// policyIdentifiersMatcher matches the policy identifiers ARM embeds in the message of RequestDisallowedByPolicy errors,
+// e.g. Policy identifiers: '[{"policyAssignment":{"name":"...","id":"..."},"policyDefinition":{"name":"...","id":"..."}}]'.
+var policyIdentifiersMatcher = regexp.MustCompile(`(?s)Policy identifiers: '(\[.*\])'`)
+
+// PolicyViolation describes a policy assignment that denied a request.
+// See https://learn.microsoft.com/azure/governance/policy/troubleshoot/general#scenario-requestdisallowedbypolicy
+type PolicyViolation struct {
+	PolicyAssignmentID             string                   `json:"policyAssignmentId"`
+	PolicyAssignmentName           string                   `json:"policyAssignmentName"`
+	PolicyAssignmentDisplayName    string                   `json:"policyAssignmentDisplayName"`
+	PolicyAssignmentScope          string                   `json:"policyAssignmentScope"`
+	PolicyDefinitionID             string                   `json:"policyDefinitionId"`
+	PolicyDefinitionName           string                   `json:"policyDefinitionName"`
+	PolicyDefinitionDisplayName    string                   `json:"policyDefinitionDisplayName"`
+	PolicyDefinitionEffect         string                   `json:"policyDefinitionEffect"`
+	PolicyDefinitionReferenceID    string                   `json:"policyDefinitionReferenceId"`
+	PolicySetDefinitionID          string                   `json:"policySetDefinitionId"`
+	PolicySetDefinitionName        string                   `json:"policySetDefinitionName"`
+	PolicySetDefinitionDisplayName string                   `json:"policySetDefinitionDisplayName"`
+	EvaluationDetails              *PolicyEvaluationDetails `json:"evaluationDetails"`
+}
+
+// PolicyEvaluationDetails lists the expressions of the policy rule and how they evaluated against the request.
+type PolicyEvaluationDetails struct {
+	EvaluatedExpressions []PolicyEvaluatedExpression `json:"evaluatedExpressions"`
+	Reason               string                      `json:"reason"`
+}
+
+// PolicyEvaluatedExpression is a single condition of a policy rule, e.g. "location notIn [eastus]".
+type PolicyEvaluatedExpression struct {
+	Result          string `json:"result"`
+	ExpressionKind  string `json:"expressionKind"`
+	Expression      string `json:"expression"`
+	Path            string `json:"path"`
+	ExpressionValue any    `json:"expressionValue"`
+	TargetValue     any    `json:"targetValue"`
+	Operator        string `json:"operator"`
+}
+
+// NonCompliantFields returns the request fields that matched the policy rule, i.e. the paths of the
+// evaluated expressions whose result is true. Changing one of these fields is what lets the request pass.
+func (v PolicyViolation) NonCompliantFields() []string {
+	if v.EvaluationDetails == nil {
+		return nil
+	}
+	var fields []string
+	for _, expression := range v.EvaluationDetails.EvaluatedExpressions {
+		if expression.Path == "" || !strings.EqualFold(expression.Result, "true") {
+			continue
+		}
+		if !slices.Contains(fields, expression.Path) {
+			fields = append(fields, expression.Path)
+		}
+	}
+	return fields
+}
+
+// policyIdentifier is the format of the policy identifiers embedded in the error message.
+type policyIdentifier struct {
+	PolicyAssignment struct {
+		Name string `json:"name"`
+		ID   string `json:"id"`
+	} `json:"policyAssignment"`
+	PolicyDefinition struct {
+		Name string `json:"name"`
+		ID   string `json:"id"`
+	} `json:"policyDefinition"`
+	PolicySetDefinition struct {
+		Name string `json:"name"`
+		ID   string `json:"id"`
+	} `json:"policySetDefinition"`
+}
+
+// ParsePolicyViolations returns the policy assignments that denied the request.
+// Violations are read from the PolicyViolation entries of additionalInfo, including those of nested details,
+// and fall back to the policy identifiers in the message for responses without evaluation details.
+// It returns nil if the error is not an *azcore.ResponseError or no policy violation was found.
+func ParsePolicyViolations(err error) []PolicyViolation {
+	azErr := IsResponseError(err)
+	if azErr == nil {
+		return nil
+	}
+	result, parseErr := parseAzureErrorResponse(responseBody(azErr))
+	if parseErr != nil {
+		return nil
+	}
+	return policyViolationsFromAzureError(result.azureError())
+}
+
+// ParsePolicyViolationsFromErrorDetail returns the policy assignments that denied the request described by the ErrorDetail.
+func ParsePolicyViolationsFromErrorDetail(errorDetail armcontainerservice.ErrorDetail) []PolicyViolation {
+	raw, err := json.Marshal(errorDetail)
+	if err != nil {
+		return nil
+	}
+	var azureError AzureError
+	if err := unmarshalTolerant(raw, &azureError); err != nil {
+		return nil
+	}
+	return policyViolationsFromAzureError(azureError)
+}
+
+func policyViolationsFromAzureError(azureError AzureError) []PolicyViolation {
+	var violations []PolicyViolation
+	for _, info := range azureError.AdditionalInfo {
+		if info.Type != PolicyViolationAdditionalInfoType {
+			continue
+		}
+		var violation PolicyViolation
+		if err := unmarshalTolerant(info.Info, &violation); err == nil {
+			violations = append(violations, violation)
+		}
+	}
+
+	if len(violations) == 0 && isRequestDisallowedByPolicy(azureError.Code) {
+		violations = policyViolationsFromMessage(azureError.Message)
+	}
+
+	for _, detail := range azureError.DetailErrors() {
+		violations = append(violations, policyViolationsFromAzureError(detail)...)
+	}
+	return violations
+}
+
+func policyViolationsFromMessage(message string) []PolicyViolation {
+	match := policyIdentifiersMatcher.FindStringSubmatch(message)
+	if match == nil {
+		return nil
+	}
+	var identifiers []policyIdentifier
+	if err := unmarshalTolerant([]byte(match[1]), &identifiers); err != nil {
+		return nil
+	}
+	violations := make([]PolicyViolation, 0, len(identifiers))
+	for _, identifier := range identifiers {
+		violations = append(violations, PolicyViolation{
+			PolicyAssignmentID:      identifier.PolicyAssignment.ID,
+			PolicyAssignmentName:    identifier.PolicyAssignment.Name,
+			PolicyDefinitionID:      identifier.PolicyDefinition.ID,
+			PolicyDefinitionName:    identifier.PolicyDefinition.Name,
+			PolicySetDefinitionID:   identifier.PolicySetDefinition.ID,
+			PolicySetDefinitionName: identifier.PolicySetDefinition.Name,
+		})
+	}
+	return violations
+}
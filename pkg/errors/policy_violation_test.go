@@ -0,0 +1,140 @@
+package errors
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerservice/armcontainerservice/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+const policyViolationBody = `{
+	"error": {
+		"code": "RequestDisallowedByPolicy",
+		"target": "my-vm",
+		"message": "Resource 'my-vm' was disallowed by policy. Reasons: 'Allowed locations'. See error details for policy resource IDs.",
+		"additionalInfo": [
+			{
+				"type": "PolicyViolation",
+				"info": {
+					"evaluationDetails": {
+						"evaluatedExpressions": [
+							{
+								"result": "True",
+								"expressionKind": "Field",
+								"expression": "location",
+								"path": "location",
+								"expressionValue": "westus",
+								"targetValue": ["eastus", "eastus2"],
+								"operator": "NotIn"
+							},
+							{
+								"result": "False",
+								"expressionKind": "Field",
+								"expression": "type",
+								"path": "type",
+								"expressionValue": "Microsoft.Compute/virtualMachines",
+								"targetValue": "Microsoft.AzureActiveDirectory/b2cDirectories",
+								"operator": "Equals"
+							}
+						]
+					},
+					"policyDefinitionId": "/providers/Microsoft.Authorization/policyDefinitions/e56962a6-4747-49cd-b67b-bf8b01975c4c",
+					"policyDefinitionName": "e56962a6-4747-49cd-b67b-bf8b01975c4c",
+					"policyDefinitionDisplayName": "Allowed locations",
+					"policyDefinitionEffect": "deny",
+					"policyAssignmentId": "/subscriptions/12345/providers/Microsoft.Authorization/policyAssignments/allowed-locations",
+					"policyAssignmentName": "allowed-locations",
+					"policyAssignmentDisplayName": "Allowed locations",
+					"policyAssignmentScope": "/subscriptions/12345",
+					"policyAssignmentParameters": {
+						"listOfAllowedLocations": {"value": ["eastus", "eastus2"]}
+					},
+					"policyExemptionIds": []
+				}
+			}
+		]
+	}
+}`
+
+func TestParsePolicyViolations(t *testing.T) {
+	t.Run("violation from additionalInfo", func(t *testing.T) {
+		err := createResponseErrorWithRequest(RequestDisallowedByPolicyErrorCode, http.StatusForbidden, policyViolationBody,
+			"/subscriptions/12345/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/my-vm")
+
+		violations := ParsePolicyViolations(err)
+		assert.Len(t, violations, 1)
+		violation := violations[0]
+		assert.Equal(t, "/subscriptions/12345/providers/Microsoft.Authorization/policyAssignments/allowed-locations", violation.PolicyAssignmentID)
+		assert.Equal(t, "Allowed locations", violation.PolicyAssignmentDisplayName)
+		assert.Equal(t, "/subscriptions/12345", violation.PolicyAssignmentScope)
+		assert.Equal(t, "/providers/Microsoft.Authorization/policyDefinitions/e56962a6-4747-49cd-b67b-bf8b01975c4c", violation.PolicyDefinitionID)
+		assert.Equal(t, "deny", violation.PolicyDefinitionEffect)
+		assert.Len(t, violation.EvaluationDetails.EvaluatedExpressions, 2)
+		assert.Equal(t, "NotIn", violation.EvaluationDetails.EvaluatedExpressions[0].Operator)
+		assert.Equal(t, []any{"eastus", "eastus2"}, violation.EvaluationDetails.EvaluatedExpressions[0].TargetValue)
+		assert.Equal(t, []string{"location"}, violation.NonCompliantFields())
+	})
+
+	t.Run("body remains readable", func(t *testing.T) {
+		err := createResponseErrorWithRequest(RequestDisallowedByPolicyErrorCode, http.StatusForbidden, policyViolationBody, "/subscriptions/12345")
+
+		assert.Len(t, ParsePolicyViolations(err), 1)
+		assert.Len(t, ParsePolicyViolations(err), 1)
+		assert.Contains(t, NewResponseErrorWrapper(err).Error(), "Resource 'my-vm' was disallowed by policy.")
+	})
+
+	t.Run("violation from policy identifiers in message", func(t *testing.T) {
+		body := `{"error": {"code": "RequestDisallowedByPolicy", "message": "Resource 'my-sa' was disallowed by policy. Policy identifiers: '[{\"policyAssignment\":{\"name\":\"Require secure transfer\",\"id\":\"/subscriptions/12345/providers/Microsoft.Authorization/policyAssignments/secure-transfer\"},\"policyDefinition\":{\"name\":\"Secure transfer to storage accounts should be enabled\",\"id\":\"/providers/Microsoft.Authorization/policyDefinitions/404c3081-a854-4457-ae30-26a93ef643f9\"}}]'."}}`
+		err := createResponseErrorWithRequest(RequestDisallowedByPolicyErrorCode, http.StatusForbidden, body, "/subscriptions/12345")
+
+		violations := ParsePolicyViolations(err)
+		assert.Len(t, violations, 1)
+		assert.Equal(t, "/subscriptions/12345/providers/Microsoft.Authorization/policyAssignments/secure-transfer", violations[0].PolicyAssignmentID)
+		assert.Equal(t, "Require secure transfer", violations[0].PolicyAssignmentName)
+		assert.Equal(t, "/providers/Microsoft.Authorization/policyDefinitions/404c3081-a854-4457-ae30-26a93ef643f9", violations[0].PolicyDefinitionID)
+		assert.Nil(t, violations[0].NonCompliantFields())
+	})
+
+	t.Run("violation nested in deployment error details", func(t *testing.T) {
+		body := `{"error": {"code": "InvalidTemplateDeployment", "message": "The template deployment failed because of policy violation.", "details": [{"code": "RequestDisallowedByPolicy", "target": "my-vm", "message": "Resource 'my-vm' was disallowed by policy.", "additionalInfo": [{"type": "PolicyViolation", "info": {"policyAssignmentId": "/subscriptions/12345/providers/Microsoft.Authorization/policyAssignments/deny-public-ip", "policyDefinitionEffect": "Deny"}}]}]}}`
+		err := createResponseErrorWithRequest("InvalidTemplateDeployment", http.StatusBadRequest, body, "/subscriptions/12345")
+
+		violations := ParsePolicyViolations(err)
+		assert.Len(t, violations, 1)
+		assert.Equal(t, "/subscriptions/12345/providers/Microsoft.Authorization/policyAssignments/deny-public-ip", violations[0].PolicyAssignmentID)
+		assert.Equal(t, "Deny", violations[0].PolicyDefinitionEffect)
+	})
+
+	t.Run("no violations", func(t *testing.T) {
+		assert.Nil(t, ParsePolicyViolations(createResponseError(SubnetIsFullErrorCode, http.StatusBadRequest, "Subnet is full.")))
+		assert.Nil(t, ParsePolicyViolations(errors.New("some other error")))
+		assert.Nil(t, ParsePolicyViolations(nil))
+	})
+}
+
+func TestParsePolicyViolationsFromErrorDetail(t *testing.T) {
+	errorDetail := armcontainerservice.ErrorDetail{
+		Code:    to.Ptr(RequestDisallowedByPolicyErrorCode),
+		Message: to.Ptr("Resource 'my-cluster' was disallowed by policy."),
+		AdditionalInfo: []*armcontainerservice.ErrorAdditionalInfo{
+			{
+				Type: to.Ptr(PolicyViolationAdditionalInfoType),
+				Info: map[string]any{
+					"policyAssignmentId":     "/subscriptions/12345/providers/Microsoft.Authorization/policyAssignments/aks-baseline",
+					"policyDefinitionId":     "/providers/Microsoft.Authorization/policyDefinitions/abc",
+					"policyDefinitionEffect": "deny",
+				},
+			},
+		},
+	}
+
+	violations := ParsePolicyViolationsFromErrorDetail(errorDetail)
+	assert.Len(t, violations, 1)
+	assert.Equal(t, "/subscriptions/12345/providers/Microsoft.Authorization/policyAssignments/aks-baseline", violations[0].PolicyAssignmentID)
+	assert.Equal(t, "/providers/Microsoft.Authorization/policyDefinitions/abc", violations[0].PolicyDefinitionID)
+
+	assert.Nil(t, ParsePolicyViolationsFromErrorDetail(createErrorDetail(SubnetIsFullErrorCode, "")))
+}
@@ -1,11 +1,18 @@
 package errors
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 
+	"github.com/Azure/azure-sdk-for-go-extensions/internal/redact"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 )
 
@@ -15,59 +22,189 @@ var jsonUnescaper = strings.NewReplacer(
 	"\r", " ",
 )
 
+// WrapperFormat controls how ResponseErrorWrapper.Error() renders the error.
+type WrapperFormat int
+
+const (
+	// WrapperFormatCompact renders "HTTP CODE: ..., ERROR CODE: ..., MESSAGE: ..., REQUEST: ..." on a single line.
+	WrapperFormatCompact WrapperFormat = iota
+	// WrapperFormatVerbose renders one field per line, including request IDs, target and the details tree.
+	WrapperFormatVerbose
+	// WrapperFormatJSON renders the error as single-line JSON, the same as MarshalJSON.
+	WrapperFormatJSON
+)
+
+// DefaultMaxErrorBodySize is the default number of bytes of an error body that are read for parsing.
+const DefaultMaxErrorBodySize = 1 << 20
+
+// ResponseErrorWrapperOptions configures a ResponseErrorWrapper. The zero value is the default configuration.
+type ResponseErrorWrapperOptions struct {
+	// Format is the format of Error(), defaults to WrapperFormatCompact.
+	Format WrapperFormat
+	// MaxBodySize is the maximum number of bytes of the body that are read, defaults to DefaultMaxErrorBodySize.
+	// Bodies that are larger are not parsed.
+	MaxBodySize int64
+	// Redaction controls the redaction of the request URL and error messages, defaults to DefaultRedactionOptions.
+	Redaction *RedactionOptions
+}
+
+// RedactionOptions controls how ResponseErrorWrapper redacts the request URL and error messages,
+// which can contain SAS tokens, skip tokens, keys and subscription or tenant IDs.
+type RedactionOptions struct {
+	// Disabled turns off redaction.
+	Disabled bool
+	// StripQuery removes the query parameters of the URL that are not in AllowedQueryParams.
+	// When the query is kept, the values of sensitive parameters such as SAS signatures and skip tokens are redacted.
+	StripQuery bool
+	// AllowedQueryParams are the query parameters that are kept as is, e.g. api-version.
+	AllowedQueryParams []string
+	// MaskGUIDs replaces GUIDs, such as subscription and tenant IDs, with the nil GUID.
+	MaskGUIDs bool
+}
+
+// DefaultRedactionOptions is used by wrappers that are created without RedactionOptions.
+// It can be changed during initialization, before any wrapper is created.
+var DefaultRedactionOptions = RedactionOptions{
+	StripQuery:         true,
+	AllowedQueryParams: []string{"api-version"},
+}
+
+func (o *RedactionOptions) redactURL(u *url.URL) string {
+	if o.Disabled {
+		return u.String()
+	}
+	return redact.URL(u, redact.URLOptions{
+		StripQuery:         o.StripQuery,
+		AllowedQueryParams: o.AllowedQueryParams,
+		MaskGUIDs:          o.MaskGUIDs,
+	})
+}
+
+// redactMessage hides keys, passwords and SSH keys, and GUIDs if they are masked.
+func (o *RedactionOptions) redactMessage(message string) string {
+	if o.Disabled {
+		return message
+	}
+	message = redact.HideSecrets(message)
+	if o.MaskGUIDs {
+		message = redact.HideGUIDs(message)
+	}
+	return message
+}
+
+// ResponseErrorWrapper formats an *azcore.ResponseError. The body of the response is read once,
+// restored for other consumers of the ResponseError, and parsed once; it is safe for concurrent use.
 type ResponseErrorWrapper struct {
 	respErr *azcore.ResponseError
-	message string
+	options ResponseErrorWrapperOptions
+
+	parseOnce sync.Once
+	parsed    *AzureErrorResponse
+
+	messageOnce sync.Once
+	message     string
 }
 
+var (
+	_ error          = (*ResponseErrorWrapper)(nil)
+	_ slog.LogValuer = (*ResponseErrorWrapper)(nil)
+	_ json.Marshaler = (*ResponseErrorWrapper)(nil)
+)
+
 func NewResponseErrorWrapper(respErr *azcore.ResponseError) *ResponseErrorWrapper {
-	return &ResponseErrorWrapper{
+	return NewResponseErrorWrapperWithOptions(respErr, nil)
+}
+
+// NewResponseErrorWrapperWithOptions creates a ResponseErrorWrapper. Pass nil to accept the default options.
+func NewResponseErrorWrapperWithOptions(respErr *azcore.ResponseError, options *ResponseErrorWrapperOptions) *ResponseErrorWrapper {
+	wrapper := &ResponseErrorWrapper{
 		respErr: respErr,
 	}
+	if options != nil {
+		wrapper.options = *options
+	}
+	if wrapper.options.MaxBodySize <= 0 {
+		wrapper.options.MaxBodySize = DefaultMaxErrorBodySize
+	}
+	if wrapper.options.Redaction == nil {
+		redaction := DefaultRedactionOptions
+		wrapper.options.Redaction = &redaction
+	}
+	return wrapper
 }
 
 func (e *ResponseErrorWrapper) Unwrap() error {
 	return e.respErr
 }
 
+// Is reports whether target is the sentinel error of the category of the wrapped error,
+// e.g. errors.Is(err, ErrZonalAllocationFailed).
+func (e *ResponseErrorWrapper) Is(target error) bool {
+	sentinel := e.Category().Sentinel()
+	return sentinel != nil && sentinel == target
+}
+
+// Category returns the category of the wrapped error. It's classified from the body parsed by the wrapper,
+// which is read once and up to MaxBodySize.
+func (e *ResponseErrorWrapper) Category() ErrorCategory {
+	if e.respErr == nil {
+		return ErrorCategoryUnknown
+	}
+	return classifyError(e.respErr.StatusCode, e.ErrorCode(), e.azureError().Message)
+}
+
 // WrapResponseError wraps ResponseError instances in ResponseErrorWrapper for more concise formatting.
 // If the error is a ResponseError, it returns a wrapped version which has a more concise .Error() output.
 // If the error is not a ResponseError, it returns the original error unchanged.
 func WrapResponseError(err error) error {
+	return WrapResponseErrorWithOptions(err, nil)
+}
+
+// WrapResponseErrorWithOptions is like WrapResponseError, with the options of the ResponseErrorWrapper.
+func WrapResponseErrorWithOptions(err error, options *ResponseErrorWrapperOptions) error {
 	if azErr := IsResponseError(err); azErr != nil {
-		return NewResponseErrorWrapper(azErr)
+		return NewResponseErrorWrapperWithOptions(azErr, options)
 	}
 	return err
 }
 
 func (c *ResponseErrorWrapper) Error() string {
-	if c.message != "" {
-		return c.message
-	}
-
 	if c.respErr == nil {
 		// TODO - special handling if this is nil? But for now, just return empty string to not pollute logs
 		return ""
 	}
 
-	// Attempt to build error message - this is best effort since format can vary depending on the Azure service
-	c.message = buildWrapperErrorMessage(c.respErr)
+	c.messageOnce.Do(func() {
+		// Attempt to build error message - this is best effort since format can vary depending on the Azure service
+		switch c.options.Format {
+		case WrapperFormatVerbose:
+			c.message = c.buildVerboseMessage()
+		case WrapperFormatJSON:
+			c.message = c.buildJSONMessage()
+		default:
+			c.message = buildWrapperErrorMessage(c.respErr, c.parse(), c.options.Redaction)
+		}
+	})
 
 	return c.message
 }
 
-func buildWrapperErrorMessage(respErr *azcore.ResponseError) string {
+func buildWrapperErrorMessage(respErr *azcore.ResponseError, result *AzureErrorResponse, redaction *RedactionOptions) string {
 	httpCode := respErr.StatusCode
 	errorCode := respErr.ErrorCode
+	if errorCode == "" && result != nil {
+		// data plane services do not all set the x-ms-error-code header
+		errorCode = result.azureError().Code
+	}
 	if errorCode == "" {
 		errorCode = "UNAVAILABLE"
 	}
 
 	// Extract HTTP Method and URL
-	httpMethod, url := extractRequestInfo(respErr)
+	httpMethod, url := extractRequestInfo(respErr, redaction)
 
 	// Extract error message
-	errorMessage := extractErrorMessage(respErr)
+	errorMessage := redaction.redactMessage(extractErrorMessage(result))
 
 	wrapperMessage := fmt.Sprintf("HTTP CODE: %d, ERROR CODE: %s, MESSAGE: %s, REQUEST: %s %s",
 		httpCode, errorCode, errorMessage, httpMethod, url)
@@ -75,8 +212,8 @@ func buildWrapperErrorMessage(respErr *azcore.ResponseError) string {
 	return wrapperMessage
 }
 
-// extractRequestInfo extracts HTTP method and URL with proper nil checks
-func extractRequestInfo(respErr *azcore.ResponseError) (string, string) {
+// extractRequestInfo extracts HTTP method and redacted URL with proper nil checks
+func extractRequestInfo(respErr *azcore.ResponseError, redaction *RedactionOptions) (string, string) {
 	method := "UNKNOWN"
 	requestURL := "UNAVAILABLE"
 
@@ -88,46 +225,154 @@ func extractRequestInfo(respErr *azcore.ResponseError) (string, string) {
 	method = req.Method
 
 	if req.URL != nil {
-		requestURL = req.URL.String()
+		requestURL = redaction.redactURL(req.URL)
 	}
 
 	return method, requestURL
 }
 
 type AzureErrorResponse struct {
-	Error   AzureError `json:"error"`
-	Code    string     `json:"code"`
-	Message string     `json:"message"`
-	Details any        `json:"details"`
+	Error          AzureError                 `json:"error"`
+	Code           string                     `json:"code"`
+	Message        string                     `json:"message"`
+	Target         string                     `json:"target"`
+	Details        any                        `json:"details"`
+	AdditionalInfo []AzureErrorAdditionalInfo `json:"additionalInfo"`
+	InnerError     *AzureError                `json:"innererror,omitempty"`
 }
 
 type AzureError struct {
-	Code    string `json:"code"`
-	Message string `json:"message"`
-	Details any    `json:"details"`
+	Code           string                     `json:"code"`
+	Message        string                     `json:"message"`
+	Target         string                     `json:"target"`
+	Details        any                        `json:"details"`
+	AdditionalInfo []AzureErrorAdditionalInfo `json:"additionalInfo"`
+	// InnerError is the more specific error of data plane services such as Key Vault,
+	// and the request context of Microsoft Graph, both of which use the "innererror" field.
+	InnerError *AzureError `json:"innererror,omitempty"`
 }
 
-func extractErrorMessage(respErr *azcore.ResponseError) string {
-	// these 2 cases shouldn't happen in real-world scenarios as a
-	// response with no body should set it to http.NoBody
+// AzureErrorAdditionalInfo is an entry of the additionalInfo array of an ARM error, e.g. a PolicyViolation.
+type AzureErrorAdditionalInfo struct {
+	Type string          `json:"type"`
+	Info json.RawMessage `json:"info"`
+}
+
+// DetailErrors returns the details of the error as AzureErrors.
+// Details that are not a list of errors are ignored.
+func (e AzureError) DetailErrors() []AzureError {
+	if e.Details == nil {
+		return nil
+	}
+	raw, err := json.Marshal(e.Details)
+	if err != nil {
+		return nil
+	}
+	var details []AzureError
+	if err := unmarshalTolerant(raw, &details); err != nil {
+		return nil
+	}
+	return details
+}
+
+// azureError returns the error of the response, whether or not it is wrapped in an "error" object.
+func (r *AzureErrorResponse) azureError() AzureError {
+	if r.Error.Code != "" || r.Error.Message != "" {
+		return r.Error
+	}
+	return AzureError{
+		Code:           r.Code,
+		Message:        r.Message,
+		Target:         r.Target,
+		Details:        r.Details,
+		AdditionalInfo: r.AdditionalInfo,
+		InnerError:     r.InnerError,
+	}
+}
+
+// unmarshalTolerant unmarshals JSON, keeping the fields that could be decoded when
+// some values have an unexpected type, as error bodies vary between resource providers.
+func unmarshalTolerant(data []byte, v any) error {
+	err := json.Unmarshal(data, v)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return nil
+	}
+	return err
+}
+
+// responseBody returns up to DefaultMaxErrorBodySize bytes of the body of the response without consuming it.
+func responseBody(respErr *azcore.ResponseError) []byte {
 	if respErr.RawResponse == nil {
-		return "UNAVAILABLE"
+		return nil
 	}
+	return snapshotBody(respErr.RawResponse, DefaultMaxErrorBodySize)
+}
 
-	if respErr.RawResponse.Body == nil {
-		return "UNAVAILABLE"
+// bytesBody is implemented by the body azcore installs once the response has been downloaded.
+type bytesBody interface {
+	Bytes() []byte
+}
+
+// restoredBody replays the bytes read from a body before the rest of the original body.
+type restoredBody struct {
+	io.Reader
+	io.Closer
+}
+
+// snapshotBody returns up to limit bytes of the body, leaving the body readable from where it was for other consumers.
+// Bodies larger than limit are truncated, which makes them fail parsing rather than be read unbounded into memory.
+func snapshotBody(resp *http.Response, limit int64) []byte {
+	// these cases shouldn't happen in real-world scenarios as a
+	// response with no body should set it to http.NoBody
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return nil
 	}
 
-	// Read the body content once and save it in case we need to use one of the fallback approaches for message extraction
-	respBody := respErr.RawResponse.Body
-	bodyBytes, err := io.ReadAll(respBody)
-	if err != nil {
-		return "UNAVAILABLE"
+	if b, ok := resp.Body.(bytesBody); ok {
+		// the body has been downloaded by the pipeline (see runtime.Payload)
+		body := b.Bytes()
+		return body[:min(int64(len(body)), limit)]
+	}
+
+	if seeker, ok := resp.Body.(io.Seeker); ok {
+		if offset, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return nil
+			}
+			body, readErr := io.ReadAll(io.LimitReader(resp.Body, limit))
+			if _, err := seeker.Seek(offset, io.SeekStart); err == nil && readErr == nil {
+				return body
+			}
+			return nil
+		}
 	}
 
-	var result AzureErrorResponse
-	err = json.Unmarshal(bodyBytes, &result)
+	original := resp.Body
+	body, err := io.ReadAll(io.LimitReader(original, limit))
+	resp.Body = &restoredBody{Reader: io.MultiReader(bytes.NewReader(body), original), Closer: original}
 	if err != nil {
+		return nil
+	}
+	return body
+}
+
+// parse reads and parses the body of the response once, returning nil if it is not an Azure error body.
+func (c *ResponseErrorWrapper) parse() *AzureErrorResponse {
+	c.parseOnce.Do(func() {
+		if c.respErr == nil || c.respErr.RawResponse == nil {
+			return
+		}
+		body := snapshotBody(c.respErr.RawResponse, c.options.MaxBodySize)
+		if result, err := parseAzureErrorResponse(body); err == nil {
+			c.parsed = result
+		}
+	})
+	return c.parsed
+}
+
+func extractErrorMessage(result *AzureErrorResponse) string {
+	if result == nil {
 		return "UNAVAILABLE"
 	}
 
@@ -144,3 +389,235 @@ func extractErrorMessage(respErr *azcore.ResponseError) string {
 	// If no message found, return unavailable
 	return "UNAVAILABLE"
 }
+
+// StatusCode returns the HTTP status code of the response.
+func (c *ResponseErrorWrapper) StatusCode() int {
+	if c.respErr == nil {
+		return 0
+	}
+	return c.respErr.StatusCode
+}
+
+// ErrorCode returns the error code of the response. The code of the body is used when the
+// x-ms-error-code header is missing.
+func (c *ResponseErrorWrapper) ErrorCode() string {
+	if c.respErr == nil {
+		return ""
+	}
+	if c.respErr.ErrorCode != "" {
+		return c.respErr.ErrorCode
+	}
+	return c.azureError().Code
+}
+
+// Message returns the redacted error message of the body, or an empty string if it could not be extracted.
+func (c *ResponseErrorWrapper) Message() string {
+	return c.options.Redaction.redactMessage(c.azureError().Message)
+}
+
+// Target returns the target of the error, if any.
+func (c *ResponseErrorWrapper) Target() string {
+	return c.azureError().Target
+}
+
+// Details returns the details of the error. Nested details are available through AzureError.DetailErrors.
+func (c *ResponseErrorWrapper) Details() []AzureError {
+	return c.azureError().DetailErrors()
+}
+
+// Method returns the HTTP method of the request, or an empty string if the request is unavailable.
+func (c *ResponseErrorWrapper) Method() string {
+	if req := c.request(); req != nil {
+		return req.Method
+	}
+	return ""
+}
+
+// URL returns the redacted URL of the request, or an empty string if the request is unavailable.
+// The URL as sent is available through the request of the unwrapped ResponseError.
+func (c *ResponseErrorWrapper) URL() string {
+	if req := c.request(); req != nil && req.URL != nil {
+		return c.options.Redaction.redactURL(req.URL)
+	}
+	return ""
+}
+
+// RequestID returns the x-ms-request-id header of the response, or the request-id header used by Microsoft Graph.
+func (c *ResponseErrorWrapper) RequestID() string {
+	if c.respErr == nil || c.respErr.RawResponse == nil {
+		return ""
+	}
+	if id := c.respErr.RawResponse.Header.Get(headerRequestID); id != "" {
+		return id
+	}
+	return c.respErr.RawResponse.Header.Get(headerGraphRequestID)
+}
+
+// CorrelationID returns the x-ms-correlation-request-id header of the response,
+// falling back to the header of the request.
+func (c *ResponseErrorWrapper) CorrelationID() string {
+	if c.respErr == nil || c.respErr.RawResponse == nil {
+		return ""
+	}
+	if id := c.respErr.RawResponse.Header.Get(headerCorrelationRequestID); id != "" {
+		return id
+	}
+	if req := c.request(); req != nil {
+		return req.Header.Get(headerCorrelationRequestID)
+	}
+	return ""
+}
+
+// LogValue implements slog.LogValuer, logging the fields of the error as a group.
+func (c *ResponseErrorWrapper) LogValue() slog.Value {
+	if c.respErr == nil {
+		return slog.GroupValue()
+	}
+	e := c.structuredError()
+	attrs := []slog.Attr{slog.Int("statusCode", e.StatusCode)}
+	appendString := func(key, value string) {
+		if value != "" {
+			attrs = append(attrs, slog.String(key, value))
+		}
+	}
+	appendString("errorCode", e.ErrorCode)
+	appendString("message", e.Message)
+	appendString("target", e.Target)
+	appendString("method", e.Method)
+	appendString("url", e.URL)
+	appendString("requestId", e.RequestID)
+	appendString("correlationId", e.CorrelationID)
+	if len(e.Details) > 0 {
+		attrs = append(attrs, slog.Any("details", e.Details))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (c *ResponseErrorWrapper) MarshalJSON() ([]byte, error) {
+	if c.respErr == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(c.structuredError())
+}
+
+const (
+	headerRequestID            = "x-ms-request-id"
+	headerGraphRequestID       = "request-id"
+	headerCorrelationRequestID = "x-ms-correlation-request-id"
+)
+
+// responseErrorJSON is the structured form of a ResponseErrorWrapper used for JSON and slog.
+type responseErrorJSON struct {
+	StatusCode    int               `json:"statusCode,omitempty"`
+	ErrorCode     string            `json:"errorCode,omitempty"`
+	Message       string            `json:"message,omitempty"`
+	Target        string            `json:"target,omitempty"`
+	Method        string            `json:"method,omitempty"`
+	URL           string            `json:"url,omitempty"`
+	RequestID     string            `json:"requestId,omitempty"`
+	CorrelationID string            `json:"correlationId,omitempty"`
+	Details       []errorDetailJSON `json:"details,omitempty"`
+}
+
+type errorDetailJSON struct {
+	Code    string            `json:"code,omitempty"`
+	Message string            `json:"message,omitempty"`
+	Target  string            `json:"target,omitempty"`
+	Details []errorDetailJSON `json:"details,omitempty"`
+}
+
+func (c *ResponseErrorWrapper) structuredError() responseErrorJSON {
+	azureError := c.azureError()
+	return responseErrorJSON{
+		StatusCode:    c.StatusCode(),
+		ErrorCode:     c.ErrorCode(),
+		Message:       c.options.Redaction.redactMessage(azureError.Message),
+		Target:        azureError.Target,
+		Method:        c.Method(),
+		URL:           c.URL(),
+		RequestID:     c.RequestID(),
+		CorrelationID: c.CorrelationID(),
+		Details:       errorDetailsJSON(azureError.DetailErrors(), c.options.Redaction),
+	}
+}
+
+func errorDetailsJSON(details []AzureError, redaction *RedactionOptions) []errorDetailJSON {
+	if len(details) == 0 {
+		return nil
+	}
+	result := make([]errorDetailJSON, 0, len(details))
+	for _, detail := range details {
+		result = append(result, errorDetailJSON{
+			Code:    detail.Code,
+			Message: redaction.redactMessage(detail.Message),
+			Target:  detail.Target,
+			Details: errorDetailsJSON(detail.DetailErrors(), redaction),
+		})
+	}
+	return result
+}
+
+// azureError returns the parsed error of the body, or the zero value if the body cannot be parsed.
+func (c *ResponseErrorWrapper) azureError() AzureError {
+	if result := c.parse(); result != nil {
+		return result.azureError()
+	}
+	return AzureError{}
+}
+
+func (c *ResponseErrorWrapper) request() *http.Request {
+	if c.respErr == nil || c.respErr.RawResponse == nil {
+		return nil
+	}
+	return c.respErr.RawResponse.Request
+}
+
+func (c *ResponseErrorWrapper) buildVerboseMessage() string {
+	e := c.structuredError()
+	valueOr := func(value, fallback string) string {
+		if value == "" {
+			return fallback
+		}
+		return value
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "HTTP CODE: %d\n", e.StatusCode)
+	fmt.Fprintf(&sb, "ERROR CODE: %s\n", valueOr(e.ErrorCode, "UNAVAILABLE"))
+	fmt.Fprintf(&sb, "MESSAGE: %s\n", valueOr(jsonUnescaper.Replace(e.Message), "UNAVAILABLE"))
+	if e.Target != "" {
+		fmt.Fprintf(&sb, "TARGET: %s\n", e.Target)
+	}
+	fmt.Fprintf(&sb, "REQUEST: %s %s", valueOr(e.Method, "UNKNOWN"), valueOr(e.URL, "UNAVAILABLE"))
+	if e.RequestID != "" {
+		fmt.Fprintf(&sb, "\nREQUEST ID: %s", e.RequestID)
+	}
+	if e.CorrelationID != "" {
+		fmt.Fprintf(&sb, "\nCORRELATION ID: %s", e.CorrelationID)
+	}
+	if len(e.Details) > 0 {
+		sb.WriteString("\nDETAILS:")
+		writeVerboseDetails(&sb, e.Details, 1)
+	}
+	return sb.String()
+}
+
+func writeVerboseDetails(sb *strings.Builder, details []errorDetailJSON, depth int) {
+	indent := strings.Repeat("  ", depth)
+	for _, detail := range details {
+		fmt.Fprintf(sb, "\n%s- CODE: %s, MESSAGE: %s", indent, detail.Code, jsonUnescaper.Replace(detail.Message))
+		if detail.Target != "" {
+			fmt.Fprintf(sb, ", TARGET: %s", detail.Target)
+		}
+		writeVerboseDetails(sb, detail.Details, depth+1)
+	}
+}
+
+func (c *ResponseErrorWrapper) buildJSONMessage() string {
+	body, err := c.MarshalJSON()
+	if err != nil {
+		return buildWrapperErrorMessage(c.respErr, c.parse(), c.options.Redaction)
+	}
+	return string(body)
+}
@@ -2,14 +2,18 @@ package errors
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"sync"
 	"testing"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestResponseErrorWrapper_Error(t *testing.T) {
@@ -498,3 +502,321 @@ func TestAsWrappedResponseError(t *testing.T) {
 		assert.NotEmpty(t, err.Error())
 	})
 }
+
+func createStructuredResponseError() *azcore.ResponseError {
+	body := `{
+		"error": {
+			"code": "InvalidTemplateDeployment",
+			"target": "vm",
+			"message": "The template deployment failed.\nSee details.",
+			"details": [
+				{
+					"code": "InvalidParameter",
+					"target": "location",
+					"message": "The provided location 'invalid-region' is not available.",
+					"details": [{"code": "LocationNotAvailable", "message": "Region 'invalid-region' does not support this resource type."}]
+				}
+			]
+		}
+	}`
+	resp := &http.Response{
+		StatusCode: 400,
+		Header: http.Header{
+			"X-Ms-Request-Id":             []string{"req-123"},
+			"X-Ms-Correlation-Request-Id": []string{"corr-456"},
+		},
+		Body: io.NopCloser(bytes.NewBufferString(body)),
+		Request: &http.Request{
+			Method: "PUT",
+			URL: &url.URL{
+				Scheme: "https",
+				Host:   "management.azure.com",
+				Path:   "/subscriptions/12345/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm",
+			},
+		},
+	}
+	return &azcore.ResponseError{
+		ErrorCode:   "InvalidTemplateDeployment",
+		StatusCode:  400,
+		RawResponse: resp,
+	}
+}
+
+func TestResponseErrorWrapper_Accessors(t *testing.T) {
+	wrapper := NewResponseErrorWrapper(createStructuredResponseError())
+
+	assert.Equal(t, 400, wrapper.StatusCode())
+	assert.Equal(t, "InvalidTemplateDeployment", wrapper.ErrorCode())
+	assert.Equal(t, "The template deployment failed.\nSee details.", wrapper.Message())
+	assert.Equal(t, "vm", wrapper.Target())
+	assert.Equal(t, "PUT", wrapper.Method())
+	assert.Equal(t, "https://management.azure.com/subscriptions/12345/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm", wrapper.URL())
+	assert.Equal(t, "req-123", wrapper.RequestID())
+	assert.Equal(t, "corr-456", wrapper.CorrelationID())
+
+	details := wrapper.Details()
+	require.Len(t, details, 1)
+	assert.Equal(t, "InvalidParameter", details[0].Code)
+	assert.Equal(t, "LocationNotAvailable", details[0].DetailErrors()[0].Code)
+
+	t.Run("error code falls back to the body", func(t *testing.T) {
+		respErr := createStructuredResponseError()
+		respErr.ErrorCode = ""
+		assert.Equal(t, "InvalidTemplateDeployment", NewResponseErrorWrapper(respErr).ErrorCode())
+	})
+
+	t.Run("nil ResponseError", func(t *testing.T) {
+		wrapper := NewResponseErrorWrapper(nil)
+		assert.Equal(t, 0, wrapper.StatusCode())
+		assert.Empty(t, wrapper.ErrorCode())
+		assert.Empty(t, wrapper.Message())
+		assert.Empty(t, wrapper.URL())
+		assert.Empty(t, wrapper.RequestID())
+		assert.Nil(t, wrapper.Details())
+	})
+}
+
+func TestResponseErrorWrapper_MarshalJSON(t *testing.T) {
+	raw, err := json.Marshal(NewResponseErrorWrapper(createStructuredResponseError()))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"statusCode": 400,
+		"errorCode": "InvalidTemplateDeployment",
+		"message": "The template deployment failed.\nSee details.",
+		"target": "vm",
+		"method": "PUT",
+		"url": "https://management.azure.com/subscriptions/12345/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm",
+		"requestId": "req-123",
+		"correlationId": "corr-456",
+		"details": [
+			{
+				"code": "InvalidParameter",
+				"target": "location",
+				"message": "The provided location 'invalid-region' is not available.",
+				"details": [{"code": "LocationNotAvailable", "message": "Region 'invalid-region' does not support this resource type."}]
+			}
+		]
+	}`, string(raw))
+
+	raw, err = json.Marshal(NewResponseErrorWrapper(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "{}", string(raw))
+}
+
+func TestResponseErrorWrapper_LogValue(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	logger.Error("request failed", "error", NewResponseErrorWrapper(createStructuredResponseError()))
+
+	var entry struct {
+		Error map[string]any `json:"error"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, float64(400), entry.Error["statusCode"])
+	assert.Equal(t, "InvalidTemplateDeployment", entry.Error["errorCode"])
+	assert.Equal(t, "req-123", entry.Error["requestId"])
+	assert.Equal(t, "corr-456", entry.Error["correlationId"])
+	assert.Len(t, entry.Error["details"], 1)
+}
+
+func TestResponseErrorWrapper_Format(t *testing.T) {
+	t.Run("compact is the default", func(t *testing.T) {
+		wrapper := NewResponseErrorWrapperWithOptions(createStructuredResponseError(), &ResponseErrorWrapperOptions{})
+		assert.Equal(t, "HTTP CODE: 400, ERROR CODE: InvalidTemplateDeployment, MESSAGE: The template deployment failed. See details., REQUEST: PUT https://management.azure.com/subscriptions/12345/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm", wrapper.Error())
+	})
+
+	t.Run("verbose", func(t *testing.T) {
+		wrapper := NewResponseErrorWrapperWithOptions(createStructuredResponseError(), &ResponseErrorWrapperOptions{Format: WrapperFormatVerbose})
+		expected := "HTTP CODE: 400\n" +
+			"ERROR CODE: InvalidTemplateDeployment\n" +
+			"MESSAGE: The template deployment failed. See details.\n" +
+			"TARGET: vm\n" +
+			"REQUEST: PUT https://management.azure.com/subscriptions/12345/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm\n" +
+			"REQUEST ID: req-123\n" +
+			"CORRELATION ID: corr-456\n" +
+			"DETAILS:\n" +
+			"  - CODE: InvalidParameter, MESSAGE: The provided location 'invalid-region' is not available., TARGET: location\n" +
+			"    - CODE: LocationNotAvailable, MESSAGE: Region 'invalid-region' does not support this resource type."
+		assert.Equal(t, expected, wrapper.Error())
+	})
+
+	t.Run("json", func(t *testing.T) {
+		err := WrapResponseErrorWithOptions(createStructuredResponseError(), &ResponseErrorWrapperOptions{Format: WrapperFormatJSON})
+		assert.NotContains(t, err.Error(), "\n")
+		var decoded map[string]any
+		require.NoError(t, json.Unmarshal([]byte(err.Error()), &decoded))
+		assert.Equal(t, "InvalidTemplateDeployment", decoded["errorCode"])
+		assert.Equal(t, "req-123", decoded["requestId"])
+	})
+}
+
+func TestResponseErrorWrapper_BodyHandling(t *testing.T) {
+	const body = `{"error": {"code": "SubnetIsFull", "message": "Subnet is full."}}`
+	newResponseError := func(respBody io.ReadCloser) *azcore.ResponseError {
+		return &azcore.ResponseError{
+			ErrorCode:  SubnetIsFullErrorCode,
+			StatusCode: http.StatusBadRequest,
+			RawResponse: &http.Response{
+				StatusCode: http.StatusBadRequest,
+				Body:       respBody,
+			},
+		}
+	}
+
+	t.Run("body is restored for other consumers", func(t *testing.T) {
+		respErr := newResponseError(io.NopCloser(bytes.NewBufferString(body)))
+		assert.Contains(t, NewResponseErrorWrapper(respErr).Error(), "MESSAGE: Subnet is full.")
+
+		restored, err := io.ReadAll(respErr.RawResponse.Body)
+		require.NoError(t, err)
+		assert.Equal(t, body, string(restored))
+	})
+
+	t.Run("body is readable by the ResponseError and other wrappers", func(t *testing.T) {
+		respErr := newResponseError(io.NopCloser(bytes.NewBufferString(body)))
+		assert.Contains(t, NewResponseErrorWrapper(respErr).Error(), "MESSAGE: Subnet is full.")
+		assert.Contains(t, respErr.Error(), "Subnet is full.")
+		assert.Contains(t, NewResponseErrorWrapper(respErr).Error(), "MESSAGE: Subnet is full.")
+	})
+
+	t.Run("seekable body keeps its position", func(t *testing.T) {
+		reader := bytes.NewReader([]byte(body))
+		_, err := reader.Seek(int64(len(body)), io.SeekStart)
+		require.NoError(t, err)
+		respErr := newResponseError(struct {
+			io.ReadSeeker
+			io.Closer
+		}{reader, io.NopCloser(nil)})
+
+		assert.Equal(t, "Subnet is full.", NewResponseErrorWrapper(respErr).Message())
+		offset, err := reader.Seek(0, io.SeekCurrent)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(body)), offset)
+	})
+
+	t.Run("bodies larger than the maximum size are not parsed", func(t *testing.T) {
+		respErr := newResponseError(io.NopCloser(bytes.NewBufferString(body)))
+		wrapper := NewResponseErrorWrapperWithOptions(respErr, &ResponseErrorWrapperOptions{MaxBodySize: 10})
+		assert.Equal(t, "HTTP CODE: 400, ERROR CODE: SubnetIsFull, MESSAGE: UNAVAILABLE, REQUEST: UNKNOWN UNAVAILABLE", wrapper.Error())
+
+		restored, err := io.ReadAll(respErr.RawResponse.Body)
+		require.NoError(t, err)
+		assert.Equal(t, body, string(restored))
+	})
+
+	t.Run("the category is classified from the body parsed once", func(t *testing.T) {
+		original := &countingReader{Reader: bytes.NewBufferString(body)}
+		originalBody := io.NopCloser(original)
+		respErr := newResponseError(originalBody)
+		// the code is only in the body
+		respErr.ErrorCode = ""
+		wrapper := NewResponseErrorWrapper(respErr)
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.ErrorIs(t, wrapper, ErrSubnetFull)
+				assert.Contains(t, wrapper.Error(), "Subnet is full.")
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, ErrorCategorySubnetFull, wrapper.Category())
+		assert.Equal(t, len(body), original.n)
+		// the body was replaced once, by the parse of the wrapper
+		restored, ok := respErr.RawResponse.Body.(*restoredBody)
+		require.True(t, ok)
+		assert.Equal(t, originalBody, restored.Closer)
+	})
+
+	t.Run("the category respects the maximum body size", func(t *testing.T) {
+		respErr := newResponseError(io.NopCloser(bytes.NewBufferString(body)))
+		respErr.ErrorCode = ""
+		wrapper := NewResponseErrorWrapperWithOptions(respErr, &ResponseErrorWrapperOptions{MaxBodySize: 10})
+		// the body is not parsed, the status code is used
+		assert.Equal(t, ErrorCategoryInvalidRequest, wrapper.Category())
+	})
+
+	t.Run("concurrent Error calls", func(t *testing.T) {
+		wrapper := NewResponseErrorWrapper(newResponseError(io.NopCloser(bytes.NewBufferString(body))))
+		var wg sync.WaitGroup
+		messages := make([]string, 10)
+		for i := range messages {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				messages[i] = wrapper.Error()
+			}()
+		}
+		wg.Wait()
+		for _, message := range messages {
+			assert.Equal(t, "HTTP CODE: 400, ERROR CODE: SubnetIsFull, MESSAGE: Subnet is full., REQUEST: UNKNOWN UNAVAILABLE", message)
+		}
+	})
+}
+
+func TestResponseErrorWrapper_Redaction(t *testing.T) {
+	newResponseError := func(rawURL string) *azcore.ResponseError {
+		requestURL, err := url.Parse(rawURL)
+		require.NoError(t, err)
+		body := `{"error": {"code": "AuthorizationFailed", "message": "The client '0a1b2c3d-1234-5678-9abc-def012345678' does not have authorization to perform action over scope '/subscriptions/0A1B2C3D-1234-5678-9ABC-DEF012345678'. Key: dGhpcyBpcyBhIHZlcnkgc2VjcmV0IHN0b3JhZ2UgYWNjb3VudCBrZXk="}}`
+		return &azcore.ResponseError{
+			ErrorCode:  "AuthorizationFailed",
+			StatusCode: http.StatusForbidden,
+			RawResponse: &http.Response{
+				StatusCode: http.StatusForbidden,
+				Body:       io.NopCloser(bytes.NewBufferString(body)),
+				Request:    &http.Request{Method: http.MethodGet, URL: requestURL},
+			},
+		}
+	}
+	const listURL = "https://management.azure.com/subscriptions/0A1B2C3D-1234-5678-9ABC-DEF012345678/providers/Microsoft.Compute/virtualMachines?api-version=2024-07-01&$skiptoken=YWJjZGVmZ2g%3D"
+	const sasURL = "https://account.blob.core.windows.net/container/blob?sv=2022-11-02&sp=r&sig=c2VjcmV0"
+
+	t.Run("default strips the query but api-version", func(t *testing.T) {
+		wrapper := NewResponseErrorWrapper(newResponseError(listURL))
+		assert.Equal(t, "HTTP CODE: 403, ERROR CODE: AuthorizationFailed, MESSAGE: The client '0a1b2c3d-1234-5678-9abc-def012345678' does not have authorization to perform action over scope '/subscriptions/0A1B2C3D-1234-5678-9ABC-DEF012345678'. Key: {KEY}, REQUEST: GET https://management.azure.com/subscriptions/0A1B2C3D-1234-5678-9ABC-DEF012345678/providers/Microsoft.Compute/virtualMachines?api-version=2024-07-01", wrapper.Error())
+		assert.Equal(t, "https://account.blob.core.windows.net/container/blob", NewResponseErrorWrapper(newResponseError(sasURL)).URL())
+	})
+
+	t.Run("mask GUIDs", func(t *testing.T) {
+		wrapper := NewResponseErrorWrapperWithOptions(newResponseError(listURL), &ResponseErrorWrapperOptions{
+			Format:    WrapperFormatJSON,
+			Redaction: &RedactionOptions{StripQuery: true, MaskGUIDs: true},
+		})
+		assert.NotContains(t, wrapper.Error(), "0A1B2C3D")
+		assert.NotContains(t, wrapper.Error(), "0a1b2c3d")
+		assert.Equal(t, "https://management.azure.com/subscriptions/00000000-0000-0000-0000-000000000000/providers/Microsoft.Compute/virtualMachines", wrapper.URL())
+	})
+
+	t.Run("sensitive query params are redacted when the query is kept", func(t *testing.T) {
+		wrapper := NewResponseErrorWrapperWithOptions(newResponseError(sasURL), &ResponseErrorWrapperOptions{Redaction: &RedactionOptions{}})
+		assert.Equal(t, "https://account.blob.core.windows.net/container/blob?sig=REDACTED&sp=r&sv=2022-11-02", wrapper.URL())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		wrapper := NewResponseErrorWrapperWithOptions(newResponseError(sasURL), &ResponseErrorWrapperOptions{Redaction: &RedactionOptions{Disabled: true}})
+		assert.Equal(t, sasURL, wrapper.URL())
+		assert.Contains(t, wrapper.Message(), "dGhpcyBpcyBhIHZlcnkgc2VjcmV0IHN0b3JhZ2UgYWNjb3VudCBrZXk=")
+	})
+
+	t.Run("package default", func(t *testing.T) {
+		defaultRedaction := DefaultRedactionOptions
+		t.Cleanup(func() { DefaultRedactionOptions = defaultRedaction })
+		DefaultRedactionOptions = RedactionOptions{StripQuery: true}
+
+		assert.Equal(t, "https://management.azure.com/subscriptions/0A1B2C3D-1234-5678-9ABC-DEF012345678/providers/Microsoft.Compute/virtualMachines", NewResponseErrorWrapper(newResponseError(listURL)).URL())
+	})
+}
+
+// countingReader counts the bytes read from Reader.
+type countingReader struct {
+	io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += n
+	return n, err
+}
@@ -0,0 +1,122 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+const queryKeyAPIVersion = "api-version"
+
+// APIVersionOverride records the api-version of a request changed by APIVersionOverridePolicy, see RequestInfo.
+type APIVersionOverride struct {
+	// Original is the api-version the request was created with, empty if it had none.
+	Original string
+	// Overridden is the api-version the request was sent with.
+	Overridden string
+}
+
+// APIVersionOverridePolicy pins the api-version of the requests to some resource providers or resource types,
+// without regenerating the SDK clients. It's meant to be added to the PerCallPolicies, so that
+// ArmRequestMetricPolicy reports the override in RequestInfo.APIVersionOverride.
+type APIVersionOverridePolicy struct {
+	// versions are keyed by lower-case provider namespace or resource type
+	versions map[string]string
+}
+
+// NewAPIVersionOverridePolicy returns a policy that sets the api-version of the requests according to versions,
+// keyed by provider namespace, e.g. Microsoft.Compute, or resource type, e.g. Microsoft.Compute/virtualMachines.
+// Keys are case-insensitive. The most specific key applies: the resource type of the request, then the types it's
+// a child of, then its provider.
+// The resource type of a request is the one of its URL parsed by arm.ParseResourceID, or of ClassifyArmRequest
+// for the URLs that are not resource IDs, e.g. lists. The polls of long-running operations keep their api-version.
+func NewAPIVersionOverridePolicy(versions map[string]string) *APIVersionOverridePolicy {
+	p := &APIVersionOverridePolicy{versions: make(map[string]string, len(versions))}
+	for key, version := range versions {
+		p.versions[strings.ToLower(key)] = version
+	}
+	return p
+}
+
+// Do implements the azcore/policy.Policy interface.
+func (p *APIVersionOverridePolicy) Do(req *policy.Request) (*http.Response, error) {
+	rawReq := req.Raw()
+	if rawReq == nil || rawReq.URL == nil {
+		return req.Next()
+	}
+	version, ok := p.versionFor(rawReq)
+	original := rawReq.URL.Query().Get(queryKeyAPIVersion)
+	if !ok || version == original {
+		return req.Next()
+	}
+
+	override := &APIVersionOverride{Original: original, Overridden: version}
+	if armCtx := armRequestContextFrom(rawReq.Context()); armCtx != nil {
+		// the policy runs after ArmRequestMetricPolicy, e.g. in the PerRetryPolicies
+		armCtx.requestInfo.APIVersionOverride = override
+	} else {
+		req.SetOperationValue(override)
+	}
+	replace := &QueryParameterPolicy{Name: queryKeyAPIVersion, Value: version, Replace: true}
+	return replace.Do(req)
+}
+
+// versionFor returns the api-version to send req with, if it's overridden.
+func (p *APIVersionOverridePolicy) versionFor(req *http.Request) (string, bool) {
+	if len(p.versions) == 0 {
+		return "", false
+	}
+	var resourceType string
+	if resId, err := arm.ParseResourceID(req.URL.Path); err == nil {
+		resourceType = resId.ResourceType.String()
+	}
+	classification := ClassifyArmRequest(req)
+	if classification.OperationKind == ArmOperationAsyncStatus {
+		return "", false
+	}
+	if resourceType == "" {
+		resourceType = classification.ResourceType
+	}
+	if resourceType == "" {
+		return "", false
+	}
+
+	// Microsoft.Compute/virtualMachines/extensions, then Microsoft.Compute/virtualMachines, then Microsoft.Compute
+	key := strings.ToLower(resourceType)
+	for {
+		if version, ok := p.versions[key]; ok {
+			return version, true
+		}
+		i := strings.LastIndexByte(key, '/')
+		if i < 0 {
+			return "", false
+		}
+		key = key[:i]
+	}
+}
+
+// apiVersionOverride returns the override recorded by an APIVersionOverridePolicy that ran before
+// ArmRequestMetricPolicy, nil if the api-version was not overridden.
+func apiVersionOverride(req *policy.Request) *APIVersionOverride {
+	var override *APIVersionOverride
+	if !req.OperationValue(&override) {
+		return nil
+	}
+	return override
+}
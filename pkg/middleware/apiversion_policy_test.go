@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIVersionOverridePolicy(t *testing.T) {
+	const base = "https://management.azure.com/subscriptions/sub/resourceGroups/rg/providers"
+
+	versions := map[string]string{
+		"Microsoft.Compute":                                     "2024-01-01",
+		"microsoft.compute/virtualmachines":                     "2024-07-01",
+		"Microsoft.ContainerService/managedClusters/agentPools": "2024-09-01",
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		expected string
+		override *APIVersionOverride
+	}{
+		{
+			name:     "resource type",
+			url:      base + "/Microsoft.Compute/virtualMachines/vm?api-version=2023-03-01",
+			expected: "2024-07-01",
+			override: &APIVersionOverride{Original: "2023-03-01", Overridden: "2024-07-01"},
+		},
+		{
+			name:     "child of a resource type",
+			url:      base + "/Microsoft.Compute/virtualMachines/vm/extensions/ext?api-version=2023-03-01",
+			expected: "2024-07-01",
+			override: &APIVersionOverride{Original: "2023-03-01", Overridden: "2024-07-01"},
+		},
+		{
+			name:     "provider",
+			url:      base + "/Microsoft.Compute/disks/disk?api-version=2023-03-01",
+			expected: "2024-01-01",
+			override: &APIVersionOverride{Original: "2023-03-01", Overridden: "2024-01-01"},
+		},
+		{
+			name:     "list",
+			url:      "https://management.azure.com/subscriptions/sub/providers/Microsoft.Compute/virtualMachines?api-version=2023-03-01",
+			expected: "2024-07-01",
+			override: &APIVersionOverride{Original: "2023-03-01", Overridden: "2024-07-01"},
+		},
+		{
+			name:     "action",
+			method:   http.MethodPost,
+			url:      base + "/Microsoft.Compute/virtualMachines/vm/start?api-version=2023-03-01",
+			expected: "2024-07-01",
+			override: &APIVersionOverride{Original: "2023-03-01", Overridden: "2024-07-01"},
+		},
+		{
+			name:     "missing api-version",
+			url:      base + "/Microsoft.Compute/virtualMachines/vm",
+			expected: "2024-07-01",
+			override: &APIVersionOverride{Overridden: "2024-07-01"},
+		},
+		{
+			name:     "parent of a resource type",
+			url:      base + "/Microsoft.ContainerService/managedClusters/aks?api-version=2023-03-01",
+			expected: "2023-03-01",
+		},
+		{
+			name:     "other provider",
+			url:      base + "/Microsoft.Network/virtualNetworks/vnet?api-version=2023-03-01",
+			expected: "2023-03-01",
+		},
+		{
+			name:     "same api-version",
+			url:      base + "/Microsoft.Compute/virtualMachines/vm?api-version=2024-07-01",
+			expected: "2024-07-01",
+		},
+		{
+			name:     "poll of a long-running operation",
+			url:      "https://management.azure.com/subscriptions/sub/providers/Microsoft.Compute/locations/westus/operations/op?api-version=2023-03-01",
+			expected: "2023-03-01",
+		},
+	}
+
+	for _, perRetry := range []bool{false, true} {
+		for _, tt := range tests {
+			name := tt.name
+			if perRetry {
+				name += " after the metric policy"
+			}
+			t.Run(name, func(t *testing.T) {
+				var sent *http.Request
+				var infos []*RequestInfo
+				collector := &testCollector{
+					requestStarted: func(iReq *RequestInfo) {},
+					requestCompleted: func(iReq *RequestInfo, iResp *ResponseInfo) {
+						infos = append(infos, iReq)
+					},
+				}
+				overridePolicy := NewAPIVersionOverridePolicy(versions)
+				opts := &policy.ClientOptions{
+					Transport: &mockServerTransport{do: func(req *http.Request) (*http.Response, error) {
+						sent = req
+						return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+					}},
+					Retry:            policy.RetryOptions{MaxRetries: -1},
+					PerRetryPolicies: []policy.Policy{&ArmRequestMetricPolicy{Collector: collector}},
+				}
+				if perRetry {
+					opts.PerRetryPolicies = append(opts.PerRetryPolicies, overridePolicy)
+				} else {
+					opts.PerCallPolicies = []policy.Policy{overridePolicy}
+				}
+				pl := runtime.NewPipeline("test", "v1", runtime.PipelineOptions{}, opts)
+
+				method := tt.method
+				if method == "" {
+					method = http.MethodGet
+				}
+				req, err := runtime.NewRequest(context.Background(), method, tt.url)
+				require.NoError(t, err)
+				_, err = pl.Do(req)
+				require.NoError(t, err)
+
+				require.NotNil(t, sent)
+				assert.Equal(t, tt.expected, sent.URL.Query().Get("api-version"))
+				require.Len(t, infos, 1)
+				assert.Equal(t, tt.override, infos[0].APIVersionOverride)
+			})
+		}
+	}
+}
@@ -0,0 +1,216 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxConsecutiveFailures is the number of consecutive transport errors after which a connection is evicted.
+	DefaultMaxConsecutiveFailures = 3
+	// DefaultEvictionCooldown is the time an evicted connection is not used.
+	DefaultEvictionCooldown = 30 * time.Second
+)
+
+// LoadBalancingOptions configures the spreading of the requests to a host across several connections.
+// With HTTP/2 all the requests to management.azure.com are multiplexed over one connection, pinned to a single
+// ARM frontend instance, which concentrates throttling on it.
+type LoadBalancingOptions struct {
+	// Connections is the number of connections per host the requests are spread across, each has its own transport.
+	// Load balancing is disabled if it's lower than 2.
+	Connections int
+	// DistinctIPs dials each connection to a different IP address of the host, when the host resolves to several.
+	DistinctIPs bool
+	// MaxConsecutiveFailures is the number of consecutive transport errors after which the connection is evicted:
+	// it's replaced by a new one, used once EvictionCooldown has passed.
+	// DefaultMaxConsecutiveFailures is used if zero.
+	MaxConsecutiveFailures int
+	// EvictionCooldown is the time an evicted connection is not used, DefaultEvictionCooldown is used if zero.
+	EvictionCooldown time.Duration
+}
+
+// armBalancer spreads the requests across several transports, to the ones with the fewest requests in flight first.
+type armBalancer struct {
+	opts *HTTPClientOptions
+	// lookupHost resolves the hosts for LoadBalancingOptions.DistinctIPs
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+	// now is replaced by tests
+	now func() time.Time
+
+	mu      sync.Mutex
+	members []*balancerMember
+	// next is the member preferred when members have as many requests in flight
+	next int
+}
+
+type balancerMember struct {
+	index int
+	// the fields below are protected by the mutex of the balancer
+	transport           *http.Transport
+	inFlight            int
+	consecutiveFailures int
+	evictedUntil        time.Time
+}
+
+func newArmBalancer(opts *HTTPClientOptions) (*armBalancer, error) {
+	b := &armBalancer{
+		opts:       opts,
+		lookupHost: net.DefaultResolver.LookupHost,
+		now:        time.Now,
+	}
+	if opts.DNSCache != nil {
+		b.lookupHost = opts.DNSCache.LookupHost
+	}
+	for i := range opts.LoadBalancing.Connections {
+		member := &balancerMember{index: i}
+		tr, err := b.newTransport(member)
+		if err != nil {
+			return nil, err
+		}
+		member.transport = tr
+		b.members = append(b.members, member)
+	}
+	return b, nil
+}
+
+func (b *armBalancer) newTransport(member *balancerMember) (*http.Transport, error) {
+	if !b.opts.LoadBalancing.DistinctIPs {
+		return newTransport(b.opts, nil)
+	}
+	return newTransport(b.opts, func(dial dialContextFunc) dialContextFunc {
+		return b.pinnedDial(member.index, dial)
+	})
+}
+
+// pinnedDial dials the index-th IP address of the host, in sorted order.
+// The address is dialed as is if it's an IP address or if it can't be resolved.
+func (b *armBalancer) pinnedDial(index int, dial dialContextFunc) dialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		ips, err := b.lookupHost(ctx, host)
+		if err != nil || len(ips) == 0 {
+			return dial(ctx, network, addr)
+		}
+		slices.Sort(ips)
+		return dial(ctx, network, net.JoinHostPort(ips[index%len(ips)], port))
+	}
+}
+
+func (b *armBalancer) RoundTrip(req *http.Request) (*http.Response, error) {
+	member, tr := b.pick()
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		b.done(member, tr, req.Context().Err() == nil)
+		return resp, err
+	}
+	b.succeeded(member)
+	// the request is in flight until its body is read or closed
+	resp.Body = &monitoredBody{ReadCloser: resp.Body, done: func() { b.done(member, tr, false) }}
+	return resp, nil
+}
+
+// pick returns the member with the fewest requests in flight, and its transport.
+// Evicted members are only used if all members are evicted.
+func (b *armBalancer) pick() (*balancerMember, *http.Transport) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	var picked *balancerMember
+	for i := range b.members {
+		member := b.members[(b.next+i)%len(b.members)]
+		if picked == nil || better(member, picked, now) {
+			picked = member
+		}
+	}
+	b.next = (picked.index + 1) % len(b.members)
+	picked.inFlight++
+	return picked, picked.transport
+}
+
+// better tells if member should be picked over picked.
+func better(member, picked *balancerMember, now time.Time) bool {
+	memberEvicted, pickedEvicted := now.Before(member.evictedUntil), now.Before(picked.evictedUntil)
+	if memberEvicted != pickedEvicted {
+		return pickedEvicted
+	}
+	if memberEvicted {
+		return member.evictedUntil.Before(picked.evictedUntil)
+	}
+	return member.inFlight < picked.inFlight
+}
+
+func (b *armBalancer) succeeded(member *balancerMember) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	member.consecutiveFailures = 0
+}
+
+// done records the end of a request sent with tr, failed tells if it failed with a transport error.
+func (b *armBalancer) done(member *balancerMember, tr *http.Transport, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	member.inFlight--
+	// requests sent before an eviction don't count against the new transport
+	if !failed || member.transport != tr {
+		return
+	}
+	member.consecutiveFailures++
+	if member.consecutiveFailures < b.maxConsecutiveFailures() {
+		return
+	}
+
+	fresh, err := b.newTransport(member)
+	if err != nil {
+		// can't happen, the options were validated by newArmBalancer
+		return
+	}
+	member.transport = fresh
+	member.consecutiveFailures = 0
+	member.evictedUntil = b.now().Add(b.evictionCooldown())
+	// requests in flight on the evicted transport go on, its idle connections are closed
+	tr.CloseIdleConnections()
+}
+
+func (b *armBalancer) maxConsecutiveFailures() int {
+	if b.opts.LoadBalancing.MaxConsecutiveFailures > 0 {
+		return b.opts.LoadBalancing.MaxConsecutiveFailures
+	}
+	return DefaultMaxConsecutiveFailures
+}
+
+func (b *armBalancer) evictionCooldown() time.Duration {
+	if b.opts.LoadBalancing.EvictionCooldown > 0 {
+		return b.opts.LoadBalancing.EvictionCooldown
+	}
+	return DefaultEvictionCooldown
+}
+
+// CloseIdleConnections closes the idle connections of all the transports.
+func (b *armBalancer) CloseIdleConnections() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, member := range b.members {
+		member.transport.CloseIdleConnections()
+	}
+}
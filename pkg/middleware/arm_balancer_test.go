@@ -0,0 +1,162 @@
+package middleware
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArmBalancer(t *testing.T) {
+	// remoteAddrs counts the requests per connection, localAddrs per listener of the server
+	type serverCounts struct {
+		mu          sync.Mutex
+		remoteAddrs map[string]int
+		localAddrs  map[string]int
+	}
+
+	// newServer starts a TLS server listening on port of each of the ips, port 0 picks a free port.
+	newServer := func(t *testing.T, ips ...string) (*httptest.Server, *serverCounts, int) {
+		counts := &serverCounts{remoteAddrs: map[string]int{}, localAddrs: map[string]int{}}
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			counts.mu.Lock()
+			defer counts.mu.Unlock()
+			counts.remoteAddrs[r.RemoteAddr]++
+			localAddr := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+			counts.localAddrs[localAddr.String()]++
+		}))
+		ln, err := net.Listen("tcp", net.JoinHostPort(ips[0], "0"))
+		require.NoError(t, err)
+		ts.Listener = ln
+		ts.EnableHTTP2 = true
+		ts.StartTLS()
+		t.Cleanup(ts.Close)
+
+		port := ln.Addr().(*net.TCPAddr).Port
+		for _, ip := range ips[1:] {
+			ln, err := net.Listen("tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+			if err != nil {
+				t.Skipf("can't listen on %s: %v", ip, err)
+			}
+			t.Cleanup(func() { ln.Close() })
+			go ts.Config.Serve(tls.NewListener(ln, ts.TLS))
+		}
+		return ts, counts, port
+	}
+
+	newBalancer := func(t *testing.T, ts *httptest.Server, lb *LoadBalancingOptions) *armBalancer {
+		opts := DefaultHTTPClientOptions()
+		opts.TLSClientConfig = ts.Client().Transport.(*http.Transport).TLSClientConfig
+		opts.LoadBalancing = lb
+		b, err := newArmBalancer(opts)
+		require.NoError(t, err)
+		t.Cleanup(b.CloseIdleConnections)
+		return b
+	}
+
+	get := func(client *http.Client, url string) error {
+		resp, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = io.ReadAll(resp.Body)
+		return err
+	}
+
+	t.Run("requests are spread across connections", func(t *testing.T) {
+		ts, counts, _ := newServer(t, "127.0.0.1")
+		opts := DefaultHTTPClientOptions()
+		opts.TLSClientConfig = ts.Client().Transport.(*http.Transport).TLSClientConfig
+		opts.LoadBalancing = &LoadBalancingOptions{Connections: 3}
+		client, err := NewHTTPClient(opts)
+		require.NoError(t, err)
+
+		for range 9 {
+			require.NoError(t, get(client, ts.URL))
+		}
+		assert.Len(t, counts.remoteAddrs, 3)
+		for addr, count := range counts.remoteAddrs {
+			assert.Equal(t, 3, count, addr)
+		}
+	})
+
+	t.Run("requests in flight are taken into account", func(t *testing.T) {
+		ts, _, _ := newServer(t, "127.0.0.1")
+		b := newBalancer(t, ts, &LoadBalancingOptions{Connections: 2})
+		first, _ := b.pick()
+		second, _ := b.pick()
+		assert.NotEqual(t, first.index, second.index)
+		b.done(second, second.transport, false)
+		// it's the turn of the first member, but it has more requests in flight
+		third, _ := b.pick()
+		assert.Equal(t, second.index, third.index)
+		assert.Equal(t, 1, first.inFlight)
+		assert.Equal(t, 1, third.inFlight)
+	})
+
+	t.Run("connections are dialed to distinct IPs", func(t *testing.T) {
+		ts, counts, port := newServer(t, "127.0.0.1", "127.0.0.2")
+		b := newBalancer(t, ts, &LoadBalancingOptions{Connections: 2, DistinctIPs: true})
+		b.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+			return []string{"127.0.0.2", "127.0.0.1"}, nil
+		}
+		client := &http.Client{Transport: b}
+
+		// example.com is in the certificate of the test server
+		url := "https://example.com:" + strconv.Itoa(port)
+		for range 4 {
+			require.NoError(t, get(client, url))
+		}
+		assert.Equal(t, map[string]int{
+			"127.0.0.1:" + strconv.Itoa(port): 2,
+			"127.0.0.2:" + strconv.Itoa(port): 2,
+		}, counts.localAddrs)
+	})
+
+	t.Run("failing connections are evicted", func(t *testing.T) {
+		ts, counts, port := newServer(t, "127.0.0.1")
+		b := newBalancer(t, ts, &LoadBalancingOptions{
+			Connections:            2,
+			DistinctIPs:            true,
+			MaxConsecutiveFailures: 1,
+			EvictionCooldown:       time.Minute,
+		})
+		// nothing listens on 127.0.0.3
+		b.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+			return []string{"127.0.0.1", "127.0.0.3"}, nil
+		}
+		now := time.Now()
+		b.now = func() time.Time { return now }
+		client := &http.Client{Transport: b}
+		url := "https://example.com:" + strconv.Itoa(port)
+
+		failures := 0
+		for range 6 {
+			if get(client, url) != nil {
+				failures++
+			}
+		}
+		assert.Equal(t, 1, failures)
+		assert.Equal(t, 5, counts.localAddrs["127.0.0.1:"+strconv.Itoa(port)])
+
+		// the evicted connection is used again after the cooldown
+		now = now.Add(2 * time.Minute)
+		failures = 0
+		for range 2 {
+			if get(client, url) != nil {
+				failures++
+			}
+		}
+		assert.Equal(t, 1, failures)
+	})
+}
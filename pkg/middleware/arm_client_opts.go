@@ -30,10 +30,15 @@ func DefaultArmOpts(userAgent string, logCollector ArmRequestMetricCollector, cu
 	// we add the logging policy to the PerRetryPolicies so we can track
 	// any retries that happened
 	opts.PerRetryPolicies = []policy.Policy{
+		// waits out the backoff of the previous try before the latency of the next one is measured
+		&RetryBackoffPolicy{},
 		runtime.NewRequestIDPolicy(),
 		&ArmRequestMetricPolicy{Collector: logCollector},
 	}
-	opts.PerCallPolicies = []policy.Policy{}
+	opts.PerCallPolicies = []policy.Policy{
+		// lets the ArmRequestMetricPolicy tell per-try timeouts from deadlines of the caller
+		&CallerContextPolicy{},
+	}
 	if customPerCallPolicies != nil {
 		opts.PerCallPolicies = append(opts.PerCallPolicies, customPerCallPolicies...)
 	}
@@ -56,6 +61,9 @@ func DefaultRetryOpts() policy.RetryOptions {
 		// Specifying values will replace the default values.
 		// Specifying an empty slice will disable retries for HTTP status codes.
 		// StatusCodes: nil,
+		// ShouldRetry replaces the status code check with the classification of the ARM error,
+		// see ShouldRetryResponse.
+		ShouldRetry: ShouldRetryResponse,
 	}
 }
 
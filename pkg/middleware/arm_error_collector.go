@@ -3,11 +3,16 @@ package middleware
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptrace"
+	"slices"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
@@ -15,6 +20,9 @@ import (
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"golang.org/x/net/http2"
+
+	armerrors "github.com/Azure/azure-sdk-for-go-extensions/pkg/errors"
 )
 
 const (
@@ -25,32 +33,117 @@ const (
 	ArmErrorCodeUnexpectedTransportError     ArmErrorCode = "UnexpectedTransportError"
 	ArmErrorCodeContextCanceled              ArmErrorCode = "ContextCanceled"
 	ArmErrorCodeContextDeadlineExceeded      ArmErrorCode = "ContextDeadlineExceeded"
+	// ArmErrorCodeTryTimeout is used when the per-try timeout of the retry policy (policy.RetryOptions.TryTimeout)
+	// expired, while the context of the caller is still valid.
+	ArmErrorCodeTryTimeout ArmErrorCode = "TryTimeout"
+	// ArmErrorCodeClientTimeout is used when a timeout of the http client or the transport expired,
+	// while the context is still valid.
+	ArmErrorCodeClientTimeout     ArmErrorCode = "ClientTimeout"
+	ArmErrorCodeDNSError          ArmErrorCode = "DNSError"
+	ArmErrorCodeConnectionRefused ArmErrorCode = "ConnectionRefused"
+	ArmErrorCodeDialError         ArmErrorCode = "DialError"
+	ArmErrorCodeTLSHandshakeError ArmErrorCode = "TLSHandshakeError"
+	ArmErrorCodeConnectionReset   ArmErrorCode = "ConnectionReset"
+	ArmErrorCodeHTTP2GoAway       ArmErrorCode = "HTTP2GoAway"
+	ArmErrorCodeProxyError        ArmErrorCode = "ProxyError"
+	// ArmErrorCodeResponseHeaderTimeout is used when the response headers were not received within
+	// HTTPClientOptions.ResponseHeaderTimeout, see ErrResponseHeaderTimeout.
+	ArmErrorCodeResponseHeaderTimeout ArmErrorCode = "ResponseHeaderTimeout"
+	// ArmErrorCodeBodyReadIdleTimeout is used when the HTTP/1.1 response body received nothing within
+	// HTTPClientOptions.BodyReadIdleTimeout, see ErrBodyReadIdleTimeout.
+	ArmErrorCodeBodyReadIdleTimeout ArmErrorCode = "BodyReadIdleTimeout"
 )
 
 // ArmError is unified Error Experience across AzureResourceManager, it contains Code Message.
+// It wraps the error it was created from, so the predicates of pkg/errors accept an *ArmError,
+// e.g. armerrors.SKUFamilyQuotaHasBeenReached(respInfo.Error).
 type ArmError struct {
 	Code    ArmErrorCode `json:"code"`
 	Message string       `json:"message"`
+	// Target, Details and AdditionalInfo are parsed from the body of the response.
+	Target         string                               `json:"target,omitempty"`
+	Details        []ArmError                           `json:"details,omitempty"`
+	AdditionalInfo []armerrors.AzureErrorAdditionalInfo `json:"additionalInfo,omitempty"`
+	// StatusCode is the HTTP status code of the response, 0 for transport errors.
+	StatusCode int `json:"statusCode,omitempty"`
+
+	// cause is the *azcore.ResponseError or transport error the ArmError was created from
+	cause error
+}
+
+func (e *ArmError) Error() string {
+	return string(e.Code) + ": " + e.Message
+}
+
+// Unwrap returns the *azcore.ResponseError or transport error the ArmError was created from.
+func (e *ArmError) Unwrap() error {
+	if e == nil {
+		return nil
+	}
+	return e.cause
 }
 
 type ArmErrorCode string
 
 type RequestInfo struct {
-	Request  *http.Request
+	Request *http.Request
+	// ArmResId is nil if the URL path is not a resource ID, e.g. for lists and actions. Use Classification instead.
 	ArmResId *arm.ResourceID
+	// Classification is set for every request.
+	Classification *ArmRequestClassification
+	// Attempt is the number of the try of the operation, starting at 1, retries have an Attempt greater than 1.
+	Attempt int
+	// APIVersionOverride is set if an APIVersionOverridePolicy changed the api-version of the request.
+	APIVersionOverride *APIVersionOverride
 }
 
 func newRequestInfo(req *http.Request, resId *arm.ResourceID) *RequestInfo {
-	return &RequestInfo{Request: req, ArmResId: resId}
+	return &RequestInfo{Request: req, ArmResId: resId, Classification: ClassifyArmRequest(req)}
+}
+
+// tryCounter numbers the tries of an operation for the policies that report them: ArmRequestMetricPolicy,
+// RetryBackoffPolicy and DumpPolicy. It's shared by the clones of the request. A try starts when the first of these
+// policies enters it and ends when that policy returns, so they agree on its number whatever their order.
+type tryCounter struct {
+	count int
+	depth int
+}
+
+// enterTry returns the number of the current try of the operation, exit must be called once the policy returns.
+func enterTry(req *policy.Request) (attempt int, exit func()) {
+	var tries *tryCounter
+	if !req.OperationValue(&tries) {
+		tries = &tryCounter{}
+		req.SetOperationValue(tries)
+	}
+	if tries.depth == 0 {
+		tries.count++
+	}
+	tries.depth++
+	return tries.count, func() { tries.depth-- }
 }
 
 type ResponseInfo struct {
-	Response      *http.Response
-	Error         *ArmError
+	Response *http.Response
+	Error    *ArmError
+	// ResponseError is the error of 4xx and 5xx responses, nil for transport errors.
+	ResponseError *azcore.ResponseError
+	// ErrorCategory is the classification of Error, ErrorCategoryUnknown for transport errors.
+	// It is empty if the request succeeded.
+	ErrorCategory armerrors.ErrorCategory
 	Latency       time.Duration
 	RequestId     string
 	CorrelationId string
 	ConnTracking  *HttpConnTracking
+	// HostConnStats are the stats of the connections to the host once the request got its connection,
+	// nil if the transport is not tracked by a ConnPoolMonitor, see HTTPClientOptions.ConnPoolMonitor.
+	HostConnStats *HostConnStats
+	// DNSCacheResult is how the host was resolved if the request dialed a connection with a DNSCache,
+	// empty otherwise, see HTTPClientOptions.DNSCache.
+	DNSCacheResult DNSCacheResult
+	// Payload are the sizes of the bodies, nil if the transport is not created by NewHTTPClient.
+	// The response body is counted as it's read: unless the pipeline skips its download, it's read by then.
+	Payload *PayloadStats
 }
 
 
@@ -81,19 +174,29 @@ func (p *ArmRequestMetricPolicy) Do(req *policy.Request) (*http.Response, error)
 		return req.Next()
 	}
 
-	armResId, err := arm.ParseResourceID(httpReq.URL.Path)
-	if err != nil {
-		// TODO: error handling without break the request.
-	}
+	// the path of lists, actions and async operation polls is not a resource ID,
+	// RequestInfo.Classification describes those.
+	armResId, _ := arm.ParseResourceID(httpReq.URL.Path)
 
 	connTracking := &HttpConnTracking{}
+	requestInfo := newRequestInfo(httpReq, armResId)
+	attempt, exitTry := enterTry(req)
+	defer exitTry()
+	requestInfo.Attempt = attempt
+	requestInfo.APIVersionOverride = apiVersionOverride(req)
+	newCtx := addConnectionTracingToRequestContext(httpReq.Context(), connTracking)
+	// lets the transport, e.g. the span enrichment of NewArmSpanRoundTripper, reuse what the policy knows about the request
+	armCtx := &armRequestContext{
+		requestInfo:  requestInfo,
+		connTracking: connTracking,
+		callerCtx:    callerContext(req),
+	}
+	newCtx = withArmRequestContext(newCtx, armCtx)
 	// have to add to the context at first - then clone the policy.Request struct
 	// this allows the connection tracing to happen
 	// otherwise we can't change the underlying http request of req, we have to use
 	// newARMReq
-	newCtx := addConnectionTracingToRequestContext(httpReq.Context(), connTracking)
 	newARMReq := req.Clone(newCtx)
-	requestInfo := newRequestInfo(httpReq, armResId)
 	started := time.Now()
 
 	p.requestStarted(requestInfo)
@@ -109,14 +212,24 @@ func (p *ArmRequestMetricPolicy) Do(req *policy.Request) (*http.Response, error)
 			Response:     resp,
 			Latency:      latency,
 			ConnTracking: connTracking,
+			// set by the transport before it returned
+			HostConnStats: armCtx.hostConnStats,
+		}
+		respInfo.DNSCacheResult, _ = armCtx.dnsCacheResult.Load().(DNSCacheResult)
+		if armCtx.payload != nil {
+			respInfo.Payload = armCtx.payload.snapshot()
 		}
 
 		if reqErr != nil {
 			// either it's a transport error
 			// or it is already handled by previous policy
-			respInfo.Error = parseTransportError(reqErr)
+			respInfo.Error = parseTransportError(reqErr, callerContext(req))
 		} else {
-			respInfo.Error = parseArmErrorFromResponse(resp)
+			respInfo.Error = armCtx.armError(resp)
+		}
+		if respInfo.Error != nil {
+			respInfo.ResponseError = armerrors.IsResponseError(respInfo.Error)
+			respInfo.ErrorCategory = armerrors.ClassifyError(respInfo.Error)
 		}
 
 		// need to get the request id and correlation id from the response.request header
@@ -156,28 +269,175 @@ func parseArmErrorFromResponse(resp *http.Response) *ArmError {
 		err := runtime.NewResponseError(resp)
 		respErr := &azcore.ResponseError{}
 		if errors.As(err, &respErr) {
-			return &ArmError{Code: ArmErrorCode(respErr.ErrorCode), Message: respErr.Error()}
+			return newArmErrorFromResponseError(respErr)
 		}
-		return &ArmError{Code: ArmErrorCodeCastToArmResponseErrorFailed, Message: fmt.Sprintf("Response body is not in ARM error form: {error:{code, message}}: %s", err.Error())}
+		return &ArmError{Code: ArmErrorCodeCastToArmResponseErrorFailed, Message: fmt.Sprintf("Response body is not in ARM error form: {error:{code, message}}: %s", err.Error()), cause: err}
 	}
 	return nil
 }
 
+// newArmErrorFromResponseError creates an ArmError from the body of the response, which is left for downstream policies.
+// The message is the one of the body, and falls back to the azcore dump of the response if the body can't be parsed.
+func newArmErrorFromResponseError(respErr *azcore.ResponseError) *ArmError {
+	armErr := &ArmError{
+		Code:       ArmErrorCode(respErr.ErrorCode),
+		Message:    respErr.Error(),
+		StatusCode: respErr.StatusCode,
+		cause:      respErr,
+	}
+	if azureError := armerrors.ParseResponseError(respErr); azureError != nil {
+		if armErr.Code == "" {
+			armErr.Code = ArmErrorCode(azureError.Code)
+		}
+		if azureError.Message != "" {
+			armErr.Message = azureError.Message
+		}
+		armErr.Target = azureError.Target
+		armErr.AdditionalInfo = azureError.AdditionalInfo
+		armErr.Details = armErrorDetails(azureError.DetailErrors())
+	}
+	return armErr
+}
+
+func armErrorDetails(details []armerrors.AzureError) []ArmError {
+	if len(details) == 0 {
+		return nil
+	}
+	result := make([]ArmError, 0, len(details))
+	for _, detail := range details {
+		result = append(result, ArmError{
+			Code:           ArmErrorCode(detail.Code),
+			Message:        detail.Message,
+			Target:         detail.Target,
+			AdditionalInfo: detail.AdditionalInfo,
+			Details:        armErrorDetails(detail.DetailErrors()),
+		})
+	}
+	return result
+}
+
 // distinguash
 // - Context Cancelled (request configured context to have timeout)
+// - TryTimeout (context of the caller still valid, per-try timeout of the retry policy expired)
 // - ClientTimeout (context still valid, http client have timeout configured)
-// - Transport Error (DNS/Dial/TLS/ServerTimeout)
-func parseTransportError(err error) *ArmError {
+// - ResponseHeaderTimeout/BodyReadIdleTimeout (the watchdog of the transport canceled the request)
+// - Transport Error (DNS/Dial/TLS/Reset/GOAWAY/Proxy)
+// callerCtx is the context of the caller, see CallerContextPolicy, it's nil if unknown.
+func parseTransportError(err error, callerCtx context.Context) *ArmError {
 	if err == nil {
 		return nil
 	}
+	return &ArmError{Code: transportErrorCode(err, callerCtx), Message: err.Error(), cause: err}
+}
+
+func transportErrorCode(err error, callerCtx context.Context) ArmErrorCode {
+	// the watchdog cancels the request, it's checked before the context errors
+	if errors.Is(err, ErrResponseHeaderTimeout) {
+		return ArmErrorCodeResponseHeaderTimeout
+	}
+	if errors.Is(err, ErrBodyReadIdleTimeout) {
+		return ArmErrorCodeBodyReadIdleTimeout
+	}
+	// the timeouts of http.Client and http.Transport wrap context.DeadlineExceeded too, as of Go 1.25,
+	// they are told from the deadlines of the contexts by their message
+	if isClientTimeout(err) {
+		return ArmErrorCodeClientTimeout
+	}
 	if errors.Is(err, context.Canceled) {
-		return &ArmError{Code: ArmErrorCodeContextCanceled, Message: err.Error()}
+		return ArmErrorCodeContextCanceled
 	}
 	if errors.Is(err, context.DeadlineExceeded) {
-		return &ArmError{Code: ArmErrorCodeContextDeadlineExceeded, Message: err.Error()}
+		if callerCtx != nil && callerCtx.Err() == nil {
+			return ArmErrorCodeTryTimeout
+		}
+		return ArmErrorCodeContextDeadlineExceeded
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return ArmErrorCodeDNSError
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "proxyconnect" {
+		return ArmErrorCodeProxyError
+	}
+	if isTLSHandshakeError(err) {
+		return ArmErrorCodeTLSHandshakeError
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return ArmErrorCodeConnectionRefused
+	}
+	if opErr != nil && opErr.Op == "dial" {
+		return ArmErrorCodeDialError
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return ArmErrorCodeConnectionReset
+	}
+	// the http2 implementation bundled in net/http has its own GoAwayError, typed but unexported,
+	// so its errors are matched by their message, which TestParseTransportError checks against a real server
+	var goAwayErr http2.GoAwayError
+	if errors.As(err, &goAwayErr) || strings.Contains(err.Error(), "server sent GOAWAY") {
+		return ArmErrorCodeHTTP2GoAway
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ArmErrorCodeClientTimeout
 	}
-	return &ArmError{Code: ArmErrorCodeTransportError, Message: err.Error()}
+	return ArmErrorCodeTransportError
+}
+
+// clientTimeoutMessages are the messages of the timeout errors of net/http:
+// http.Client.Timeout and http.Transport.ResponseHeaderTimeout.
+var clientTimeoutMessages = []string{"Client.Timeout exceeded", "timeout awaiting response headers"}
+
+func isClientTimeout(err error) bool {
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		return false
+	}
+	msg := err.Error()
+	return slices.ContainsFunc(clientTimeoutMessages, func(m string) bool { return strings.Contains(msg, m) })
+}
+
+func isTLSHandshakeError(err error) bool {
+	var recordHeaderErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var certVerificationErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certInvalidErr x509.CertificateInvalidError
+	var opErr *net.OpError
+	return errors.As(err, &recordHeaderErr) ||
+		errors.As(err, &alertErr) ||
+		errors.As(err, &certVerificationErr) ||
+		errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &certInvalidErr) ||
+		// tls alerts sent by the server, e.g. "remote error: tls: handshake failure"
+		(errors.As(err, &opErr) && opErr.Op == "remote error")
+}
+
+// callerContextValue holds the context of the caller, before the retry policy applies its per-try timeout.
+type callerContextValue struct {
+	ctx context.Context
+}
+
+// CallerContextPolicy records the context of the caller so that ArmRequestMetricPolicy can tell a per-try timeout
+// of the retry policy from a deadline of the caller. It must be added to the PerCallPolicies, DefaultArmOpts does so.
+type CallerContextPolicy struct{}
+
+func (p *CallerContextPolicy) Do(req *policy.Request) (*http.Response, error) {
+	req.SetOperationValue(callerContextValue{ctx: req.Raw().Context()})
+	return req.Next()
+}
+
+// callerContext returns the context recorded by CallerContextPolicy, or nil.
+func callerContext(req *policy.Request) context.Context {
+	var value callerContextValue
+	if req.OperationValue(&value) {
+		return value.ctx
+	}
+	return nil
 }
 
 func addConnectionTracingToRequestContext(ctx context.Context, connTracking *HttpConnTracking) context.Context {
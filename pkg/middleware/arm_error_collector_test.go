@@ -2,9 +2,18 @@ package middleware
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -13,6 +22,10 @@ import (
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerservice/armcontainerservice/v8"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+
+	armerrors "github.com/Azure/azure-sdk-for-go-extensions/pkg/errors"
 )
 
 func TestArmRequestMetrics(t *testing.T) {
@@ -26,6 +39,8 @@ func TestArmRequestMetrics(t *testing.T) {
 		assert.Equal(tt, iReq.ArmResId.SubscriptionID, subID)
 		assert.Equal(tt, iReq.ArmResId.ResourceGroupName, rgName)
 		assert.Equal(tt, iReq.ArmResId.Name, resourceName)
+		assert.NotNil(tt, iReq.Classification)
+		assert.Equal(tt, subID, iReq.Classification.SubscriptionID)
 		assert.NotNil(tt, iReq.Request)
 	}
 
@@ -122,6 +137,38 @@ func TestArmRequestMetrics(t *testing.T) {
 		assert.Error(tt, err)
 	})
 
+	t.Run("should carry the ResponseError and its classification for failed requests", func(tt *testing.T) {
+		tt.Parallel()
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Ms-Error-Code", armerrors.OperationNotAllowed)
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error":{"code":"OperationNotAllowed","message":"Operation could not be completed as it results in exceeding approved standardDSv3Family Family Cores quota."}}`))
+		}))
+		defer ts.Close()
+
+		var completed *ResponseInfo
+		collector := &testCollector{
+			requestStarted: func(iReq *RequestInfo) {},
+			requestCompleted: func(iReq *RequestInfo, iResp *ResponseInfo) {
+				completed = iResp
+			},
+		}
+
+		clientOptions := DefaultArmOpts("testUserAgent", collector)
+		clientOptions.Transport = newMockServerTransportWithTestServer(ts)
+		client, err := armcontainerservice.NewManagedClustersClient(subID, &mockTokenCredential{}, clientOptions)
+		assert.NoError(tt, err)
+		_, err = client.Get(context.Background(), rgName, resourceName, nil)
+		assert.Error(tt, err)
+
+		assert.NotNil(tt, completed)
+		assert.NotNil(tt, completed.ResponseError)
+		assert.Equal(tt, http.StatusConflict, completed.ResponseError.StatusCode)
+		assert.Equal(tt, armerrors.ErrorCategoryQuotaExceeded, completed.ErrorCategory)
+		assert.True(tt, armerrors.SKUFamilyQuotaHasBeenReached(completed.Error))
+		assert.Same(tt, completed.ResponseError, armerrors.IsResponseError(completed.Error))
+	})
+
 	t.Run("should get correct ArmError when context timeout", func(tt *testing.T) {
 		tt.Parallel()
 		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -209,7 +256,7 @@ func TestArmRequestMetrics(t *testing.T) {
 				assert.True(tt, iResp.Latency > 0)
 				respErr := iResp.Error
 				assert.NotNil(tt, respErr)
-				assert.Equal(tt, ArmErrorCodeTransportError, respErr.Code)
+				assert.Equal(tt, ArmErrorCodeConnectionRefused, respErr.Code)
 				assert.NotEmpty(tt, respErr.Message)
 			},
 		}
@@ -242,7 +289,7 @@ func TestArmRequestMetrics(t *testing.T) {
 				assert.True(tt, iResp.Latency > 0)
 				respErr := iResp.Error
 				assert.NotNil(tt, respErr)
-				assert.Equal(tt, ArmErrorCodeContextDeadlineExceeded, respErr.Code)
+				assert.Equal(tt, ArmErrorCodeTryTimeout, respErr.Code)
 				assert.NotEmpty(tt, respErr.Message)
 			},
 		}
@@ -260,6 +307,238 @@ func TestArmRequestMetrics(t *testing.T) {
 
 }
 
+func TestTryCounter(t *testing.T) {
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls++; calls == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	var metricAttempts []int
+	collector := &testCollector{
+		requestStarted: func(iReq *RequestInfo) {},
+		requestCompleted: func(iReq *RequestInfo, iResp *ResponseInfo) {
+			metricAttempts = append(metricAttempts, iReq.Attempt)
+		},
+	}
+	sink := NewRingDumpSink(10)
+	pl := runtime.NewPipeline("test", "v1", runtime.PipelineOptions{}, &policy.ClientOptions{
+		Transport: ts.Client(),
+		Retry:     policy.RetryOptions{MaxRetries: 1, RetryDelay: time.Millisecond},
+		PerRetryPolicies: []policy.Policy{
+			NewDumpPolicy(DumpPolicyOptions{Sink: sink, Enabled: true}),
+			&RetryBackoffPolicy{},
+			&ArmRequestMetricPolicy{Collector: collector},
+		},
+	})
+	req, err := runtime.NewRequest(context.Background(), http.MethodGet, ts.URL)
+	require.NoError(t, err)
+	resp, err := pl.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the policies of a try agree on its number
+	assert.Equal(t, []int{1, 2}, metricAttempts)
+	var dumpAttempts []int
+	for _, exchange := range sink.Exchanges() {
+		dumpAttempts = append(dumpAttempts, exchange.Attempt)
+	}
+	assert.Equal(t, []int{1, 2}, dumpAttempts)
+}
+
+func TestArmErrorUnwrap(t *testing.T) {
+	transportErr := parseTransportError(fmt.Errorf("dial: %w", context.Canceled), nil)
+	assert.ErrorIs(t, transportErr, context.Canceled)
+	assert.Nil(t, armerrors.IsResponseError(transportErr))
+	assert.Equal(t, armerrors.ErrorCategoryUnknown, armerrors.ClassifyError(transportErr))
+	assert.Equal(t, "ContextCanceled: dial: context canceled", transportErr.Error())
+
+	var nilErr *ArmError
+	assert.Nil(t, nilErr.Unwrap())
+	assert.Nil(t, parseArmErrorFromResponse(&http.Response{StatusCode: http.StatusOK}))
+}
+
+func TestParseTransportError(t *testing.T) {
+	expiredCtx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	urlErr := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://management.azure.com/subscriptions", Err: err}
+	}
+
+	tests := []struct {
+		name      string
+		err       error
+		callerCtx context.Context
+		expected  ArmErrorCode
+	}{
+		{"caller canceled", urlErr(context.Canceled), nil, ArmErrorCodeContextCanceled},
+		{"caller deadline", urlErr(context.DeadlineExceeded), expiredCtx, ArmErrorCodeContextDeadlineExceeded},
+		{"deadline with unknown caller context", urlErr(context.DeadlineExceeded), nil, ArmErrorCodeContextDeadlineExceeded},
+		{"per-try timeout", urlErr(context.DeadlineExceeded), context.Background(), ArmErrorCodeTryTimeout},
+		{"dns", urlErr(&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "management.azure.com", IsNotFound: true}}), nil, ArmErrorCodeDNSError},
+		{"connection refused", urlErr(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), nil, ArmErrorCodeConnectionRefused},
+		{"dial", urlErr(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}), nil, ArmErrorCodeDialError},
+		{"proxy", urlErr(&net.OpError{Op: "proxyconnect", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), nil, ArmErrorCodeProxyError},
+		{"tls certificate", urlErr(&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}), nil, ArmErrorCodeTLSHandshakeError},
+		{"tls alert", urlErr(&net.OpError{Op: "remote error", Err: tls.AlertError(40)}), nil, ArmErrorCodeTLSHandshakeError},
+		{"connection reset", urlErr(&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), nil, ArmErrorCodeConnectionReset},
+		{"broken pipe", urlErr(&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}), nil, ArmErrorCodeConnectionReset},
+		{"http2 goaway", urlErr(http2.GoAwayError{ErrCode: http2.ErrCodeNo, DebugData: "server shutting down"}), nil, ArmErrorCodeHTTP2GoAway},
+		{"bundled http2 goaway", urlErr(errors.New("http2: server sent GOAWAY and closed the connection; LastStreamID=1, ErrCode=NO_ERROR, debug=\"\"")), nil, ArmErrorCodeHTTP2GoAway},
+		{"client timeout", urlErr(timeoutError{}), context.Background(), ArmErrorCodeClientTimeout},
+		{"client timeout wrapping the deadline", urlErr(deadlineTimeoutError{"context deadline exceeded (Client.Timeout exceeded while awaiting headers)"}), context.Background(), ArmErrorCodeClientTimeout},
+		{"response header timeout of the transport", urlErr(deadlineTimeoutError{"net/http: timeout awaiting response headers"}), context.Background(), ArmErrorCodeClientTimeout},
+		{"other", urlErr(errors.New("unexpected EOF")), nil, ArmErrorCodeTransportError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			armErr := parseTransportError(tt.err, tt.callerCtx)
+			assert.Equal(t, tt.expected, armErr.Code)
+			assert.ErrorIs(t, armErr, tt.err)
+		})
+	}
+
+	t.Run("timeouts of a real client", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}))
+		defer ts.Close()
+
+		_, err := (&http.Client{Timeout: 20 * time.Millisecond}).Get(ts.URL)
+		require.Error(t, err)
+		assert.Equal(t, ArmErrorCodeClientTimeout, parseTransportError(err, context.Background()).Code)
+
+		_, err = (&http.Client{Transport: &http.Transport{ResponseHeaderTimeout: 20 * time.Millisecond}}).Get(ts.URL)
+		require.Error(t, err)
+		assert.Equal(t, ArmErrorCodeClientTimeout, parseTransportError(err, context.Background()).Code)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+		require.NoError(t, err)
+		_, err = ts.Client().Do(req)
+		require.Error(t, err)
+		assert.Equal(t, ArmErrorCodeTryTimeout, parseTransportError(err, context.Background()).Code)
+	})
+
+	t.Run("untrusted certificate of a real server", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer ts.Close()
+		_, err := http.Get(ts.URL)
+		assert.Equal(t, ArmErrorCodeTLSHandshakeError, parseTransportError(err, context.Background()).Code)
+	})
+
+	t.Run("goaway of a real http2 server", func(t *testing.T) {
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		ts.EnableHTTP2 = true
+		// the server sends GOAWAY once the request is received, and closes the connection without answering it
+		ts.Config.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+			"h2": func(s *http.Server, c *tls.Conn, h http.Handler) {
+				defer c.Close()
+				if _, err := io.ReadFull(c, make([]byte, len(http2.ClientPreface))); err != nil {
+					return
+				}
+				framer := http2.NewFramer(c, c)
+				if framer.WriteSettings() != nil {
+					return
+				}
+				for {
+					frame, err := framer.ReadFrame()
+					if err != nil {
+						return
+					}
+					if headers, ok := frame.(*http2.HeadersFrame); ok {
+						_ = framer.WriteGoAway(headers.StreamID, http2.ErrCodeNo, nil)
+						return
+					}
+				}
+			},
+		}
+		ts.StartTLS()
+		defer ts.Close()
+
+		_, err := ts.Client().Get(ts.URL)
+		require.Error(t, err)
+		assert.Equal(t, ArmErrorCodeHTTP2GoAway, parseTransportError(err, context.Background()).Code, err.Error())
+	})
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string {
+	return "net/http: request canceled (Client.Timeout exceeded while awaiting headers)"
+}
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// deadlineTimeoutError is like the timeout errors of net/http, that wrap context.DeadlineExceeded.
+type deadlineTimeoutError struct {
+	msg string
+}
+
+func (e deadlineTimeoutError) Error() string { return e.msg }
+func (deadlineTimeoutError) Timeout() bool   { return true }
+func (deadlineTimeoutError) Is(err error) bool {
+	return err == context.DeadlineExceeded
+}
+
+func TestParseArmErrorFromResponse(t *testing.T) {
+	newResponse := func(statusCode int, header http.Header, body string) *http.Response {
+		return &http.Response{
+			StatusCode: statusCode,
+			Header:     header,
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request: &http.Request{
+				Method: http.MethodPut,
+				URL:    &url.URL{Scheme: "https", Host: "management.azure.com", Path: "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm"},
+			},
+		}
+	}
+
+	t.Run("details of the body", func(t *testing.T) {
+		body := `{"error": {"code": "InvalidTemplateDeployment", "target": "vm", "message": "The template deployment failed because of policy violation.", "details": [{"code": "RequestDisallowedByPolicy", "target": "vm", "message": "Resource 'vm' was disallowed by policy.", "additionalInfo": [{"type": "PolicyViolation", "info": {"policyDefinitionDisplayName": "Allowed locations"}}]}]}}`
+		resp := newResponse(http.StatusBadRequest, http.Header{"X-Ms-Error-Code": []string{"InvalidTemplateDeployment"}}, body)
+
+		armErr := parseArmErrorFromResponse(resp)
+		assert.Equal(t, ArmErrorCode("InvalidTemplateDeployment"), armErr.Code)
+		assert.Equal(t, "The template deployment failed because of policy violation.", armErr.Message)
+		assert.Equal(t, "vm", armErr.Target)
+		assert.Equal(t, http.StatusBadRequest, armErr.StatusCode)
+		assert.Len(t, armErr.Details, 1)
+		assert.Equal(t, ArmErrorCode("RequestDisallowedByPolicy"), armErr.Details[0].Code)
+		assert.Equal(t, "Resource 'vm' was disallowed by policy.", armErr.Details[0].Message)
+		assert.Len(t, armErr.Details[0].AdditionalInfo, 1)
+		assert.Equal(t, "PolicyViolation", armErr.Details[0].AdditionalInfo[0].Type)
+
+		// the body is left for downstream policies and callers
+		restored, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, body, string(restored))
+		assert.Len(t, armerrors.ParsePolicyViolations(armErr), 1)
+	})
+
+	t.Run("code of the body without header", func(t *testing.T) {
+		armErr := parseArmErrorFromResponse(newResponse(http.StatusNotFound, http.Header{}, `{"code": "ResourceNotFound", "message": "The resource was not found."}`))
+		assert.Equal(t, ArmErrorCode("ResourceNotFound"), armErr.Code)
+		assert.Equal(t, "The resource was not found.", armErr.Message)
+	})
+
+	t.Run("body that is not an error falls back to the response dump", func(t *testing.T) {
+		armErr := parseArmErrorFromResponse(newResponse(http.StatusBadGateway, http.Header{}, `<html>Bad Gateway</html>`))
+		assert.Equal(t, http.StatusBadGateway, armErr.StatusCode)
+		assert.Contains(t, armErr.Message, "RESPONSE 502")
+		assert.Nil(t, armErr.Details)
+	})
+}
+
 var _ ArmRequestMetricCollector = &testCollector{}
 
 type testCollector struct {
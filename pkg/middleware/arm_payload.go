@@ -0,0 +1,300 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// PayloadStats are the sizes of the bodies of a request and of its response, see ResponseInfo.Payload.
+// The bodies are counted as they are read, they are not buffered.
+type PayloadStats struct {
+	// RequestBytes is the size of the request body as sent.
+	RequestBytes int64
+	// ResponseWireBytes is the size of the response body as received, before decompression.
+	ResponseWireBytes int64
+	// ResponseBytes is the size of the response body once decompressed, it's ResponseWireBytes if the body
+	// was not compressed, or if it was compressed on the request of the caller, who decompresses it.
+	ResponseBytes int64
+	// ContentEncoding is the Content-Encoding of the response body, empty if it was not compressed.
+	ContentEncoding string
+
+	// Paged tells if the response body is a page of a list, {"value": [...], "nextLink": "..."}.
+	Paged bool
+	// ItemCount is the number of items of the page.
+	ItemCount int
+	// HasNextLink tells if the page has a nextLink, i.e. if it's not the last page of the list.
+	HasNextLink bool
+}
+
+// payloadRoundTripper counts the bytes of the request and response bodies, and the items of the pages of lists.
+// It decompresses the gzip responses in place of the transport, which must have DisableCompression set,
+// so that the bytes received on the wire are counted.
+type payloadRoundTripper struct {
+	next http.RoundTripper
+}
+
+func (t *payloadRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	outReq := req
+	// the conditions of http.Transport to ask for a compressed response
+	requestedGzip := req.Header.Get("Accept-Encoding") == "" && req.Header.Get("Range") == "" && req.Method != http.MethodHead
+	if requestedGzip {
+		outReq = req.Clone(req.Context())
+		outReq.Header.Set("Accept-Encoding", "gzip")
+	}
+
+	armCtx := armRequestContextFrom(req.Context())
+	var counter *payloadCounter
+	if armCtx != nil {
+		counter = &payloadCounter{}
+		counter.stats.RequestBytes = req.ContentLength
+		if req.ContentLength < 0 && req.Body != nil && req.Body != http.NoBody {
+			counter.stats.RequestBytes = 0
+			if outReq == req {
+				outReq = req.Clone(req.Context())
+			}
+			outReq.Body = &readCloser{Reader: &countingReader{Reader: req.Body, count: counter.countRequest}, Closer: req.Body}
+		}
+		armCtx.payload = counter
+	}
+
+	resp, err := t.next.RoundTrip(outReq)
+	if err != nil {
+		return resp, err
+	}
+	// the caller sees the request it sent, like with http.Transport
+	resp.Request = req
+
+	decompress := requestedGzip && strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") && resp.Body != http.NoBody
+	if counter != nil {
+		counter.stats.ContentEncoding = resp.Header.Get("Content-Encoding")
+		if strings.Contains(resp.Header.Get("Content-Type"), "json") {
+			counter.scanner = &pageScanner{}
+		}
+	}
+	if !decompress && counter == nil {
+		return resp, nil
+	}
+
+	var body io.Reader = resp.Body
+	if counter != nil {
+		body = &countingReader{Reader: body, count: counter.countWire}
+	}
+	if decompress {
+		body = &gzipReader{body: body}
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+	}
+	if counter != nil {
+		body = &countingReader{Reader: body, count: counter.countResponse}
+	}
+	resp.Body = &readCloser{Reader: body, Closer: resp.Body}
+	return resp, nil
+}
+
+// payloadCounter counts the bytes of a request. The body may be read while the stats are snapshotted,
+// e.g. when the pipeline skips the download of the body.
+type payloadCounter struct {
+	mu    sync.Mutex
+	stats PayloadStats
+	// scanner is nil if the response body is not JSON
+	scanner *pageScanner
+}
+
+func (c *payloadCounter) countRequest(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.RequestBytes += int64(len(p))
+}
+
+func (c *payloadCounter) countWire(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.ResponseWireBytes += int64(len(p))
+}
+
+func (c *payloadCounter) countResponse(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.ResponseBytes += int64(len(p))
+	if c.scanner != nil {
+		c.scanner.scan(p)
+	}
+}
+
+// snapshot returns the stats of the bytes read so far.
+func (c *payloadCounter) snapshot() *PayloadStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	if c.scanner != nil && c.scanner.paged {
+		stats.Paged = true
+		stats.ItemCount = c.scanner.items
+		stats.HasNextLink = c.scanner.hasNextLink
+	}
+	return &stats
+}
+
+type countingReader struct {
+	io.Reader
+	count func(p []byte)
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.count(p[:n])
+	}
+	return n, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// gzipReader creates the gzip reader on the first read, so that reading the gzip header doesn't block the round trip.
+type gzipReader struct {
+	body io.Reader
+	zr   *gzip.Reader
+	err  error
+}
+
+func (r *gzipReader) Read(p []byte) (int, error) {
+	if r.zr == nil && r.err == nil {
+		r.zr, r.err = gzip.NewReader(r.body)
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.zr.Read(p)
+}
+
+// maxScannedKeyLen is the length of the longest key the pageScanner looks for.
+const maxScannedKeyLen = len("nextLink")
+
+// pageScanner finds the number of items and the nextLink of a page of a list, {"value": [...], "nextLink": "..."},
+// as the body is read. Only the top-level keys are looked at, the items are not parsed.
+type pageScanner struct {
+	started     bool
+	notObject   bool
+	depth       int
+	inString    bool
+	escaped     bool
+	expectKey   bool
+	capturing   bool
+	key         []byte
+	lastKey     string
+	inNextLink  bool
+	inValue     bool
+	expectItem  bool
+	paged       bool
+	items       int
+	hasNextLink bool
+}
+
+func (s *pageScanner) scan(p []byte) {
+	for _, c := range p {
+		if s.notObject {
+			return
+		}
+		if s.inString {
+			switch {
+			case s.escaped:
+				s.escaped = false
+			case c == '\\':
+				s.escaped = true
+			case c == '"':
+				s.inString = false
+				if s.capturing {
+					s.lastKey = string(s.key)
+					s.capturing = false
+				}
+				continue
+			}
+			if s.capturing {
+				// longer keys are not looked for, capturing one more byte tells them apart
+				if len(s.key) <= maxScannedKeyLen {
+					s.key = append(s.key, c)
+				}
+			}
+			if s.inNextLink {
+				s.hasNextLink = true
+			}
+			continue
+		}
+		switch c {
+		case ' ', '\t', '\n', '\r':
+			continue
+		}
+		if !s.started {
+			s.started = true
+			if c != '{' {
+				s.notObject = true
+				return
+			}
+		}
+		if s.inValue && s.depth == 2 && s.expectItem && c != ',' && c != ']' {
+			s.items++
+			s.expectItem = false
+		}
+
+		switch c {
+		case '"':
+			s.inString = true
+			s.inNextLink = false
+			if s.depth == 1 {
+				if s.expectKey {
+					s.capturing = true
+					s.key = s.key[:0]
+				} else {
+					s.inNextLink = s.lastKey == "nextLink"
+				}
+			}
+		case ':':
+			if s.depth == 1 {
+				s.expectKey = false
+			}
+		case ',':
+			if s.depth == 1 {
+				s.expectKey = true
+			}
+			if s.inValue && s.depth == 2 {
+				s.expectItem = true
+			}
+		case '{', '[':
+			if s.depth == 1 && c == '[' && s.lastKey == "value" {
+				s.inValue = true
+				s.paged = true
+				s.expectItem = true
+			}
+			s.depth++
+			if s.depth == 1 {
+				s.expectKey = true
+			}
+		case '}', ']':
+			s.depth--
+			if s.depth == 1 {
+				s.inValue = false
+			}
+		}
+	}
+}
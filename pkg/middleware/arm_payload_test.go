@@ -0,0 +1,171 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPageScanner(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		paged       bool
+		items       int
+		hasNextLink bool
+	}{
+		{
+			name:        "page with a next link",
+			body:        `{"value": [{"id": "a"}, {"id": "b"}, {"id": "c"}], "nextLink": "https://management.azure.com/next"}`,
+			paged:       true,
+			items:       3,
+			hasNextLink: true,
+		},
+		{
+			name:  "last page",
+			body:  `{"nextLink": null, "value": [{"id": "a"}]}`,
+			paged: true,
+			items: 1,
+		},
+		{
+			name:  "empty next link",
+			body:  `{"value": [1, 2], "nextLink": ""}`,
+			paged: true,
+			items: 2,
+		},
+		{
+			name:  "empty page",
+			body:  " {\n\t\"value\" : [ ]\n}",
+			paged: true,
+		},
+		{
+			name:  "nested values and next links are ignored",
+			body:  `{"value": [{"properties": {"value": [1, 2, 3], "nextLink": "x"}}, [4, 5]]}`,
+			paged: true,
+			items: 2,
+		},
+		{
+			name:  "strings with escapes and brackets",
+			body:  `{"value": ["a,\"]b", "{,}", "\\"], "description": "\"nextLink\": \"x\""}`,
+			paged: true,
+			items: 3,
+		},
+		{
+			name: "resource",
+			body: `{"id": "/subscriptions/sub/resourceGroups/rg", "properties": {"value": [1]}}`,
+		},
+		{
+			name: "longer keys",
+			body: `{"values": [1], "nextLinks": "x"}`,
+		},
+		{
+			name: "array",
+			body: `[{"value": [1]}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the body is read in chunks of any size
+			for _, chunkSize := range []int{1, 7, len(tt.body)} {
+				s := &pageScanner{}
+				for chunk := range slices.Chunk([]byte(tt.body), chunkSize) {
+					s.scan(chunk)
+				}
+				assert.Equal(t, tt.paged, s.paged, "chunk size %d", chunkSize)
+				assert.Equal(t, tt.items, s.items, "chunk size %d", chunkSize)
+				assert.Equal(t, tt.hasNextLink, s.hasNextLink, "chunk size %d", chunkSize)
+			}
+		})
+	}
+}
+
+func TestPayloadStats(t *testing.T) {
+	page := `{"value": [{"id": "a"}, {"id": "b"}], "nextLink": "https://management.azure.com/next"}`
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	_, err := zw.Write([]byte(page))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			_, _ = w.Write(compressed.Bytes())
+			return
+		}
+		_, _ = w.Write([]byte(page))
+	}))
+	defer ts.Close()
+
+	send := func(t *testing.T, method string, header http.Header, body string) (*PayloadStats, string) {
+		var payload *PayloadStats
+		collector := &testCollector{
+			requestStarted: func(iReq *RequestInfo) {},
+			requestCompleted: func(iReq *RequestInfo, iResp *ResponseInfo) {
+				payload = iResp.Payload
+			},
+		}
+		client, err := NewHTTPClient(nil)
+		require.NoError(t, err)
+		pl := runtime.NewPipeline("test", "v1", runtime.PipelineOptions{}, &policy.ClientOptions{
+			Transport:        client,
+			Retry:            policy.RetryOptions{MaxRetries: -1},
+			PerRetryPolicies: []policy.Policy{&ArmRequestMetricPolicy{Collector: collector}},
+		})
+		req, err := runtime.NewRequest(context.Background(), method, ts.URL)
+		require.NoError(t, err)
+		for key := range header {
+			req.Raw().Header.Set(key, header.Get(key))
+		}
+		if body != "" {
+			require.NoError(t, req.SetBody(streaming.NopCloser(strings.NewReader(body)), "application/json"))
+		}
+		resp, err := pl.Do(req)
+		require.NoError(t, err)
+		respBody, err := runtime.Payload(resp)
+		require.NoError(t, err)
+		require.NotNil(t, payload)
+		return payload, string(respBody)
+	}
+
+	t.Run("compressed response", func(t *testing.T) {
+		payload, body := send(t, http.MethodGet, nil, "")
+		assert.Equal(t, page, body)
+		assert.Equal(t, &PayloadStats{
+			ResponseWireBytes: int64(compressed.Len()),
+			ResponseBytes:     int64(len(page)),
+			ContentEncoding:   "gzip",
+			Paged:             true,
+			ItemCount:         2,
+			HasNextLink:       true,
+		}, payload)
+	})
+
+	t.Run("uncompressed response", func(t *testing.T) {
+		payload, body := send(t, http.MethodGet, http.Header{"Accept-Encoding": {"identity"}}, "")
+		assert.Equal(t, page, body)
+		assert.Equal(t, int64(len(page)), payload.ResponseWireBytes)
+		assert.Equal(t, int64(len(page)), payload.ResponseBytes)
+		assert.Empty(t, payload.ContentEncoding)
+		assert.Equal(t, 2, payload.ItemCount)
+	})
+
+	t.Run("request body", func(t *testing.T) {
+		payload, _ := send(t, http.MethodPut, nil, `{"location": "westus"}`)
+		assert.Equal(t, int64(len(`{"location": "westus"}`)), payload.RequestBytes)
+	})
+}
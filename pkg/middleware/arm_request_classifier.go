@@ -0,0 +1,191 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// ArmScope is the scope an ARM request targets.
+type ArmScope string
+
+const (
+	ArmScopeTenant            ArmScope = "Tenant"
+	ArmScopeSubscription      ArmScope = "Subscription"
+	ArmScopeResourceGroup     ArmScope = "ResourceGroup"
+	ArmScopeResource          ArmScope = "Resource"
+	ArmScopeExtensionResource ArmScope = "ExtensionResource"
+)
+
+// ArmOperationKind is the kind of operation of an ARM request.
+type ArmOperationKind string
+
+const (
+	ArmOperationGet            ArmOperationKind = "Get"
+	ArmOperationList           ArmOperationKind = "List"
+	ArmOperationCreateOrUpdate ArmOperationKind = "CreateOrUpdate"
+	ArmOperationUpdate         ArmOperationKind = "Update"
+	ArmOperationDelete         ArmOperationKind = "Delete"
+	// ArmOperationAction is used for POST requests such as /start or /listKeys, see ArmRequestClassification.Action.
+	ArmOperationAction ArmOperationKind = "Action"
+	// ArmOperationAsyncStatus is used for the polls of the status of long-running operations.
+	ArmOperationAsyncStatus ArmOperationKind = "AsyncStatus"
+	ArmOperationUnknown     ArmOperationKind = "Unknown"
+)
+
+// resourcesProvider is the provider of the resource types ARM exposes without a provider segment, e.g. resourceGroups.
+const resourcesProvider = "Microsoft.Resources"
+
+// asyncStatusResourceTypes are the resource types resource providers expose the status of long-running operations as.
+var asyncStatusResourceTypes = []string{"operations", "operationStatuses", "operationResults", "asyncOperations"}
+
+// ArmRequestClassification describes an ARM request, including requests whose URL is not a resource ID.
+type ArmRequestClassification struct {
+	Scope             ArmScope
+	SubscriptionID    string
+	ResourceGroupName string
+	// Provider is the resource provider namespace, e.g. Microsoft.Compute.
+	// It's the provider of the extension for extension resources.
+	Provider string
+	// ResourceType is the full resource type, e.g. Microsoft.Compute/virtualMachines/extensions.
+	// It's the type of the collection for lists.
+	ResourceType string
+	// ResourceName is the name of the last resource of the URL, if any.
+	ResourceName  string
+	OperationKind ArmOperationKind
+	// Action is the name of the action of POST requests, e.g. start.
+	Action     string
+	APIVersion string
+}
+
+// ClassifyArmRequest classifies an ARM request from its method and URL. It never fails: parts of the URL
+// that are not understood are left empty.
+// A GET of a segment after a named resource, e.g. /virtualMachines/vm/extensions or /virtualMachines/vm/instanceView,
+// is either a list of child resources or a singleton sub-resource: it keeps the type and name of the named resource,
+// and its OperationKind is ArmOperationUnknown.
+func ClassifyArmRequest(req *http.Request) *ArmRequestClassification {
+	c := &ArmRequestClassification{Scope: ArmScopeTenant, OperationKind: ArmOperationUnknown}
+	if req == nil || req.URL == nil {
+		return c
+	}
+	c.APIVersion = req.URL.Query().Get("api-version")
+
+	segments := strings.FieldsFunc(req.URL.Path, func(r rune) bool { return r == '/' })
+	var types []string
+	trailing := ""
+	for i := 0; i < len(segments); {
+		segment := segments[i]
+		hasNext := i+1 < len(segments)
+		switch {
+		case strings.EqualFold(segment, "subscriptions") && hasNext && c.Provider == "" && c.SubscriptionID == "":
+			c.SubscriptionID = segments[i+1]
+			c.Scope = ArmScopeSubscription
+			i += 2
+		case strings.EqualFold(segment, "resourceGroups") && hasNext && c.Provider == "" && c.SubscriptionID != "":
+			c.ResourceGroupName = segments[i+1]
+			c.Scope = ArmScopeResourceGroup
+			i += 2
+		case strings.EqualFold(segment, "providers") && hasNext:
+			if c.ResourceName != "" {
+				c.Scope = ArmScopeExtensionResource
+			}
+			c.Provider = segments[i+1]
+			types = nil
+			c.ResourceName = ""
+			i += 2
+		case hasNext:
+			types = append(types, segment)
+			c.ResourceName = segments[i+1]
+			if c.Provider != "" && c.Scope != ArmScopeExtensionResource {
+				c.Scope = ArmScopeResource
+			}
+			i += 2
+		default:
+			trailing = segment
+			i++
+		}
+	}
+
+	isList, ambiguous := false, false
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		switch {
+		case trailing != "" && c.ResourceName != "":
+			// a collection of child resources, e.g. /virtualMachines/vm/extensions, or a singleton
+			// sub-resource, e.g. /virtualMachines/vm/instanceView: the URL doesn't tell them apart
+			ambiguous = true
+		case trailing != "":
+			// a collection, e.g. /virtualMachines or /resourceGroups
+			types = append(types, trailing)
+			c.ResourceName = ""
+			isList = true
+		case c.Provider != "" && len(types) == 0:
+			// a resource provider, e.g. /subscriptions/{id}/providers/Microsoft.Compute, as with arm.ResourceID
+			c.ResourceName, c.Provider = c.Provider, ""
+			types = []string{"providers"}
+		}
+	case http.MethodPost:
+		c.Action = trailing
+	}
+
+	c.ResourceType = resourceType(c, types)
+	c.OperationKind = operationKind(req.Method, types, isList)
+	if ambiguous {
+		c.OperationKind = ArmOperationUnknown
+	}
+	return c
+}
+
+// resourceType returns the full resource type of the classified URL. Subscriptions and resource groups are
+// Microsoft.Resources types, as with arm.ResourceID.
+func resourceType(c *ArmRequestClassification, types []string) string {
+	switch {
+	case c.Provider != "":
+		return strings.Join(append([]string{c.Provider}, types...), "/")
+	case len(types) > 0:
+		return strings.Join(append([]string{resourcesProvider}, types...), "/")
+	case c.Scope == ArmScopeResourceGroup:
+		return resourcesProvider + "/resourceGroups"
+	case c.Scope == ArmScopeSubscription:
+		return resourcesProvider + "/subscriptions"
+	}
+	return ""
+}
+
+func operationKind(method string, types []string, isList bool) ArmOperationKind {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		if len(types) > 0 && slices.ContainsFunc(asyncStatusResourceTypes, func(t string) bool {
+			return strings.EqualFold(t, types[len(types)-1])
+		}) && !isList {
+			return ArmOperationAsyncStatus
+		}
+		if isList {
+			return ArmOperationList
+		}
+		return ArmOperationGet
+	case http.MethodPut:
+		return ArmOperationCreateOrUpdate
+	case http.MethodPatch:
+		return ArmOperationUpdate
+	case http.MethodDelete:
+		return ArmOperationDelete
+	case http.MethodPost:
+		return ArmOperationAction
+	}
+	return ArmOperationUnknown
+}
@@ -0,0 +1,241 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyArmRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		expected ArmRequestClassification
+	}{
+		{
+			name:   "list subscriptions",
+			method: http.MethodGet,
+			path:   "/subscriptions?api-version=2022-12-01",
+			expected: ArmRequestClassification{
+				Scope: ArmScopeTenant, ResourceType: "Microsoft.Resources/subscriptions",
+				OperationKind: ArmOperationList, APIVersion: "2022-12-01",
+			},
+		},
+		{
+			name:   "get subscription",
+			method: http.MethodGet,
+			path:   "/subscriptions/sub?api-version=2022-12-01",
+			expected: ArmRequestClassification{
+				Scope: ArmScopeSubscription, SubscriptionID: "sub", ResourceType: "Microsoft.Resources/subscriptions",
+				OperationKind: ArmOperationGet, APIVersion: "2022-12-01",
+			},
+		},
+		{
+			name:   "list resource groups",
+			method: http.MethodGet,
+			path:   "/subscriptions/sub/resourcegroups",
+			expected: ArmRequestClassification{
+				Scope: ArmScopeSubscription, SubscriptionID: "sub", ResourceType: "Microsoft.Resources/resourcegroups",
+				OperationKind: ArmOperationList,
+			},
+		},
+		{
+			name:   "create resource group",
+			method: http.MethodPut,
+			path:   "/subscriptions/sub/resourceGroups/rg",
+			expected: ArmRequestClassification{
+				Scope: ArmScopeResourceGroup, SubscriptionID: "sub", ResourceGroupName: "rg",
+				ResourceType: "Microsoft.Resources/resourceGroups", OperationKind: ArmOperationCreateOrUpdate,
+			},
+		},
+		{
+			name:   "list resources of resource group",
+			method: http.MethodGet,
+			path:   "/subscriptions/sub/resourceGroups/rg/resources",
+			expected: ArmRequestClassification{
+				Scope: ArmScopeResourceGroup, SubscriptionID: "sub", ResourceGroupName: "rg",
+				ResourceType: "Microsoft.Resources/resources", OperationKind: ArmOperationList,
+			},
+		},
+		{
+			name:   "list resource providers",
+			method: http.MethodGet,
+			path:   "/subscriptions/sub/providers",
+			expected: ArmRequestClassification{
+				Scope: ArmScopeSubscription, SubscriptionID: "sub", ResourceType: "Microsoft.Resources/providers",
+				OperationKind: ArmOperationList,
+			},
+		},
+		{
+			name:   "get resource provider",
+			method: http.MethodGet,
+			path:   "/subscriptions/sub/providers/Microsoft.Compute",
+			expected: ArmRequestClassification{
+				Scope: ArmScopeSubscription, SubscriptionID: "sub", ResourceType: "Microsoft.Resources/providers",
+				ResourceName: "Microsoft.Compute", OperationKind: ArmOperationGet,
+			},
+		},
+		{
+			name:   "get resource provider of tenant",
+			method: http.MethodGet,
+			path:   "/providers/Microsoft.Compute",
+			expected: ArmRequestClassification{
+				Scope: ArmScopeTenant, ResourceType: "Microsoft.Resources/providers",
+				ResourceName: "Microsoft.Compute", OperationKind: ArmOperationGet,
+			},
+		},
+		{
+			name:   "register resource provider",
+			method: http.MethodPost,
+			path:   "/subscriptions/sub/providers/Microsoft.Compute/register",
+			expected: ArmRequestClassification{
+				Scope: ArmScopeSubscription, SubscriptionID: "sub", Provider: "Microsoft.Compute",
+				ResourceType: "Microsoft.Compute", OperationKind: ArmOperationAction, Action: "register",
+			},
+		},
+		{
+			name:   "list resources of subscription",
+			method: http.MethodGet,
+			path:   "/subscriptions/sub/providers/Microsoft.Compute/virtualMachines",
+			expected: ArmRequestClassification{
+				Scope: ArmScopeSubscription, SubscriptionID: "sub", Provider: "Microsoft.Compute",
+				ResourceType: "Microsoft.Compute/virtualMachines", OperationKind: ArmOperationList,
+			},
+		},
+		{
+			name:   "get resource",
+			method: http.MethodGet,
+			path:   "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm",
+			expected: ArmRequestClassification{
+				Scope: ArmScopeResource, SubscriptionID: "sub", ResourceGroupName: "rg", Provider: "Microsoft.Compute",
+				ResourceType: "Microsoft.Compute/virtualMachines", ResourceName: "vm", OperationKind: ArmOperationGet,
+			},
+		},
+		{
+			name:   "delete child resource",
+			method: http.MethodDelete,
+			path:   "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/virtualNetworks/vnet/subnets/subnet",
+			expected: ArmRequestClassification{
+				Scope: ArmScopeResource, SubscriptionID: "sub", ResourceGroupName: "rg", Provider: "Microsoft.Network",
+				ResourceType: "Microsoft.Network/virtualNetworks/subnets", ResourceName: "subnet", OperationKind: ArmOperationDelete,
+			},
+		},
+		{
+			name:   "list child resources",
+			method: http.MethodGet,
+			path:   "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm/extensions",
+			expected: ArmRequestClassification{
+				Scope: ArmScopeResource, SubscriptionID: "sub", ResourceGroupName: "rg", Provider: "Microsoft.Compute",
+				ResourceType: "Microsoft.Compute/virtualMachines", ResourceName: "vm", OperationKind: ArmOperationUnknown,
+			},
+		},
+		{
+			name:   "get singleton sub-resource",
+			method: http.MethodGet,
+			path:   "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm/instanceView",
+			expected: ArmRequestClassification{
+				Scope: ArmScopeResource, SubscriptionID: "sub", ResourceGroupName: "rg", Provider: "Microsoft.Compute",
+				ResourceType: "Microsoft.Compute/virtualMachines", ResourceName: "vm", OperationKind: ArmOperationUnknown,
+			},
+		},
+		{
+			name:   "list child resources of a location",
+			method: http.MethodGet,
+			path:   "/subscriptions/sub/providers/Microsoft.Compute/locations/eastus/vmSizes",
+			expected: ArmRequestClassification{
+				Scope: ArmScopeResource, SubscriptionID: "sub", Provider: "Microsoft.Compute",
+				ResourceType: "Microsoft.Compute/locations", ResourceName: "eastus", OperationKind: ArmOperationUnknown,
+			},
+		},
+		{
+			name:   "resource action",
+			method: http.MethodPost,
+			path:   "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm/start",
+			expected: ArmRequestClassification{
+				Scope: ArmScopeResource, SubscriptionID: "sub", ResourceGroupName: "rg", Provider: "Microsoft.Compute",
+				ResourceType: "Microsoft.Compute/virtualMachines", ResourceName: "vm",
+				OperationKind: ArmOperationAction, Action: "start",
+			},
+		},
+		{
+			name:   "extension resource",
+			method: http.MethodPut,
+			path:   "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm/providers/Microsoft.Authorization/roleAssignments/ra",
+			expected: ArmRequestClassification{
+				Scope: ArmScopeExtensionResource, SubscriptionID: "sub", ResourceGroupName: "rg", Provider: "Microsoft.Authorization",
+				ResourceType: "Microsoft.Authorization/roleAssignments", ResourceName: "ra", OperationKind: ArmOperationCreateOrUpdate,
+			},
+		},
+		{
+			name:   "async operation status",
+			method: http.MethodGet,
+			path:   "/subscriptions/sub/providers/Microsoft.ContainerService/locations/eastus/operations/op?api-version=2016-03-30",
+			expected: ArmRequestClassification{
+				Scope: ArmScopeResource, SubscriptionID: "sub", Provider: "Microsoft.ContainerService",
+				ResourceType: "Microsoft.ContainerService/locations/operations", ResourceName: "op",
+				OperationKind: ArmOperationAsyncStatus, APIVersion: "2016-03-30",
+			},
+		},
+		{
+			name:   "async operation result",
+			method: http.MethodGet,
+			path:   "/subscriptions/sub/providers/Microsoft.Network/locations/eastus/operationResults/op",
+			expected: ArmRequestClassification{
+				Scope: ArmScopeResource, SubscriptionID: "sub", Provider: "Microsoft.Network",
+				ResourceType: "Microsoft.Network/locations/operationResults", ResourceName: "op",
+				OperationKind: ArmOperationAsyncStatus,
+			},
+		},
+		{
+			name:   "list provider operations",
+			method: http.MethodGet,
+			path:   "/providers/Microsoft.Compute/operations",
+			expected: ArmRequestClassification{
+				Scope: ArmScopeTenant, Provider: "Microsoft.Compute",
+				ResourceType: "Microsoft.Compute/operations", OperationKind: ArmOperationList,
+			},
+		},
+		{
+			name:   "tenant level resource",
+			method: http.MethodGet,
+			path:   "/providers/Microsoft.Management/managementGroups/mg",
+			expected: ArmRequestClassification{
+				Scope: ArmScopeResource, Provider: "Microsoft.Management",
+				ResourceType: "Microsoft.Management/managementGroups", ResourceName: "mg", OperationKind: ArmOperationGet,
+			},
+		},
+		{
+			name:   "tenant level action",
+			method: http.MethodPost,
+			path:   "/providers/Microsoft.Resources/calculateTemplateHash",
+			expected: ArmRequestClassification{
+				Scope: ArmScopeTenant, Provider: "Microsoft.Resources",
+				ResourceType: "Microsoft.Resources", OperationKind: ArmOperationAction, Action: "calculateTemplateHash",
+			},
+		},
+		{
+			name:   "root",
+			method: http.MethodGet,
+			path:   "/",
+			expected: ArmRequestClassification{
+				Scope: ArmScopeTenant, OperationKind: ArmOperationGet,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "https://management.azure.com"+tc.path, nil)
+			assert.Equal(t, &tc.expected, ClassifyArmRequest(req))
+		})
+	}
+
+	t.Run("nil request", func(t *testing.T) {
+		c := ClassifyArmRequest(nil)
+		assert.Equal(t, ArmScopeTenant, c.Scope)
+		assert.Equal(t, ArmOperationUnknown, c.OperationKind)
+	})
+}
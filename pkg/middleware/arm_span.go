@@ -0,0 +1,257 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	armerrors "github.com/Azure/azure-sdk-for-go-extensions/pkg/errors"
+)
+
+// attributes of the ARM semantics added to the spans of the otelhttp transport.
+const (
+	attrSubscriptionID       = attribute.Key("azure.subscription.id")
+	attrResourceGroup        = attribute.Key("azure.resource_group.name")
+	attrResourceProvider     = attribute.Key("azure.resource_provider.namespace")
+	attrResourceType         = attribute.Key("azure.resource.type")
+	attrOperationKind        = attribute.Key("azure.operation.kind")
+	attrOperationAction      = attribute.Key("azure.operation.action")
+	attrAPIVersion           = attribute.Key("azure.api_version")
+	attrRequestID            = attribute.Key("azure.request_id")
+	attrClientRequestID      = attribute.Key("azure.client_request_id")
+	attrCorrelationRequestID = attribute.Key("azure.correlation_request_id")
+	attrArmErrorCode         = attribute.Key("azure.arm.error_code")
+	// attrResendCount is the OpenTelemetry semantic convention for the retries of a request.
+	attrResendCount = attribute.Key("http.request.resend_count")
+
+	attrDNSLatency  = attribute.Key("http.connection.dns_latency")
+	attrConnLatency = attribute.Key("http.connection.connect_latency")
+	attrTLSLatency  = attribute.Key("http.connection.tls_latency")
+	attrGetConn     = attribute.Key("http.connection.get_latency")
+	attrProtocol    = attribute.Key("http.connection.protocol")
+	attrReused      = attribute.Key("http.connection.reused")
+	attrWasIdle     = attribute.Key("http.connection.was_idle")
+	attrError       = attribute.Key("error")
+)
+
+const (
+	// headerKeyArmRequestID is the ID ARM gives to the request, the one support asks for.
+	headerKeyArmRequestID = "X-Ms-Request-Id"
+	// headerKeyErrorCode is the error code of an error response, also found in its body.
+	headerKeyErrorCode = "X-Ms-Error-Code"
+)
+
+// armRequestContext is what ArmRequestMetricPolicy knows about the request, passed down to the transport in the context.
+type armRequestContext struct {
+	requestInfo  *RequestInfo
+	connTracking *HttpConnTracking
+	callerCtx    context.Context
+	// hostConnStats is set by the transport if its connections are tracked by a ConnPoolMonitor
+	hostConnStats *HostConnStats
+	// dnsCacheResult holds the DNSCacheResult of the dial of the request, if any. The dial may end after the request
+	// got another connection, hence the atomic.
+	dnsCacheResult atomic.Value
+	// payload is set by the transport if it counts the bytes of the bodies
+	payload *payloadCounter
+	// response is the last response of the request and responseError its ArmError. The span ends once the body is
+	// downloaded, before the policy sees the response, so the error is parsed by the transport if it traces the
+	// request, and reused by the policy and the retry decisions.
+	response      *http.Response
+	responseError *ArmError
+}
+
+// armError returns the ArmError of resp, it's parsed once per response.
+func (c *armRequestContext) armError(resp *http.Response) *ArmError {
+	if c.response == nil || c.response != resp {
+		c.response, c.responseError = resp, parseArmErrorFromResponse(resp)
+	}
+	return c.responseError
+}
+
+type armRequestContextKey struct{}
+
+func withArmRequestContext(ctx context.Context, armCtx *armRequestContext) context.Context {
+	return context.WithValue(ctx, armRequestContextKey{}, armCtx)
+}
+
+// armRequestContextFrom returns the armRequestContext of ctx, or nil if the request did not go through ArmRequestMetricPolicy.
+func armRequestContextFrom(ctx context.Context) *armRequestContext {
+	armCtx, _ := ctx.Value(armRequestContextKey{}).(*armRequestContext)
+	return armCtx
+}
+
+// armSpanRoundTripper enriches the span of the request with ARM semantics.
+type armSpanRoundTripper struct {
+	next http.RoundTripper
+}
+
+// NewArmSpanRoundTripper returns a round tripper that adds the ARM semantics of the request (subscription, resource group,
+// provider, resource type, operation, request IDs, retry attempt and ArmErrorCode) and events for the phases of the
+// connection to the span in the context of the request.
+// It must be wrapped by the otelhttp transport, which starts the span, as DefaultHTTPClient does.
+// The retry attempt and connection latencies are only known for requests that went through ArmRequestMetricPolicy.
+func NewArmSpanRoundTripper(next http.RoundTripper) http.RoundTripper {
+	return &armSpanRoundTripper{next: next}
+}
+
+func (t *armSpanRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	span := trace.SpanFromContext(req.Context())
+	if !span.IsRecording() {
+		return t.next.RoundTrip(req)
+	}
+
+	armCtx := armRequestContextFrom(req.Context())
+	var callerCtx context.Context
+	if armCtx != nil {
+		span.SetAttributes(classificationAttributes(armCtx.requestInfo.Classification)...)
+		span.SetAttributes(attrResendCount.Int(armCtx.requestInfo.Attempt - 1))
+		callerCtx = armCtx.callerCtx
+	} else {
+		span.SetAttributes(classificationAttributes(ClassifyArmRequest(req))...)
+	}
+	setHeaderAttribute(span, attrClientRequestID, req.Header, headerKeyRequestID)
+	setHeaderAttribute(span, attrCorrelationRequestID, req.Header, headerKeyCorrelationID)
+
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), connectionEvents(span)))
+	resp, err := t.next.RoundTrip(req)
+	if armCtx != nil {
+		span.SetAttributes(connTrackingAttributes(armCtx.connTracking)...)
+	}
+	if err != nil {
+		span.SetAttributes(attrArmErrorCode.String(string(parseTransportError(err, callerCtx).Code)))
+		return resp, err
+	}
+
+	setHeaderAttribute(span, attrRequestID, resp.Header, headerKeyArmRequestID)
+	armErr, parsed := parseLimitedArmError(resp)
+	if parsed && armCtx != nil {
+		// ArmRequestMetricPolicy reuses it
+		armCtx.response, armCtx.responseError = resp, armErr
+	}
+	if armErr != nil {
+		span.SetAttributes(attrArmErrorCode.String(string(armErr.Code)))
+	} else if !parsed {
+		setHeaderAttribute(span, attrArmErrorCode, resp.Header, headerKeyErrorCode)
+	}
+	return resp, nil
+}
+
+// parseLimitedArmError parses the error of resp if its body is at most armerrors.DefaultMaxErrorBodySize, as
+// pkg/errors does, so that tracing doesn't change how much of a response is read. The body is put back in front of
+// the rest of the response, which stays streamed. parsed is false if the body is larger.
+func parseLimitedArmError(resp *http.Response) (armErr *ArmError, parsed bool) {
+	if resp.StatusCode < http.StatusBadRequest || resp.Body == nil || resp.Body == http.NoBody {
+		return parseArmErrorFromResponse(resp), true
+	}
+	prefix, readErr := readPrefix(resp.Body, armerrors.DefaultMaxErrorBodySize)
+	resp.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(prefix), errReader{readErr}, resp.Body), Closer: resp.Body}
+	if readErr != nil || len(prefix) > armerrors.DefaultMaxErrorBodySize {
+		return nil, false
+	}
+	return parseArmErrorFromResponse(resp), true
+}
+
+func setHeaderAttribute(span trace.Span, key attribute.Key, header http.Header, name string) {
+	if value := header.Get(name); value != "" {
+		span.SetAttributes(key.String(value))
+	}
+}
+
+func classificationAttributes(c *ArmRequestClassification) []attribute.KeyValue {
+	if c == nil {
+		return nil
+	}
+	attrs := []attribute.KeyValue{attrOperationKind.String(string(c.OperationKind))}
+	for key, value := range map[attribute.Key]string{
+		attrSubscriptionID:   c.SubscriptionID,
+		attrResourceGroup:    c.ResourceGroupName,
+		attrResourceProvider: c.Provider,
+		attrResourceType:     c.ResourceType,
+		attrOperationAction:  c.Action,
+		attrAPIVersion:       c.APIVersion,
+	} {
+		if value != "" {
+			attrs = append(attrs, key.String(value))
+		}
+	}
+	return attrs
+}
+
+func connTrackingAttributes(connTracking *HttpConnTracking) []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	for key, value := range map[attribute.Key]string{
+		attrGetConn:     connTracking.GetTotalLatency(),
+		attrDNSLatency:  connTracking.GetDnsLatency(),
+		attrConnLatency: connTracking.GetConnLatency(),
+		attrTLSLatency:  connTracking.GetTlsLatency(),
+		attrProtocol:    connTracking.GetProtocol(),
+	} {
+		if value != "" {
+			attrs = append(attrs, key.String(value))
+		}
+	}
+	return attrs
+}
+
+// connectionEvents records the phases of the connection of the request as events of the span.
+func connectionEvents(span trace.Span) *httptrace.ClientTrace {
+	withError := func(attrs []attribute.KeyValue, err error) trace.EventOption {
+		if err != nil {
+			attrs = append(attrs, attrError.String(err.Error()))
+		}
+		return trace.WithAttributes(attrs...)
+	}
+	return &httptrace.ClientTrace{
+		GetConn: func(_ string) {
+			span.AddEvent("http.get_conn")
+		},
+		GotConn: func(connInfo httptrace.GotConnInfo) {
+			span.AddEvent("http.got_conn", trace.WithAttributes(
+				attrReused.Bool(connInfo.Reused),
+				attrWasIdle.Bool(connInfo.WasIdle),
+			))
+		},
+		DNSStart: func(_ httptrace.DNSStartInfo) {
+			span.AddEvent("http.dns.start")
+		},
+		DNSDone: func(dnsInfo httptrace.DNSDoneInfo) {
+			span.AddEvent("http.dns.done", withError(nil, dnsInfo.Err))
+		},
+		ConnectStart: func(_, _ string) {
+			span.AddEvent("http.connect.start")
+		},
+		ConnectDone: func(_, _ string, err error) {
+			span.AddEvent("http.connect.done", withError(nil, err))
+		},
+		TLSHandshakeStart: func() {
+			span.AddEvent("http.tls.start")
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			span.AddEvent("http.tls.done", withError([]attribute.KeyValue{attrProtocol.String(state.NegotiatedProtocol)}, err))
+		},
+		GotFirstResponseByte: func() {
+			span.AddEvent("http.first_response_byte")
+		},
+	}
+}
@@ -0,0 +1,235 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	armerrors "github.com/Azure/azure-sdk-for-go-extensions/pkg/errors"
+)
+
+func TestArmSpanRoundTripper(t *testing.T) {
+	const resourcePath = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm?api-version=2024-07-01"
+
+	newPipeline := func(t *testing.T, ts *httptest.Server, exporter *tracetest.InMemoryExporter, perRetryPolicies ...policy.Policy) runtime.Pipeline {
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+		t.Cleanup(func() { _ = tp.Shutdown(context.Background()) })
+		return runtime.NewPipeline("test", "v1", runtime.PipelineOptions{}, &policy.ClientOptions{
+			Transport: &http.Client{
+				Transport: otelhttp.NewTransport(NewArmSpanRoundTripper(ts.Client().Transport), otelhttp.WithTracerProvider(tp)),
+			},
+			Retry:            policy.RetryOptions{MaxRetries: 1, RetryDelay: time.Millisecond},
+			PerCallPolicies:  []policy.Policy{&CallerContextPolicy{}},
+			PerRetryPolicies: perRetryPolicies,
+		})
+	}
+
+	send := func(t *testing.T, pl runtime.Pipeline, endpoint string) (*http.Response, error) {
+		req, err := runtime.NewRequest(context.Background(), http.MethodGet, endpoint)
+		require.NoError(t, err)
+		req.Raw().Header.Set(headerKeyCorrelationID, "correlation-id")
+		resp, err := pl.Do(req)
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	attributes := func(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+		attrs := map[attribute.Key]attribute.Value{}
+		for _, attr := range span.Attributes {
+			attrs[attr.Key] = attr.Value
+		}
+		return attrs
+	}
+
+	events := func(span tracetest.SpanStub) []string {
+		var names []string
+		for _, event := range span.Events {
+			names = append(names, event.Name)
+		}
+		return names
+	}
+
+	t.Run("spans of retried requests have ARM attributes", func(t *testing.T) {
+		var calls atomic.Int32
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) == 1 {
+				w.Header().Set("X-Ms-Request-Id", "request-1")
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"error":{"code":"InternalServerError","message":"try again"}}`))
+				return
+			}
+			w.Header().Set("X-Ms-Request-Id", "request-2")
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error":{"code":"OperationNotAllowed","message":"not now"}}`))
+		}))
+		defer ts.Close()
+
+		exporter := tracetest.NewInMemoryExporter()
+		pl := newPipeline(t, ts, exporter, runtime.NewRequestIDPolicy(), &ArmRequestMetricPolicy{})
+		resp, err := send(t, pl, ts.URL+resourcePath)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		spans := exporter.GetSpans()
+		require.Len(t, spans, 2)
+		for i, span := range spans {
+			attrs := attributes(span)
+			assert.Equal(t, "sub", attrs[attrSubscriptionID].AsString())
+			assert.Equal(t, "rg", attrs[attrResourceGroup].AsString())
+			assert.Equal(t, "Microsoft.Compute", attrs[attrResourceProvider].AsString())
+			assert.Equal(t, "Microsoft.Compute/virtualMachines", attrs[attrResourceType].AsString())
+			assert.Equal(t, string(ArmOperationGet), attrs[attrOperationKind].AsString())
+			assert.Equal(t, "2024-07-01", attrs[attrAPIVersion].AsString())
+			assert.Equal(t, "correlation-id", attrs[attrCorrelationRequestID].AsString())
+			assert.NotEmpty(t, attrs[attrClientRequestID].AsString())
+			assert.Equal(t, int64(i), attrs[attrResendCount].AsInt64())
+			assert.Contains(t, events(span), "http.got_conn")
+			assert.Contains(t, events(span), "http.first_response_byte")
+		}
+
+		first, second := attributes(spans[0]), attributes(spans[1])
+		assert.Equal(t, "request-1", first[attrRequestID].AsString())
+		assert.Equal(t, "InternalServerError", first[attrArmErrorCode].AsString())
+		assert.NotEmpty(t, first[attrTLSLatency].AsString())
+		assert.Contains(t, events(spans[0]), "http.tls.done")
+		assert.Equal(t, "request-2", second[attrRequestID].AsString())
+		assert.Equal(t, "OperationNotAllowed", second[attrArmErrorCode].AsString())
+	})
+
+	t.Run("the error body is left for the pipeline", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":"ResourceNotFound","message":"not found"}}`))
+		}))
+		defer ts.Close()
+
+		exporter := tracetest.NewInMemoryExporter()
+		pl := newPipeline(t, ts, exporter)
+		req, err := runtime.NewRequest(context.Background(), http.MethodGet, ts.URL+resourcePath)
+		require.NoError(t, err)
+		resp, err := pl.Do(req)
+		require.NoError(t, err)
+		body, err := runtime.Payload(resp)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "ResourceNotFound")
+
+		spans := exporter.GetSpans()
+		require.Len(t, spans, 1)
+		attrs := attributes(spans[0])
+		assert.Equal(t, "ResourceNotFound", attrs[attrArmErrorCode].AsString())
+		// classified from the request without ArmRequestMetricPolicy
+		assert.Equal(t, "Microsoft.Compute/virtualMachines", attrs[attrResourceType].AsString())
+		assert.NotContains(t, attrs, attrResendCount)
+	})
+
+	t.Run("large error bodies are not parsed by the span", func(t *testing.T) {
+		large := `{"error":{"code":"InBody","message":"` + strings.Repeat(".", armerrors.DefaultMaxErrorBodySize) + `"}}`
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Ms-Error-Code", "InHeader")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(large))
+		}))
+		defer ts.Close()
+
+		var policyErr *ArmError
+		collector := &testCollector{
+			requestStarted: func(iReq *RequestInfo) {},
+			requestCompleted: func(iReq *RequestInfo, iResp *ResponseInfo) {
+				policyErr = iResp.Error
+			},
+		}
+		exporter := tracetest.NewInMemoryExporter()
+		pl := newPipeline(t, ts, exporter, &ArmRequestMetricPolicy{Collector: collector})
+		req, err := runtime.NewRequest(context.Background(), http.MethodGet, ts.URL+resourcePath)
+		require.NoError(t, err)
+		resp, err := pl.Do(req)
+		require.NoError(t, err)
+		body, err := runtime.Payload(resp)
+		require.NoError(t, err)
+		assert.Equal(t, large, string(body))
+
+		spans := exporter.GetSpans()
+		require.Len(t, spans, 1)
+		assert.Equal(t, "InHeader", attributes(spans[0])[attrArmErrorCode].AsString())
+		require.NotNil(t, policyErr)
+		assert.Equal(t, ArmErrorCode("InHeader"), policyErr.Code)
+	})
+
+	t.Run("transport errors have an ArmErrorCode", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		endpoint := ts.URL + resourcePath
+		ts.Close()
+
+		exporter := tracetest.NewInMemoryExporter()
+		pl := newPipeline(t, ts, exporter, &ArmRequestMetricPolicy{})
+		_, err := send(t, pl, endpoint)
+		require.Error(t, err)
+
+		spans := exporter.GetSpans()
+		require.NotEmpty(t, spans)
+		attrs := attributes(spans[0])
+		assert.Equal(t, string(ArmErrorCodeConnectionRefused), attrs[attrArmErrorCode].AsString())
+		assert.Contains(t, events(spans[0]), "http.connect.done")
+	})
+
+	t.Run("requests without a recording span are passed through", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer ts.Close()
+
+		rt := NewArmSpanRoundTripper(ts.Client().Transport)
+		req := httptest.NewRequest(http.MethodGet, ts.URL+resourcePath, nil)
+		req.RequestURI = ""
+		resp, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	})
+
+	t.Run("the error parsed for the span is reused by the policy", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":"ResourceNotFound","message":"not found"}}`))
+		}))
+		defer ts.Close()
+
+		var transportErr, policyErr *ArmError
+		inspect := policyFunc(func(req *policy.Request) (*http.Response, error) {
+			resp, err := req.Next()
+			if armCtx := armRequestContextFrom(req.Raw().Context()); armCtx != nil && armCtx.response == resp {
+				transportErr = armCtx.responseError
+			}
+			return resp, err
+		})
+		collector := &testCollector{
+			requestStarted: func(iReq *RequestInfo) {},
+			requestCompleted: func(iReq *RequestInfo, iResp *ResponseInfo) {
+				policyErr = iResp.Error
+			},
+		}
+		exporter := tracetest.NewInMemoryExporter()
+		pl := newPipeline(t, ts, exporter, &ArmRequestMetricPolicy{Collector: collector}, inspect)
+		_, err := send(t, pl, ts.URL+resourcePath)
+		require.NoError(t, err)
+
+		require.NotNil(t, transportErr)
+		assert.Same(t, transportErr, policyErr)
+		assert.Equal(t, ArmErrorCode("ResourceNotFound"), policyErr.Code)
+	})
+}
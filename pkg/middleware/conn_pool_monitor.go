@@ -0,0 +1,293 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// http2LostPingError is the error type the http2 transport counts when it closes a connection
+// because the server did not answer the health check ping.
+const http2LostPingError = "conn_close_lost_ping"
+
+// ConnPoolStats is a snapshot of the connections tracked by a ConnPoolMonitor.
+type ConnPoolStats struct {
+	// Hosts are the stats per dialed address, host:port. It's the address of the proxy for proxied connections.
+	Hosts map[string]HostConnStats
+	// PingFailures counts the HTTP/2 health check pings the servers did not answer in time, the connection is closed.
+	PingFailures int64
+}
+
+// HostConnStats are the stats of the connections to a host.
+type HostConnStats struct {
+	// Open is the number of open connections.
+	Open int
+	// Active is the number of open connections with requests in flight.
+	Active int
+	// Idle is the number of open connections without requests in flight.
+	Idle int
+	// InFlight is the number of requests in flight, the number of streams for HTTP/2.
+	InFlight int
+	// InFlightPerConn is the number of requests in flight of each active connection, in decreasing order.
+	// HTTP/1.1 connections have at most one.
+	InFlightPerConn []int
+	// Dials is the number of connections dialed, DialErrors the number of those that failed.
+	Dials      int64
+	DialErrors int64
+	// Requests is the number of requests that got a connection, Reused the number of those that reused one.
+	Requests int64
+	Reused   int64
+	// Closed is the number of connections closed.
+	Closed int64
+	// ClosedByPingTimeout is the number of HTTP/2 connections closed because the server did not answer the health check ping.
+	// A connection closed at the same time as another one lost its ping may be counted instead of it.
+	ClosedByPingTimeout int64
+}
+
+// ReuseRatio is the share of the requests that reused a connection, 0 if there was no request.
+func (s HostConnStats) ReuseRatio() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	return float64(s.Reused) / float64(s.Requests)
+}
+
+// ConnPoolMonitor tracks the connections of the transports created by NewHTTPClient, see HTTPClientOptions.ConnPoolMonitor.
+// A monitor can be shared by several clients, their stats are added up per host.
+type ConnPoolMonitor struct {
+	mu    sync.Mutex
+	hosts map[string]*hostConns
+	// lostPings are the lost pings counted by the http2 transport whose connection is not closed yet.
+	lostPings    int
+	pingFailures atomic.Int64
+}
+
+type hostConns struct {
+	conns               map[*monitoredConn]struct{}
+	dials               int64
+	dialErrors          int64
+	requests            int64
+	reused              int64
+	closed              int64
+	closedByPingTimeout int64
+}
+
+// NewConnPoolMonitor returns a new ConnPoolMonitor.
+func NewConnPoolMonitor() *ConnPoolMonitor {
+	return &ConnPoolMonitor{hosts: map[string]*hostConns{}}
+}
+
+// Snapshot returns the current stats of the connections.
+func (m *ConnPoolMonitor) Snapshot() ConnPoolStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := ConnPoolStats{
+		Hosts:        make(map[string]HostConnStats, len(m.hosts)),
+		PingFailures: m.pingFailures.Load(),
+	}
+	for host := range m.hosts {
+		stats.Hosts[host] = m.hostStatsLocked(host)
+	}
+	return stats
+}
+
+// hostStats returns the current stats of the connections to host.
+func (m *ConnPoolMonitor) hostStats(host string) HostConnStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.hostStatsLocked(host)
+}
+
+func (m *ConnPoolMonitor) hostStatsLocked(host string) HostConnStats {
+	h, ok := m.hosts[host]
+	if !ok {
+		return HostConnStats{}
+	}
+	stats := HostConnStats{
+		Open:                len(h.conns),
+		Dials:               h.dials,
+		DialErrors:          h.dialErrors,
+		Requests:            h.requests,
+		Reused:              h.reused,
+		Closed:              h.closed,
+		ClosedByPingTimeout: h.closedByPingTimeout,
+	}
+	for conn := range h.conns {
+		if conn.inFlight == 0 {
+			stats.Idle++
+			continue
+		}
+		stats.Active++
+		stats.InFlight += conn.inFlight
+		stats.InFlightPerConn = append(stats.InFlightPerConn, conn.inFlight)
+	}
+	slices.SortFunc(stats.InFlightPerConn, func(a, b int) int { return b - a })
+	return stats
+}
+
+// host returns the stats of host, it must be called with mu held.
+func (m *ConnPoolMonitor) host(host string) *hostConns {
+	h, ok := m.hosts[host]
+	if !ok {
+		h = &hostConns{conns: map[*monitoredConn]struct{}{}}
+		m.hosts[host] = h
+	}
+	return h
+}
+
+// dialContext wraps dial to track the connections it opens.
+func (m *ConnPoolMonitor) dialContext(dial dialContextFunc) dialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		h := m.host(addr)
+		h.dials++
+		if err != nil {
+			h.dialErrors++
+			return conn, err
+		}
+		monitored := &monitoredConn{Conn: conn, monitor: m, host: addr}
+		h.conns[monitored] = struct{}{}
+		return monitored, nil
+	}
+}
+
+// countError is the CountError of the http2 transport.
+func (m *ConnPoolMonitor) countError(errType string) {
+	if errType != http2LostPingError {
+		return
+	}
+	m.pingFailures.Add(1)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// the http2 transport closes the connection right after counting the error
+	m.lostPings++
+}
+
+func (m *ConnPoolMonitor) connClosed(conn *monitoredConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.host(conn.host)
+	delete(h.conns, conn)
+	h.closed++
+	if m.lostPings > 0 {
+		m.lostPings--
+		h.closedByPingTimeout++
+	}
+}
+
+// gotConn records a request that got conn, it returns the monitored connection, or nil if it's not monitored.
+func (m *ConnPoolMonitor) gotConn(connInfo httptrace.GotConnInfo) *monitoredConn {
+	conn := connInfo.Conn
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	monitored, ok := conn.(*monitoredConn)
+	if !ok || monitored.monitor != m {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.host(monitored.host)
+	h.requests++
+	if connInfo.Reused {
+		h.reused++
+	}
+	monitored.inFlight++
+	return monitored
+}
+
+func (m *ConnPoolMonitor) requestDone(conn *monitoredConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conn.inFlight--
+}
+
+// monitoredConn is a connection tracked by a ConnPoolMonitor.
+type monitoredConn struct {
+	net.Conn
+	monitor *ConnPoolMonitor
+	host    string
+	// inFlight is protected by the mutex of the monitor
+	inFlight  int
+	closeOnce sync.Once
+}
+
+func (c *monitoredConn) Close() error {
+	c.closeOnce.Do(func() { c.monitor.connClosed(c) })
+	return c.Conn.Close()
+}
+
+// connPoolRoundTripper tracks the requests in flight on the connections of a ConnPoolMonitor.
+type connPoolRoundTripper struct {
+	next    http.RoundTripper
+	monitor *ConnPoolMonitor
+}
+
+func (t *connPoolRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// GotConn is called once per request, by the transport goroutine of the request
+	var conn atomic.Pointer[monitoredConn]
+	trace := &httptrace.ClientTrace{
+		GotConn: func(connInfo httptrace.GotConnInfo) {
+			conn.Store(t.monitor.gotConn(connInfo))
+		},
+	}
+	resp, err := t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	monitored := conn.Load()
+	if monitored == nil {
+		return resp, err
+	}
+	if armCtx := armRequestContextFrom(req.Context()); armCtx != nil {
+		stats := t.monitor.hostStats(monitored.host)
+		armCtx.hostConnStats = &stats
+	}
+	if err != nil {
+		t.monitor.requestDone(monitored)
+		return resp, err
+	}
+	// the request is in flight until its body is read or closed
+	resp.Body = &monitoredBody{ReadCloser: resp.Body, done: func() { t.monitor.requestDone(monitored) }}
+	return resp, nil
+}
+
+type monitoredBody struct {
+	io.ReadCloser
+	doneOnce sync.Once
+	done     func()
+}
+
+func (b *monitoredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.doneOnce.Do(b.done)
+	}
+	return n, err
+}
+
+func (b *monitoredBody) Close() error {
+	b.doneOnce.Do(b.done)
+	return b.ReadCloser.Close()
+}
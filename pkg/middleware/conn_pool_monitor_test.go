@@ -0,0 +1,226 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnPoolMonitor(t *testing.T) {
+	newClient := func(t *testing.T, ts *httptest.Server, monitor *ConnPoolMonitor) *http.Client {
+		opts := DefaultHTTPClientOptions()
+		opts.TLSClientConfig = ts.Client().Transport.(*http.Transport).TLSClientConfig
+		opts.ConnPoolMonitor = monitor
+		client, err := NewHTTPClient(opts)
+		require.NoError(t, err)
+		return client
+	}
+
+	hostOf := func(t *testing.T, ts *httptest.Server) string {
+		u, err := url.Parse(ts.URL)
+		require.NoError(t, err)
+		return u.Host
+	}
+
+	t.Run("http/1.1 connections are reused", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+		defer ts.Close()
+		monitor := NewConnPoolMonitor()
+		client := newClient(t, ts, monitor)
+		host := hostOf(t, ts)
+
+		resp, err := client.Get(ts.URL)
+		require.NoError(t, err)
+		stats := monitor.Snapshot().Hosts[host]
+		assert.Equal(t, 1, stats.Active, "the request is in flight until its body is read")
+		assert.Equal(t, 1, stats.InFlight)
+		assert.Equal(t, []int{1}, stats.InFlightPerConn)
+		_, err = io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		resp, err = client.Get(ts.URL)
+		require.NoError(t, err)
+		_, err = io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		stats = monitor.Snapshot().Hosts[host]
+		assert.Equal(t, int64(1), stats.Dials)
+		assert.Equal(t, int64(2), stats.Requests)
+		assert.Equal(t, int64(1), stats.Reused)
+		assert.Equal(t, 0.5, stats.ReuseRatio())
+		assert.Equal(t, 1, stats.Open)
+		assert.Equal(t, 1, stats.Idle)
+		assert.Equal(t, 0, stats.Active)
+		assert.Equal(t, 0, stats.InFlight)
+
+		ts.CloseClientConnections()
+		assert.Eventually(t, func() bool {
+			stats := monitor.Snapshot().Hosts[host]
+			return stats.Open == 0 && stats.Closed == 1
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("http/2 streams are counted per connection", func(t *testing.T) {
+		release := make(chan struct{})
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			if r.URL.Path == "/wait" {
+				<-release
+			}
+		}))
+		ts.EnableHTTP2 = true
+		ts.StartTLS()
+		defer ts.Close()
+		monitor := NewConnPoolMonitor()
+		client := newClient(t, ts, monitor)
+		host := hostOf(t, ts)
+
+		// opens the connection
+		resp, err := client.Get(ts.URL)
+		require.NoError(t, err)
+		require.Equal(t, 2, resp.ProtoMajor)
+		resp.Body.Close()
+
+		const streams = 3
+		responses := make(chan *http.Response, streams)
+		var wg sync.WaitGroup
+		for range streams {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := client.Get(ts.URL + "/wait")
+				if assert.NoError(t, err) {
+					responses <- resp
+				}
+			}()
+		}
+		wg.Wait()
+
+		stats := monitor.Snapshot().Hosts[host]
+		assert.Equal(t, int64(1), stats.Dials)
+		assert.Equal(t, 1, stats.Open)
+		assert.Equal(t, 1, stats.Active)
+		assert.Equal(t, streams, stats.InFlight)
+		assert.Equal(t, []int{streams}, stats.InFlightPerConn)
+		assert.Equal(t, int64(streams+1), stats.Requests)
+		assert.Equal(t, int64(streams), stats.Reused)
+
+		close(release)
+		close(responses)
+		for resp := range responses {
+			_, _ = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		stats = monitor.Snapshot().Hosts[host]
+		assert.Equal(t, 1, stats.Idle)
+		assert.Equal(t, 0, stats.InFlight)
+		assert.Empty(t, stats.InFlightPerConn)
+	})
+
+	t.Run("connections closed after a lost ping", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer ln.Close()
+		var accepted sync.WaitGroup
+		accepted.Add(2)
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				t.Cleanup(func() { conn.Close() })
+				accepted.Done()
+			}
+		}()
+
+		monitor := NewConnPoolMonitor()
+		dial := monitor.dialContext((&net.Dialer{}).DialContext)
+		lost, err := dial(context.Background(), "tcp", ln.Addr().String())
+		require.NoError(t, err)
+		healthy, err := dial(context.Background(), "tcp", ln.Addr().String())
+		require.NoError(t, err)
+		accepted.Wait()
+
+		monitor.countError(http2LostPingError)
+		monitor.countError("recv_goaway_")
+		require.NoError(t, lost.Close())
+		_ = lost.Close() // closing twice is counted once
+		require.NoError(t, healthy.Close())
+
+		snapshot := monitor.Snapshot()
+		assert.Equal(t, int64(1), snapshot.PingFailures)
+		stats := snapshot.Hosts[ln.Addr().String()]
+		assert.Equal(t, int64(2), stats.Dials)
+		assert.Equal(t, int64(2), stats.Closed)
+		assert.Equal(t, int64(1), stats.ClosedByPingTimeout)
+		assert.Equal(t, 0, stats.Open)
+	})
+
+	t.Run("dial errors", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := ln.Addr().String()
+		ln.Close()
+
+		monitor := NewConnPoolMonitor()
+		dial := monitor.dialContext((&net.Dialer{}).DialContext)
+		_, err = dial(context.Background(), "tcp", addr)
+		require.Error(t, err)
+
+		stats := monitor.Snapshot().Hosts[addr]
+		assert.Equal(t, int64(1), stats.Dials)
+		assert.Equal(t, int64(1), stats.DialErrors)
+		assert.Equal(t, 0, stats.Open)
+	})
+
+	t.Run("stats of the host are passed to the collector", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("{}"))
+		}))
+		defer ts.Close()
+		monitor := NewConnPoolMonitor()
+
+		var completed *ResponseInfo
+		collector := &testCollector{
+			requestStarted: func(iReq *RequestInfo) {},
+			requestCompleted: func(iReq *RequestInfo, iResp *ResponseInfo) {
+				completed = iResp
+			},
+		}
+		pl := runtime.NewPipeline("test", "v1", runtime.PipelineOptions{}, &policy.ClientOptions{
+			Transport:        newClient(t, ts, monitor),
+			PerRetryPolicies: []policy.Policy{&ArmRequestMetricPolicy{Collector: collector}},
+		})
+		req, err := runtime.NewRequest(context.Background(), http.MethodGet, ts.URL+"/subscriptions/sub")
+		require.NoError(t, err)
+		resp, err := pl.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		require.NotNil(t, completed)
+		require.NotNil(t, completed.HostConnStats)
+		assert.Equal(t, int64(1), completed.HostConnStats.Dials)
+		assert.Equal(t, 1, completed.HostConnStats.InFlight)
+	})
+
+	t.Run("the default client is monitored", func(t *testing.T) {
+		assert.NotNil(t, DefaultConnPoolMonitor())
+	})
+}
@@ -15,12 +15,17 @@ limitations under the License.
 package middleware
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"time"
 
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/http2"
 )
 
@@ -31,63 +36,233 @@ var (
 	defaultTransport *http.Transport
 	// defaultRoundTripper wraps the defaultTransport with arm balancer and otel propagation
 	defaultRoundTripper http.RoundTripper
+	// defaultConnPoolMonitor tracks the connections of the defaultTransport
+	defaultConnPoolMonitor = NewConnPoolMonitor()
 )
 
+// HTTPClientOptions configures the clients created by NewHTTPClient.
+// Start from DefaultHTTPClientOptions, zero values have the meaning they have for http.Transport and net.Dialer,
+// e.g. no timeout or no limit.
+type HTTPClientOptions struct {
+	// DialTimeout is the maximum amount of time a dial will wait for a connect to complete.
+	DialTimeout time.Duration
+	// KeepAlive is the interval of the TCP keep-alive probes.
+	KeepAlive time.Duration
+	// TLSHandshakeTimeout is the maximum amount of time to wait for a TLS handshake.
+	TLSHandshakeTimeout time.Duration
+	// IdleConnTimeout is the maximum amount of time an idle connection remains idle before closing itself.
+	IdleConnTimeout time.Duration
+	// ExpectContinueTimeout is the amount of time to wait for the first response headers of requests with an "Expect: 100-continue" header.
+	ExpectContinueTimeout time.Duration
+
+	// MaxIdleConns is the maximum number of idle connections across all hosts.
+	MaxIdleConns int
+	// MaxIdleConnsPerHost is the maximum number of idle connections to keep per host.
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost limits the total number of connections per host, including connections in the dialing,
+	// active, and idle states.
+	MaxConnsPerHost int
+
+	// DisableHTTP2 keeps the client on HTTP/1.1, the HTTP/2 settings below are ignored.
+	DisableHTTP2 bool
+	// HTTP2PingTimeout is the time the server has to answer the health check ping, the connection is closed otherwise.
+	HTTP2PingTimeout time.Duration
+	// HTTP2ReadIdleTimeout is the time after which a health check ping is sent if no frame was received on the connection.
+	// Zero disables the health check.
+	HTTP2ReadIdleTimeout time.Duration
+
+	// ResponseHeaderTimeout is the time the server has to send the response headers once the request is written on an
+	// HTTP/1.1 connection, the request fails with ErrResponseHeaderTimeout otherwise. HTTP/2 connections rely on the
+	// health check ping instead. WithResponseHeaderTimeout overrides it per request. Zero disables the timeout.
+	ResponseHeaderTimeout time.Duration
+	// BodyReadIdleTimeout is the time a read of an HTTP/1.1 response body waits for data, the read fails with
+	// ErrBodyReadIdleTimeout otherwise. HTTP/2 connections rely on the health check ping instead.
+	// Zero disables the timeout.
+	BodyReadIdleTimeout time.Duration
+
+	// Proxy returns the proxy of a request, see http.Transport.Proxy.
+	Proxy func(*http.Request) (*url.URL, error)
+	// TLSClientConfig is the TLS configuration of the connections, it's cloned and not modified.
+	TLSClientConfig *tls.Config
+
+	// Propagators propagate the trace context of the requests.
+	Propagators propagation.TextMapPropagator
+	// TracerProvider creates the spans of the requests, the global one is used if nil.
+	TracerProvider trace.TracerProvider
+
+	// ConnPoolMonitor tracks the connections of the client if set, see ResponseInfo.HostConnStats.
+	ConnPoolMonitor *ConnPoolMonitor
+
+	// DNSCache resolves the hosts of the dials if set, see DNSCacheOptions.
+	DNSCache *DNSCache
+
+	// LoadBalancing spreads the requests to a host across several connections if set, see LoadBalancingOptions.
+	LoadBalancing *LoadBalancingOptions
+}
+
+// DefaultHTTPClientOptions returns the options of DefaultHTTPClient.
+func DefaultHTTPClientOptions() *HTTPClientOptions {
+	return &HTTPClientOptions{
+		DialTimeout:           30 * time.Second,
+		KeepAlive:             30 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   100,
+		// we give 10s to the server to respond to the ping. if no response is received,
+		// the transport will close the connection, so that the next request will open a new connection, and not
+		// hit a context deadline exceeded error.
+		HTTP2PingTimeout: 10 * time.Second,
+		// if no frame is received for 30s, the transport will issue a ping health check to the server.
+		HTTP2ReadIdleTimeout: 30 * time.Second,
+		// ResponseHeaderTimeout and BodyReadIdleTimeout are opt-in: ARM operations can legitimately take long to
+		// respond, and the HTTP/2 connections are already health checked.
+		Proxy:       http.ProxyFromEnvironment,
+		Propagators: propagation.TraceContext{},
+	}
+}
+
 // DefaultHTTPClient returns a shared http client
 func DefaultHTTPClient() *http.Client {
 	return defaultHTTPClient
 }
 
+// DefaultConnPoolMonitor returns the monitor of the connections of DefaultHTTPClient.
+func DefaultConnPoolMonitor() *ConnPoolMonitor {
+	return defaultConnPoolMonitor
+}
+
+// NewHTTPClient returns a new http client configured with opts, DefaultHTTPClientOptions are used if opts is nil.
+// Each client has its own transport and connection pool.
+func NewHTTPClient(opts *HTTPClientOptions) (*http.Client, error) {
+	if opts == nil {
+		opts = DefaultHTTPClientOptions()
+	}
+	var tr http.RoundTripper
+	var err error
+	if opts.LoadBalancing != nil && opts.LoadBalancing.Connections > 1 {
+		tr, err = newArmBalancer(opts)
+	} else {
+		tr, err = newTransport(opts, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newHTTPClient(newRoundTripper(tr, opts), opts), nil
+}
+
 func init() {
-	defaultTransport = &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		ForceAttemptHTTP2:     true,
-		MaxIdleConns:          100,
-		MaxIdleConnsPerHost:   100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
+	opts := DefaultHTTPClientOptions()
+	opts.ConnPoolMonitor = defaultConnPoolMonitor
+	tr, err := newTransport(opts, nil)
+	if err != nil {
+		// the transport is new, configuring http2 can't fail
+		panic(err)
+	}
+	defaultTransport = tr
+	defaultRoundTripper = newRoundTripper(defaultTransport, opts)
+	defaultHTTPClient = newHTTPClient(defaultRoundTripper, opts)
+}
+
+// dialContextFunc is the signature of http.Transport.DialContext.
+type dialContextFunc = func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// newTransport returns a new transport configured with opts. wrapDial, if not nil, wraps the dialer of the transport.
+func newTransport(opts *HTTPClientOptions, wrapDial func(dialContextFunc) dialContextFunc) (*http.Transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   opts.DialTimeout,
+		KeepAlive: opts.KeepAlive,
+	}
+	dialContext := dialer.DialContext
+	if opts.DNSCache != nil {
+		dialContext = opts.DNSCache.dialContext(dialer)
+	}
+	if wrapDial != nil {
+		dialContext = wrapDial(dialContext)
+	}
+	if opts.ConnPoolMonitor != nil {
+		dialContext = opts.ConnPoolMonitor.dialContext(dialContext)
+	}
+	tr := &http.Transport{
+		Proxy:                 opts.Proxy,
+		DialContext:           dialContext,
+		ForceAttemptHTTP2:     !opts.DisableHTTP2,
+		MaxIdleConns:          opts.MaxIdleConns,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       opts.MaxConnsPerHost,
+		IdleConnTimeout:       opts.IdleConnTimeout,
+		TLSHandshakeTimeout:   opts.TLSHandshakeTimeout,
+		ExpectContinueTimeout: opts.ExpectContinueTimeout,
+		// the responses are decompressed by the payloadRoundTripper, which counts the bytes received
+		DisableCompression: true,
 	}
-	// We call configureHttp2TransportPing() in the package init to ensure that our defaultTransport is always configured
-	// with the http2 additional settings that work around the issue described here:
+	if opts.TLSClientConfig != nil {
+		// configuring http2 adds "h2" to the NextProtos of the config
+		tr.TLSClientConfig = opts.TLSClientConfig.Clone()
+	}
+	if opts.DisableHTTP2 {
+		return tr, nil
+	}
+	// We configure the http2 ping of every transport to work around the issue described here:
 	// https://github.com/golang/go/issues/59690
 	// azure sdk related issue is here:
 	// https://github.com/Azure/azure-sdk-for-go/issues/21346#issuecomment-1699665586
-	configureHttp2TransportPing(defaultTransport)
-	defaultRoundTripper = defaultTransport
+	http2Transport, err := configureHttp2TransportPing(tr, opts.HTTP2PingTimeout, opts.HTTP2ReadIdleTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ConnPoolMonitor != nil {
+		http2Transport.CountError = opts.ConnPoolMonitor.countError
+	}
+	return tr, nil
+}
 
-	defaultHTTPClient = &http.Client{
-		Transport: otelhttp.NewTransport(
-			defaultRoundTripper,
-			otelhttp.WithPropagators(propagation.TraceContext{}),
-		),
+// newRoundTripper wraps the transport with the round trippers the options configure.
+func newRoundTripper(tr http.RoundTripper, opts *HTTPClientOptions) http.RoundTripper {
+	rt := tr
+	if opts.ResponseHeaderTimeout > 0 || opts.BodyReadIdleTimeout > 0 {
+		rt = &watchdogRoundTripper{
+			next:                  rt,
+			responseHeaderTimeout: opts.ResponseHeaderTimeout,
+			bodyReadIdleTimeout:   opts.BodyReadIdleTimeout,
+		}
+	}
+	rt = &payloadRoundTripper{next: rt}
+	if opts.ConnPoolMonitor != nil {
+		rt = &connPoolRoundTripper{next: rt, monitor: opts.ConnPoolMonitor}
 	}
+	// the span of the request is started by otelhttp, the inner round tripper adds the ARM semantics to it
+	return NewArmSpanRoundTripper(rt)
 }
 
-// configureHttp2Transport ensures that our defaultTransport is configured
+func newHTTPClient(rt http.RoundTripper, opts *HTTPClientOptions) *http.Client {
+	otelOpts := []otelhttp.Option{}
+	if opts.Propagators != nil {
+		otelOpts = append(otelOpts, otelhttp.WithPropagators(opts.Propagators))
+	}
+	if opts.TracerProvider != nil {
+		otelOpts = append(otelOpts, otelhttp.WithTracerProvider(opts.TracerProvider))
+	}
+	return &http.Client{
+		Transport: otelhttp.NewTransport(rt, otelOpts...),
+	}
+}
+
+// configureHttp2TransportPing ensures that the transport is configured
 // with the http2 additional settings that work around the issue described here:
 // https://github.com/golang/go/issues/59690
 // azure sdk related issue is here:
 // https://github.com/Azure/azure-sdk-for-go/issues/21346#issuecomment-1699665586
-// This is called by the package init to ensure that our defaultTransport is always configured
-// you should not call this anywhere else.
-func configureHttp2TransportPing(tr *http.Transport) {
+// It returns an error if the transport is already configured for http2.
+func configureHttp2TransportPing(tr *http.Transport, pingTimeout, readIdleTimeout time.Duration) (*http2.Transport, error) {
 	// http2Transport holds a reference to the default transport and configures "h2" middlewares that
 	// will use the below settings, making the standard http.Transport behave correctly for dropped connections
 	http2Transport, err := http2.ConfigureTransports(tr)
 	if err != nil {
-		// by initializing in init(), we know it is only called once.
-		// this errors if called twice.
-		panic(err)
+		return nil, fmt.Errorf("configuring http2 transport: %w", err)
 	}
-	// we give 10s to the server to respond to the ping. if no response is received,
-	// the transport will close the connection, so that the next request will open a new connection, and not
-	// hit a context deadline exceeded error.
-	http2Transport.PingTimeout = 10 * time.Second
-	// if no frame is received for 30s, the transport will issue a ping health check to the server.
-	http2Transport.ReadIdleTimeout = 30 * time.Second
+	http2Transport.PingTimeout = pingTimeout
+	http2Transport.ReadIdleTimeout = readIdleTimeout
+	return http2Transport, nil
 }
@@ -1,29 +1,139 @@
 package middleware
 
 import (
+	"context"
+	"crypto/tls"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestConfigureHttp2TransportPing(t *testing.T) {
 	t.Run("transport should be setup with http2Transport h2 middleware", func(t *testing.T) {
 		tr := &http.Transport{}
-		configureHttp2TransportPing(tr)
+		http2Transport, err := configureHttp2TransportPing(tr, 10*time.Second, 30*time.Second)
+		require.NoError(t, err)
+		require.Equal(t, 10*time.Second, http2Transport.PingTimeout)
+		require.Equal(t, 30*time.Second, http2Transport.ReadIdleTimeout)
 		require.Contains(t, tr.TLSClientConfig.NextProtos, "h2")
 	})
 
-	t.Run("configuring transport twice panics", func(t *testing.T) {
+	t.Run("configuring transport twice returns an error", func(t *testing.T) {
 		tr := &http.Transport{}
-		require.NotPanics(t, func() { configureHttp2TransportPing(tr) })
-		require.Panics(t, func() { configureHttp2TransportPing(tr) })
+		_, err := configureHttp2TransportPing(tr, 10*time.Second, 30*time.Second)
+		require.NoError(t, err)
+		_, err = configureHttp2TransportPing(tr, 10*time.Second, 30*time.Second)
+		require.Error(t, err)
 		require.Contains(t, tr.TLSClientConfig.NextProtos, "h2")
 	})
 
 	t.Run("defaultTransport is configured with h2 by default", func(t *testing.T) {
-		// should panic because it's already configured
-		require.Panics(t, func() { configureHttp2TransportPing(defaultTransport) })
+		// should fail because it's already configured
+		_, err := configureHttp2TransportPing(defaultTransport, 10*time.Second, 30*time.Second)
+		require.Error(t, err)
 		require.Contains(t, defaultTransport.TLSClientConfig.NextProtos, "h2")
 	})
 }
+
+func TestNewHTTPClient(t *testing.T) {
+	t.Run("nil options are the default ones", func(t *testing.T) {
+		client, err := NewHTTPClient(nil)
+		require.NoError(t, err)
+		require.NotNil(t, client.Transport)
+	})
+
+	t.Run("transports are independent", func(t *testing.T) {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		opts := DefaultHTTPClientOptions()
+		opts.TLSClientConfig = tlsConfig
+		first, err := newTransport(opts, nil)
+		require.NoError(t, err)
+		second, err := newTransport(opts, nil)
+		require.NoError(t, err)
+
+		assert.NotSame(t, first, second)
+		assert.NotSame(t, first.TLSClientConfig, second.TLSClientConfig)
+		assert.Contains(t, first.TLSClientConfig.NextProtos, "h2")
+		assert.Empty(t, tlsConfig.NextProtos, "the config of the caller is not modified")
+		assert.Equal(t, uint16(tls.VersionTLS12), first.TLSClientConfig.MinVersion)
+	})
+
+	t.Run("options are applied to the transport", func(t *testing.T) {
+		proxyURL, err := url.Parse("http://proxy:3128")
+		require.NoError(t, err)
+		opts := &HTTPClientOptions{
+			TLSHandshakeTimeout: time.Second,
+			IdleConnTimeout:     time.Minute,
+			MaxIdleConns:        10,
+			MaxIdleConnsPerHost: 5,
+			MaxConnsPerHost:     20,
+			DisableHTTP2:        true,
+			Proxy:               http.ProxyURL(proxyURL),
+		}
+		tr, err := newTransport(opts, nil)
+		require.NoError(t, err)
+		assert.Equal(t, time.Second, tr.TLSHandshakeTimeout)
+		assert.Equal(t, time.Minute, tr.IdleConnTimeout)
+		assert.Equal(t, 10, tr.MaxIdleConns)
+		assert.Equal(t, 5, tr.MaxIdleConnsPerHost)
+		assert.Equal(t, 20, tr.MaxConnsPerHost)
+		assert.False(t, tr.ForceAttemptHTTP2)
+		assert.Nil(t, tr.TLSClientConfig, "http2 is not configured")
+
+		proxy, err := tr.Proxy(httptest.NewRequest(http.MethodGet, "https://management.azure.com", nil))
+		require.NoError(t, err)
+		assert.Equal(t, proxyURL, proxy)
+	})
+
+	t.Run("http2 is negotiated", func(t *testing.T) {
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		ts.EnableHTTP2 = true
+		ts.StartTLS()
+		defer ts.Close()
+
+		opts := DefaultHTTPClientOptions()
+		opts.HTTP2PingTimeout = 3 * time.Second
+		opts.HTTP2ReadIdleTimeout = 7 * time.Second
+		opts.TLSClientConfig = ts.Client().Transport.(*http.Transport).TLSClientConfig
+		client, err := NewHTTPClient(opts)
+		require.NoError(t, err)
+		resp, err := client.Get(ts.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, 2, resp.ProtoMajor)
+	})
+
+	t.Run("requests are traced with the tracer provider and propagators of the options", func(t *testing.T) {
+		var traceparent string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			traceparent = r.Header.Get("traceparent")
+		}))
+		defer ts.Close()
+
+		exporter := tracetest.NewInMemoryExporter()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+		defer tp.Shutdown(context.Background())
+		opts := DefaultHTTPClientOptions()
+		opts.TracerProvider = tp
+		opts.Propagators = propagation.TraceContext{}
+		client, err := NewHTTPClient(opts)
+		require.NoError(t, err)
+
+		resp, err := client.Get(ts.URL + "/subscriptions/sub?api-version=2022-12-01")
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		spans := exporter.GetSpans()
+		require.Len(t, spans, 1)
+		assert.NotEmpty(t, traceparent)
+		assert.Contains(t, traceparent, spans[0].SpanContext.TraceID().String())
+	})
+}
@@ -0,0 +1,382 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultDNSCacheTTL is the time the addresses of a host are cached.
+	// The resolver of the standard library does not expose the TTL of the records.
+	DefaultDNSCacheTTL = 30 * time.Second
+	// DefaultDNSCacheNegativeTTL is the time a failed lookup is cached.
+	DefaultDNSCacheNegativeTTL = 5 * time.Second
+	// DefaultDNSCacheFallbackDelay is the time the dial of the first address family is given before the other one
+	// is dialed in parallel, as with net.Dialer.FallbackDelay.
+	DefaultDNSCacheFallbackDelay = 300 * time.Millisecond
+	// dnsLookupTimeout bounds the lookups, they are shared by the requests waiting for them and are not canceled
+	// with the request that started them.
+	dnsLookupTimeout = 10 * time.Second
+)
+
+// DNSCacheResult is how the addresses of a host were found in a DNSCache.
+type DNSCacheResult string
+
+const (
+	// DNSCacheHit is a fresh entry.
+	DNSCacheHit DNSCacheResult = "Hit"
+	// DNSCacheStaleHit is an expired entry served while it's refreshed in the background.
+	DNSCacheStaleHit DNSCacheResult = "StaleHit"
+	// DNSCacheNegativeHit is a cached failed lookup.
+	DNSCacheNegativeHit DNSCacheResult = "NegativeHit"
+	// DNSCacheMiss is a lookup.
+	DNSCacheMiss DNSCacheResult = "Miss"
+)
+
+// DNSCacheOptions configures a DNSCache.
+type DNSCacheOptions struct {
+	// TTL is the time the addresses of a host are cached, DefaultDNSCacheTTL is used if zero.
+	TTL time.Duration
+	// NegativeTTL is the time a failed lookup is cached, DefaultDNSCacheNegativeTTL is used if zero, negative disables it.
+	NegativeTTL time.Duration
+	// StaleWhileRevalidate is the time after the expiry of an entry during which it's still served
+	// while it's refreshed in the background. Zero disables it.
+	StaleWhileRevalidate time.Duration
+	// FallbackDelay is the happy eyeballs delay (RFC 6555): the time the dial of the first address family
+	// is given before the other one is dialed in parallel. DefaultDNSCacheFallbackDelay is used if zero,
+	// negative disables the parallel dial.
+	FallbackDelay time.Duration
+	// LookupHost resolves the hosts, net.DefaultResolver.LookupHost is used if nil.
+	LookupHost func(ctx context.Context, host string) ([]string, error)
+}
+
+// DNSCacheStats counts the lookups of a DNSCache per result.
+type DNSCacheStats struct {
+	Hits         int64
+	StaleHits    int64
+	NegativeHits int64
+	Misses       int64
+	// Errors is the number of the lookups that failed, including the refreshes in the background.
+	Errors int64
+}
+
+// DNSCache is a caching resolver for the dialer of the transports created by NewHTTPClient, see HTTPClientOptions.DNSCache.
+// The result of the lookup of the dial of a request is reported in ResponseInfo.DNSCacheResult.
+type DNSCache struct {
+	ttl                  time.Duration
+	negativeTTL          time.Duration
+	staleWhileRevalidate time.Duration
+	fallbackDelay        time.Duration
+	lookupHost           func(ctx context.Context, host string) ([]string, error)
+	// now is replaced by tests
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*dnsCacheEntry
+
+	hits, staleHits, negativeHits, misses, errors atomic.Int64
+}
+
+type dnsCacheEntry struct {
+	addrs   []string
+	err     error
+	expires time.Time
+	// lookup is closed once the entry is resolved, refreshing is set while it's refreshed in the background.
+	lookup     chan struct{}
+	refreshing bool
+}
+
+// NewDNSCache returns a new DNSCache, default options are used if opts is nil.
+func NewDNSCache(opts *DNSCacheOptions) *DNSCache {
+	if opts == nil {
+		opts = &DNSCacheOptions{}
+	}
+	c := &DNSCache{
+		ttl:                  opts.TTL,
+		negativeTTL:          opts.NegativeTTL,
+		staleWhileRevalidate: opts.StaleWhileRevalidate,
+		fallbackDelay:        opts.FallbackDelay,
+		lookupHost:           opts.LookupHost,
+		now:                  time.Now,
+		entries:              map[string]*dnsCacheEntry{},
+	}
+	if c.ttl == 0 {
+		c.ttl = DefaultDNSCacheTTL
+	}
+	if c.negativeTTL == 0 {
+		c.negativeTTL = DefaultDNSCacheNegativeTTL
+	}
+	if c.fallbackDelay == 0 {
+		c.fallbackDelay = DefaultDNSCacheFallbackDelay
+	}
+	if c.lookupHost == nil {
+		c.lookupHost = net.DefaultResolver.LookupHost
+	}
+	return c
+}
+
+// Stats returns the number of lookups per result.
+func (c *DNSCache) Stats() DNSCacheStats {
+	return DNSCacheStats{
+		Hits:         c.hits.Load(),
+		StaleHits:    c.staleHits.Load(),
+		NegativeHits: c.negativeHits.Load(),
+		Misses:       c.misses.Load(),
+		Errors:       c.errors.Load(),
+	}
+}
+
+// LookupHost returns the addresses of host, from the cache if possible.
+func (c *DNSCache) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs, _, err := c.lookup(ctx, host)
+	return addrs, err
+}
+
+func (c *DNSCache) lookup(ctx context.Context, host string) ([]string, DNSCacheResult, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	if ok {
+		select {
+		case <-entry.lookup:
+		default:
+			// another request is resolving the host, wait for it
+			c.mu.Unlock()
+			c.misses.Add(1)
+			return c.wait(ctx, entry)
+		}
+
+		now := c.now()
+		switch {
+		case now.Before(entry.expires) && entry.err != nil:
+			c.mu.Unlock()
+			c.negativeHits.Add(1)
+			return nil, DNSCacheNegativeHit, entry.err
+		case now.Before(entry.expires):
+			c.mu.Unlock()
+			c.hits.Add(1)
+			return entry.addrs, DNSCacheHit, nil
+		case entry.err == nil && now.Before(entry.expires.Add(c.staleWhileRevalidate)):
+			if !entry.refreshing {
+				entry.refreshing = true
+				go c.refresh(host, entry)
+			}
+			c.mu.Unlock()
+			c.staleHits.Add(1)
+			return entry.addrs, DNSCacheStaleHit, nil
+		}
+	}
+
+	entry = &dnsCacheEntry{lookup: make(chan struct{})}
+	c.entries[host] = entry
+	c.mu.Unlock()
+	c.misses.Add(1)
+
+	// the lookup is shared with the requests waiting for it, the caller giving up must not fail them
+	go c.resolve(context.WithoutCancel(ctx), host, entry)
+	return c.wait(ctx, entry)
+}
+
+// wait returns the result of the lookup of entry, or the error of ctx if it's done first.
+func (c *DNSCache) wait(ctx context.Context, entry *dnsCacheEntry) ([]string, DNSCacheResult, error) {
+	select {
+	case <-entry.lookup:
+		return entry.addrs, DNSCacheMiss, entry.err
+	case <-ctx.Done():
+		return nil, DNSCacheMiss, ctx.Err()
+	}
+}
+
+// resolve looks host up for entry, ctx only carries values and is bounded by dnsLookupTimeout.
+func (c *DNSCache) resolve(ctx context.Context, host string, entry *dnsCacheEntry) {
+	ctx, cancel := context.WithTimeout(ctx, dnsLookupTimeout)
+	defer cancel()
+	addrs, err := c.lookupHost(ctx, host)
+
+	c.mu.Lock()
+	c.resolved(entry, addrs, err)
+	if err != nil && c.negativeTTL < 0 && c.entries[host] == entry {
+		delete(c.entries, host)
+	}
+	c.mu.Unlock()
+	close(entry.lookup)
+}
+
+// refresh resolves host in the background, the stale entry is kept if the lookup fails.
+func (c *DNSCache) refresh(host string, stale *dnsCacheEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+	addrs, err := c.lookupHost(ctx, host)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stale.refreshing = false
+	if err != nil {
+		c.errors.Add(1)
+		return
+	}
+	if c.entries[host] != stale {
+		return
+	}
+	entry := &dnsCacheEntry{lookup: make(chan struct{})}
+	c.resolved(entry, addrs, nil)
+	close(entry.lookup)
+	c.entries[host] = entry
+}
+
+// resolved sets the result of the lookup of entry, it must be called with mu held.
+func (c *DNSCache) resolved(entry *dnsCacheEntry, addrs []string, err error) {
+	entry.addrs, entry.err = addrs, err
+	if err != nil {
+		c.errors.Add(1)
+		entry.expires = c.now().Add(c.negativeTTL)
+		return
+	}
+	entry.expires = c.now().Add(c.ttl)
+}
+
+// dialContext returns a dial function resolving the hosts with the cache, and dialing their addresses with dialer.
+func (c *DNSCache) dialContext(dialer *net.Dialer) dialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		if dialer.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, dialer.Timeout)
+			defer cancel()
+		}
+
+		addrs, result, err := c.lookup(ctx, host)
+		if armCtx := armRequestContextFrom(ctx); armCtx != nil {
+			armCtx.dnsCacheResult.Store(result)
+		}
+		if err != nil {
+			// as the dialer does, transportErrorCode recognizes the *net.DNSError
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+		primaries, fallbacks := partitionAddrs(addrs)
+		if len(fallbacks) == 0 || c.fallbackDelay < 0 {
+			return dialSerial(ctx, dialer, network, port, append(primaries, fallbacks...))
+		}
+		return dialParallel(ctx, dialer, network, port, primaries, fallbacks, c.fallbackDelay)
+	}
+}
+
+// partitionAddrs splits addrs into the addresses of the family of the first one, and the others.
+func partitionAddrs(addrs []string) (primaries, fallbacks []string) {
+	isIPv4 := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		return ip != nil && ip.To4() != nil
+	}
+	for _, addr := range addrs {
+		if len(primaries) == 0 || isIPv4(addr) == isIPv4(primaries[0]) {
+			primaries = append(primaries, addr)
+		} else {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+	return primaries, fallbacks
+}
+
+// dialSerial dials the addresses in order, it returns the first connection established or the first error.
+func dialSerial(ctx context.Context, dialer *net.Dialer, network, port string, addrs []string) (net.Conn, error) {
+	var firstErr error
+	for _, addr := range addrs {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = &net.OpError{Op: "dial", Net: network, Err: errors.New("no addresses")}
+	}
+	return nil, firstErr
+}
+
+// dialParallel races the dial of the primary addresses against the dial of the fallback ones, started after
+// fallbackDelay or as soon as the primary ones failed.
+func dialParallel(ctx context.Context, dialer *net.Dialer, network, port string, primaries, fallbacks []string, fallbackDelay time.Duration) (net.Conn, error) {
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult)
+	dial := func(addrs []string, primary bool) {
+		conn, err := dialSerial(ctx, dialer, network, port, addrs)
+		select {
+		case results <- dialResult{conn: conn, err: err, primary: primary}:
+		case <-ctx.Done():
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+	go dial(primaries, true)
+
+	fallbackTimer := time.NewTimer(fallbackDelay)
+	defer fallbackTimer.Stop()
+
+	var primaryErr error
+	fallbackStarted, pending := false, 1
+	for {
+		select {
+		case <-ctx.Done():
+			// the dials still running give up too, their connections are closed
+			return nil, &net.OpError{Op: "dial", Net: network, Err: ctx.Err()}
+		case <-fallbackTimer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				go dial(fallbacks, false)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				return res.conn, nil
+			}
+			if res.primary {
+				primaryErr = res.err
+			}
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				go dial(fallbacks, false)
+			}
+			if pending == 0 {
+				if primaryErr != nil {
+					return nil, primaryErr
+				}
+				return nil, res.err
+			}
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSCache(t *testing.T) {
+	newCache := func(opts DNSCacheOptions) (*DNSCache, *fakeResolver, *time.Time) {
+		resolver := &fakeResolver{addrs: []string{"10.0.0.1"}}
+		opts.LookupHost = resolver.lookupHost
+		cache := NewDNSCache(&opts)
+		now := time.Now()
+		cache.now = func() time.Time { return now }
+		return cache, resolver, &now
+	}
+
+	t.Run("addresses are cached for the TTL", func(t *testing.T) {
+		cache, resolver, now := newCache(DNSCacheOptions{TTL: time.Minute})
+		for range 3 {
+			addrs, err := cache.LookupHost(context.Background(), "management.azure.com")
+			require.NoError(t, err)
+			assert.Equal(t, []string{"10.0.0.1"}, addrs)
+		}
+		assert.Equal(t, 1, resolver.lookupCount())
+
+		*now = now.Add(2 * time.Minute)
+		resolver.set([]string{"10.0.0.2"}, nil)
+		addrs, err := cache.LookupHost(context.Background(), "management.azure.com")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.0.0.2"}, addrs)
+		assert.Equal(t, DNSCacheStats{Hits: 2, Misses: 2}, cache.Stats())
+	})
+
+	t.Run("failed lookups are cached for the negative TTL", func(t *testing.T) {
+		cache, resolver, now := newCache(DNSCacheOptions{NegativeTTL: time.Second})
+		resolver.set(nil, &net.DNSError{Err: "no such host", Name: "nowhere", IsNotFound: true})
+
+		for range 2 {
+			_, err := cache.LookupHost(context.Background(), "nowhere")
+			var dnsErr *net.DNSError
+			require.ErrorAs(t, err, &dnsErr)
+		}
+		assert.Equal(t, 1, resolver.lookupCount())
+
+		*now = now.Add(2 * time.Second)
+		resolver.set([]string{"10.0.0.1"}, nil)
+		addrs, err := cache.LookupHost(context.Background(), "nowhere")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.0.0.1"}, addrs)
+		assert.Equal(t, DNSCacheStats{NegativeHits: 1, Misses: 2, Errors: 1}, cache.Stats())
+	})
+
+	t.Run("negative caching can be disabled", func(t *testing.T) {
+		cache, resolver, _ := newCache(DNSCacheOptions{NegativeTTL: -1})
+		resolver.set(nil, errors.New("boom"))
+		for range 2 {
+			_, err := cache.LookupHost(context.Background(), "nowhere")
+			require.Error(t, err)
+		}
+		assert.Equal(t, 2, resolver.lookupCount())
+	})
+
+	t.Run("lookups are not canceled with the caller that started them", func(t *testing.T) {
+		release := make(chan struct{})
+		cache := NewDNSCache(&DNSCacheOptions{
+			LookupHost: func(ctx context.Context, host string) ([]string, error) {
+				select {
+				case <-release:
+					return []string{"10.0.0.1"}, nil
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			},
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		started := make(chan error)
+		go func() {
+			_, err := cache.LookupHost(ctx, "management.azure.com")
+			started <- err
+		}()
+		assert.Eventually(t, func() bool { return cache.Stats().Misses == 1 }, 5*time.Second, time.Millisecond)
+
+		waited := make(chan error)
+		go func() {
+			addrs, err := cache.LookupHost(context.Background(), "management.azure.com")
+			assert.Equal(t, []string{"10.0.0.1"}, addrs)
+			waited <- err
+		}()
+		assert.Eventually(t, func() bool { return cache.Stats().Misses == 2 }, 5*time.Second, time.Millisecond)
+
+		cancel()
+		assert.ErrorIs(t, <-started, context.Canceled)
+		close(release)
+		assert.NoError(t, <-waited)
+
+		addrs, result, err := cache.lookup(context.Background(), "management.azure.com")
+		require.NoError(t, err)
+		assert.Equal(t, DNSCacheHit, result)
+		assert.Equal(t, []string{"10.0.0.1"}, addrs)
+		assert.Equal(t, DNSCacheStats{Hits: 1, Misses: 2}, cache.Stats())
+	})
+
+	t.Run("stale addresses are served while revalidated", func(t *testing.T) {
+		cache, resolver, now := newCache(DNSCacheOptions{TTL: time.Minute, StaleWhileRevalidate: time.Minute})
+		_, err := cache.LookupHost(context.Background(), "management.azure.com")
+		require.NoError(t, err)
+
+		*now = now.Add(90 * time.Second)
+		resolver.set([]string{"10.0.0.2"}, nil)
+		addrs, result, err := cache.lookup(context.Background(), "management.azure.com")
+		require.NoError(t, err)
+		assert.Equal(t, DNSCacheStaleHit, result)
+		assert.Equal(t, []string{"10.0.0.1"}, addrs)
+
+		assert.Eventually(t, func() bool {
+			addrs, result, err := cache.lookup(context.Background(), "management.azure.com")
+			return err == nil && result == DNSCacheHit && addrs[0] == "10.0.0.2"
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, 2, resolver.lookupCount())
+
+		// past the stale window the lookup is synchronous
+		*now = now.Add(3 * time.Minute)
+		_, result, err = cache.lookup(context.Background(), "management.azure.com")
+		require.NoError(t, err)
+		assert.Equal(t, DNSCacheMiss, result)
+	})
+
+	t.Run("concurrent lookups of a host are resolved once", func(t *testing.T) {
+		release := make(chan struct{})
+		var lookups atomic.Int32
+		cache := NewDNSCache(&DNSCacheOptions{
+			LookupHost: func(ctx context.Context, host string) ([]string, error) {
+				lookups.Add(1)
+				<-release
+				return []string{"10.0.0.1"}, nil
+			},
+		})
+
+		var wg sync.WaitGroup
+		for range 5 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				addrs, err := cache.LookupHost(context.Background(), "management.azure.com")
+				assert.NoError(t, err)
+				assert.Equal(t, []string{"10.0.0.1"}, addrs)
+			}()
+		}
+		assert.Eventually(t, func() bool { return cache.Stats().Misses == 5 }, 5*time.Second, time.Millisecond)
+		close(release)
+		wg.Wait()
+		assert.Equal(t, int32(1), lookups.Load())
+	})
+
+	t.Run("addresses are partitioned by family", func(t *testing.T) {
+		primaries, fallbacks := partitionAddrs([]string{"2001:db8::1", "10.0.0.1", "2001:db8::2", "10.0.0.2"})
+		assert.Equal(t, []string{"2001:db8::1", "2001:db8::2"}, primaries)
+		assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, fallbacks)
+	})
+
+	t.Run("the fallback family is dialed when the first one fails", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer ln.Close()
+		go func() {
+			if conn, err := ln.Accept(); err == nil {
+				conn.Close()
+			}
+		}()
+		port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+		conn, err := dialParallel(context.Background(), &net.Dialer{}, "tcp", port, []string{"::1"}, []string{"127.0.0.1"}, time.Minute)
+		require.NoError(t, err)
+		defer conn.Close()
+		assert.Equal(t, ln.Addr().String(), conn.RemoteAddr().String())
+	})
+
+	t.Run("the dials end with the context", func(t *testing.T) {
+		// both families are still dialing when the context expires
+		dialer := &net.Dialer{ControlContext: func(ctx context.Context, network, address string, c syscall.RawConn) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		done := make(chan error, 1)
+		go func() {
+			_, err := dialParallel(ctx, dialer, "tcp", "443", []string{"2001:db8::1"}, []string{"192.0.2.1"}, time.Millisecond)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the dial did not end with its context")
+		}
+	})
+
+	t.Run("lookup results are reported to the collector", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer ts.Close()
+		port := strconv.Itoa(ts.Listener.Addr().(*net.TCPAddr).Port)
+
+		cache := NewDNSCache(&DNSCacheOptions{
+			LookupHost: func(ctx context.Context, host string) ([]string, error) {
+				if host != "example.com" {
+					return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+				}
+				return []string{"127.0.0.1"}, nil
+			},
+		})
+
+		var results []DNSCacheResult
+		var codes []ArmErrorCode
+		collector := &testCollector{
+			requestStarted: func(iReq *RequestInfo) {},
+			requestCompleted: func(iReq *RequestInfo, iResp *ResponseInfo) {
+				results = append(results, iResp.DNSCacheResult)
+				if iResp.Error != nil {
+					codes = append(codes, iResp.Error.Code)
+				}
+			},
+		}
+		send := func(url string) error {
+			// a new client, so that a connection is dialed
+			opts := DefaultHTTPClientOptions()
+			opts.TLSClientConfig = ts.Client().Transport.(*http.Transport).TLSClientConfig
+			opts.DNSCache = cache
+			client, err := NewHTTPClient(opts)
+			require.NoError(t, err)
+			pl := runtime.NewPipeline("test", "v1", runtime.PipelineOptions{}, &policy.ClientOptions{
+				Transport:        client,
+				Retry:            policy.RetryOptions{MaxRetries: -1},
+				PerRetryPolicies: []policy.Policy{&ArmRequestMetricPolicy{Collector: collector}},
+			})
+			req, err := runtime.NewRequest(context.Background(), http.MethodGet, url)
+			require.NoError(t, err)
+			resp, err := pl.Do(req)
+			if err != nil {
+				return err
+			}
+			return resp.Body.Close()
+		}
+
+		// example.com is in the certificate of the test server
+		require.NoError(t, send("https://example.com:"+port))
+		require.NoError(t, send("https://example.com:"+port))
+		require.Error(t, send("https://nowhere.example:"+port))
+		assert.Equal(t, []DNSCacheResult{DNSCacheMiss, DNSCacheHit, DNSCacheMiss}, results)
+		assert.Equal(t, []ArmErrorCode{ArmErrorCodeDNSError}, codes)
+	})
+}
+
+type fakeResolver struct {
+	mu      sync.Mutex
+	lookups int
+	addrs   []string
+	err     error
+}
+
+func (r *fakeResolver) lookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	return r.addrs, r.err
+}
+
+func (r *fakeResolver) set(addrs []string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addrs, r.err = addrs, err
+}
+
+func (r *fakeResolver) lookupCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups
+}
@@ -0,0 +1,299 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+
+	"github.com/Azure/azure-sdk-for-go-extensions/internal/redact"
+)
+
+// DefaultDumpMaxBodySize is the number of bytes of the bodies dumped by default.
+const DefaultDumpMaxBodySize = 64 * 1024
+
+// DumpedExchange is a request and its response, as dumped by DumpPolicy.
+// The URL, headers and bodies are redacted like the recordings of the Recorder.
+type DumpedExchange struct {
+	Time    time.Time     `json:"time"`
+	Latency time.Duration `json:"latency"`
+	// Attempt is the number of the try of the operation, starting at 1.
+	Attempt int `json:"attempt"`
+
+	Method        string      `json:"method"`
+	URL           string      `json:"url"`
+	RequestHeader http.Header `json:"requestHeader,omitempty"`
+	RequestBody   string      `json:"requestBody,omitempty"`
+	// RequestBodyTruncated tells if the request body is longer than DumpPolicyOptions.MaxBodySize.
+	RequestBodyTruncated bool `json:"requestBodyTruncated,omitempty"`
+
+	// StatusCode is 0 if the request failed with a transport error, see Error.
+	StatusCode     int         `json:"statusCode,omitempty"`
+	ResponseHeader http.Header `json:"responseHeader,omitempty"`
+	ResponseBody   string      `json:"responseBody,omitempty"`
+	// ResponseBodyTruncated tells if the response body is longer than DumpPolicyOptions.MaxBodySize.
+	ResponseBodyTruncated bool `json:"responseBodyTruncated,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+var _ slog.LogValuer = (*DumpedExchange)(nil)
+
+// LogValue implements slog.LogValuer, logging the fields of the exchange as a group.
+func (e *DumpedExchange) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.Time("time", e.Time),
+		slog.Duration("latency", e.Latency),
+		slog.Int("attempt", e.Attempt),
+		slog.String("method", e.Method),
+		slog.String("url", e.URL),
+		slog.Any("requestHeader", e.RequestHeader),
+		slog.String("requestBody", e.RequestBody),
+		slog.Bool("requestBodyTruncated", e.RequestBodyTruncated),
+		slog.Int("statusCode", e.StatusCode),
+		slog.Any("responseHeader", e.ResponseHeader),
+		slog.String("responseBody", e.ResponseBody),
+		slog.Bool("responseBodyTruncated", e.ResponseBodyTruncated),
+	}
+	if e.Error != "" {
+		attrs = append(attrs, slog.String("error", e.Error))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// DumpSink receives the exchanges dumped by DumpPolicy. It's called by the goroutine sending the request.
+type DumpSink interface {
+	Dump(ctx context.Context, exchange *DumpedExchange) error
+}
+
+// DumpPolicyOptions configures a DumpPolicy.
+type DumpPolicyOptions struct {
+	// Sink receives the dumped exchanges, it's required.
+	Sink DumpSink
+	// Enabled is the initial state of the policy, see DumpPolicy.SetEnabled.
+	Enabled bool
+	// MaxBodySize is the number of bytes of the bodies that are dumped, DefaultDumpMaxBodySize is used if zero.
+	// The bodies are not dumped if it's negative.
+	MaxBodySize int
+	// OnSinkError is called with the errors of the sink, they are ignored if nil. Dumping never fails the request.
+	OnSinkError func(error)
+}
+
+// DumpPolicy is a policy that dumps the requests and their responses, for debugging.
+// It's meant to be added to the PerRetryPolicies, and to be enabled briefly, e.g. in production while
+// investigating an issue: it reads the bodies up to DumpPolicyOptions.MaxBodySize, and the redaction is best effort.
+type DumpPolicy struct {
+	opts    DumpPolicyOptions
+	enabled atomic.Bool
+}
+
+// NewDumpPolicy returns a new DumpPolicy, it panics if opts has no Sink.
+func NewDumpPolicy(opts DumpPolicyOptions) *DumpPolicy {
+	if opts.Sink == nil {
+		panic("middleware: DumpPolicyOptions.Sink is required")
+	}
+	if opts.MaxBodySize == 0 {
+		opts.MaxBodySize = DefaultDumpMaxBodySize
+	}
+	p := &DumpPolicy{opts: opts}
+	p.enabled.Store(opts.Enabled)
+	return p
+}
+
+// SetEnabled turns the dumps on or off, it can be called while requests are sent.
+func (p *DumpPolicy) SetEnabled(enabled bool) {
+	p.enabled.Store(enabled)
+}
+
+// Enabled tells if the requests are dumped.
+func (p *DumpPolicy) Enabled() bool {
+	return p.enabled.Load()
+}
+
+// Do implements the azcore/policy.Policy interface.
+func (p *DumpPolicy) Do(req *policy.Request) (*http.Response, error) {
+	httpReq := req.Raw()
+	if !p.Enabled() || httpReq == nil || httpReq.URL == nil {
+		return req.Next()
+	}
+
+	attempt, exitTry := enterTry(req)
+	defer exitTry()
+	exchange := &DumpedExchange{
+		Time:          time.Now(),
+		Attempt:       attempt,
+		Method:        httpReq.Method,
+		URL:           redact.URL(httpReq.URL, redact.URLOptions{MaskGUIDs: true}),
+		RequestHeader: redactHeader(httpReq.Header, requestHeadersToRemove, dumpHeadersToRemove),
+	}
+	if body := req.Body(); body != nil && p.opts.MaxBodySize > 0 {
+		prefix, err := readPrefix(body, p.opts.MaxBodySize)
+		if rewindErr := req.RewindBody(); rewindErr != nil {
+			return nil, rewindErr
+		}
+		if err == nil {
+			exchange.RequestBody, exchange.RequestBodyTruncated = p.dumpedBody(prefix)
+		}
+	}
+
+	resp, err := req.Next()
+	exchange.Latency = time.Since(exchange.Time)
+	if err != nil {
+		exchange.Error = err.Error()
+	}
+	if resp != nil {
+		exchange.StatusCode = resp.StatusCode
+		exchange.ResponseHeader = redactHeader(resp.Header, responseHeadersToRemove, dumpHeadersToRemove)
+		if resp.Body != nil && resp.Body != http.NoBody && p.opts.MaxBodySize > 0 {
+			// the body may be streamed, only its first bytes are read, they are put back in front of it
+			prefix, readErr := readPrefix(resp.Body, p.opts.MaxBodySize)
+			resp.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(prefix), errReader{readErr}, resp.Body), Closer: resp.Body}
+			exchange.ResponseBody, exchange.ResponseBodyTruncated = p.dumpedBody(prefix)
+		}
+	}
+
+	if sinkErr := p.opts.Sink.Dump(httpReq.Context(), exchange); sinkErr != nil && p.opts.OnSinkError != nil {
+		p.opts.OnSinkError(sinkErr)
+	}
+	return resp, err
+}
+
+// readPrefix reads up to maxSize+1 bytes of r, the extra byte tells if the body is longer than maxSize.
+func readPrefix(r io.Reader, maxSize int) ([]byte, error) {
+	return io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+}
+
+// dumpedBody returns the redacted body to dump from its prefix, and if it's truncated.
+func (p *DumpPolicy) dumpedBody(prefix []byte) (string, bool) {
+	if len(prefix) > p.opts.MaxBodySize {
+		return hideRecordingData(string(prefix[:p.opts.MaxBodySize])), true
+	}
+	return hideRecordingData(string(prefix)), false
+}
+
+// errReader returns err, or io.EOF if err is nil.
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	return 0, io.EOF
+}
+
+// dumpHeadersToRemove are the credentials removed from the dumps on top of the headers removed from the recordings:
+// the dumps come from live traffic, which may carry more of them than the tests.
+var dumpHeadersToRemove = []string{
+	// tokens for the tenants of the other resources of a cross-tenant request
+	"X-Ms-Authorization-Auxiliary",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+}
+
+// redactHeader returns a copy of header without the headers to remove, and with the UUIDs of the values hidden.
+func redactHeader(header http.Header, headersToRemove ...[]string) http.Header {
+	redacted := header.Clone()
+	for _, keys := range headersToRemove {
+		for _, key := range keys {
+			redacted.Del(key)
+		}
+	}
+	for _, values := range redacted {
+		for i := range values {
+			values[i] = redact.HideUUIDs(values[i])
+		}
+	}
+	return redacted
+}
+
+// FileDumpSink writes each exchange as JSON to a file of its directory.
+type FileDumpSink struct {
+	dir string
+	seq atomic.Int64
+}
+
+// NewFileDumpSink returns a sink that writes the exchanges to dir, which is created if needed.
+func NewFileDumpSink(dir string) (*FileDumpSink, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating the dump directory: %w", err)
+	}
+	return &FileDumpSink{dir: dir}, nil
+}
+
+// Dump implements DumpSink, the files are named after the time and method of the request,
+// e.g. 20240102T150405.000000000Z-000001-GET.json.
+func (s *FileDumpSink) Dump(ctx context.Context, exchange *DumpedExchange) error {
+	data, err := json.MarshalIndent(exchange, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%06d-%s.json", exchange.Time.UTC().Format("20060102T150405.000000000Z"), s.seq.Add(1), exchange.Method)
+	return os.WriteFile(filepath.Join(s.dir, name), data, 0o600)
+}
+
+// RingDumpSink keeps the last exchanges in memory.
+type RingDumpSink struct {
+	exchanges *ringBuffer[*DumpedExchange]
+}
+
+// NewRingDumpSink returns a sink that keeps the last size exchanges, it panics if size is not positive.
+func NewRingDumpSink(size int) *RingDumpSink {
+	if size <= 0 {
+		panic("middleware: the size of a RingDumpSink must be positive")
+	}
+	return &RingDumpSink{exchanges: newRingBuffer[*DumpedExchange](size)}
+}
+
+// Dump implements DumpSink.
+func (s *RingDumpSink) Dump(ctx context.Context, exchange *DumpedExchange) error {
+	s.exchanges.add(exchange)
+	return nil
+}
+
+// Exchanges returns the exchanges kept, the oldest first.
+func (s *RingDumpSink) Exchanges() []*DumpedExchange {
+	return s.exchanges.all()
+}
+
+// SlogDumpSink logs the exchanges.
+type SlogDumpSink struct {
+	logger *slog.Logger
+	level  slog.Level
+}
+
+// NewSlogDumpSink returns a sink that logs the exchanges with logger at level, under the "exchange" key.
+func NewSlogDumpSink(logger *slog.Logger, level slog.Level) *SlogDumpSink {
+	return &SlogDumpSink{logger: logger, level: level}
+}
+
+// Dump implements DumpSink.
+func (s *SlogDumpSink) Dump(ctx context.Context, exchange *DumpedExchange) error {
+	s.logger.LogAttrs(ctx, s.level, "http exchange", slog.Any("exchange", exchange))
+	return nil
+}
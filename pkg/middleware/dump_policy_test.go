@@ -0,0 +1,198 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const dumpTestSubscriptionID = "0a1b2c3d-1234-5678-9abc-def012345678"
+
+func TestDumpPolicy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ms-Request-Id", "request-id")
+		w.Header().Set("X-Ms-Operation", dumpTestSubscriptionID)
+		w.Header().Set("Set-Cookie", "session=secret")
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		_, _ = w.Write([]byte(`{"id": "/subscriptions/` + dumpTestSubscriptionID + `/resourceGroups/rg", "padding": "` + strings.Repeat(".", 100) + `"}`))
+	}))
+	defer ts.Close()
+
+	send := func(t *testing.T, dump *DumpPolicy, method, url, body string, retries int32) *http.Response {
+		pl := runtime.NewPipeline("test", "v1", runtime.PipelineOptions{}, &policy.ClientOptions{
+			Transport:        ts.Client(),
+			Retry:            policy.RetryOptions{MaxRetries: retries, RetryDelay: 1, StatusCodes: []int{http.StatusInternalServerError}},
+			PerRetryPolicies: []policy.Policy{dump},
+		})
+		req, err := runtime.NewRequest(context.Background(), method, url)
+		require.NoError(t, err)
+		req.Raw().Header.Set("Authorization", "Bearer secret")
+		req.Raw().Header.Set("X-Ms-Authorization-Auxiliary", "Bearer auxiliary-secret")
+		req.Raw().Header.Set("Proxy-Authorization", "Basic secret")
+		req.Raw().Header.Set("Cookie", "session=secret")
+		if body != "" {
+			require.NoError(t, req.SetBody(streaming.NopCloser(strings.NewReader(body)), "application/json"))
+		}
+		resp, err := pl.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("exchanges are redacted", func(t *testing.T) {
+		sink := NewRingDumpSink(10)
+		dump := NewDumpPolicy(DumpPolicyOptions{Sink: sink, Enabled: true})
+		url := ts.URL + "/subscriptions/" + dumpTestSubscriptionID + "?api-version=2024-01-01&sig=secret"
+		send(t, dump, http.MethodPut, url, `{"adminPassword": "secret"}`, -1)
+
+		exchanges := sink.Exchanges()
+		require.Len(t, exchanges, 1)
+		exchange := exchanges[0]
+		assert.Equal(t, 1, exchange.Attempt)
+		assert.Equal(t, http.MethodPut, exchange.Method)
+		assert.Equal(t, ts.URL+"/subscriptions/00000000-0000-0000-0000-000000000000?api-version=2024-01-01&sig=REDACTED", exchange.URL)
+		assert.Empty(t, exchange.RequestHeader.Get("Authorization"))
+		assert.Empty(t, exchange.RequestHeader.Get("X-Ms-Authorization-Auxiliary"))
+		assert.Empty(t, exchange.RequestHeader.Get("Proxy-Authorization"))
+		assert.Empty(t, exchange.RequestHeader.Get("Cookie"))
+		assert.Empty(t, exchange.ResponseHeader.Get("Set-Cookie"))
+		assert.Equal(t, "application/json", exchange.RequestHeader.Get("Content-Type"))
+		assert.NotContains(t, exchange.RequestBody, "secret")
+		assert.Equal(t, http.StatusOK, exchange.StatusCode)
+		assert.Empty(t, exchange.ResponseHeader.Get("X-Ms-Request-Id"))
+		assert.Equal(t, "00000000-0000-0000-0000-000000000000", exchange.ResponseHeader.Get("X-Ms-Operation"))
+		assert.NotContains(t, exchange.ResponseBody, dumpTestSubscriptionID)
+		assert.False(t, exchange.ResponseBodyTruncated)
+	})
+
+	t.Run("bodies are truncated, the response body is left intact", func(t *testing.T) {
+		sink := NewRingDumpSink(10)
+		dump := NewDumpPolicy(DumpPolicyOptions{Sink: sink, Enabled: true, MaxBodySize: 10})
+		resp := send(t, dump, http.MethodPut, ts.URL, `{"location": "westus"}`, -1)
+		body, err := runtime.Payload(resp)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), strings.Repeat(".", 100))
+
+		exchange := sink.Exchanges()[0]
+		assert.Equal(t, `{"location`, exchange.RequestBody)
+		assert.True(t, exchange.RequestBodyTruncated)
+		assert.Equal(t, `{"id": "/s`, exchange.ResponseBody)
+		assert.True(t, exchange.ResponseBodyTruncated)
+	})
+
+	t.Run("the policy is toggled at runtime", func(t *testing.T) {
+		sink := NewRingDumpSink(10)
+		dump := NewDumpPolicy(DumpPolicyOptions{Sink: sink})
+		send(t, dump, http.MethodGet, ts.URL, "", -1)
+		assert.Empty(t, sink.Exchanges())
+
+		dump.SetEnabled(true)
+		assert.True(t, dump.Enabled())
+		send(t, dump, http.MethodGet, ts.URL, "", -1)
+		assert.Len(t, sink.Exchanges(), 1)
+
+		dump.SetEnabled(false)
+		send(t, dump, http.MethodGet, ts.URL, "", -1)
+		assert.Len(t, sink.Exchanges(), 1)
+	})
+
+	t.Run("each try is dumped", func(t *testing.T) {
+		sink := NewRingDumpSink(10)
+		dump := NewDumpPolicy(DumpPolicyOptions{Sink: sink, Enabled: true})
+		send(t, dump, http.MethodGet, ts.URL+"?fail=true", "", 2)
+		exchanges := sink.Exchanges()
+		require.Len(t, exchanges, 3)
+		for i, exchange := range exchanges {
+			assert.Equal(t, i+1, exchange.Attempt)
+			assert.Equal(t, http.StatusInternalServerError, exchange.StatusCode)
+		}
+	})
+
+	t.Run("sink errors don't fail the request", func(t *testing.T) {
+		var sinkErr error
+		dump := NewDumpPolicy(DumpPolicyOptions{
+			Sink:        dumpSinkFunc(func(context.Context, *DumpedExchange) error { return errors.New("disk full") }),
+			Enabled:     true,
+			OnSinkError: func(err error) { sinkErr = err },
+		})
+		resp := send(t, dump, http.MethodGet, ts.URL, "", -1)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.EqualError(t, sinkErr, "disk full")
+	})
+}
+
+type dumpSinkFunc func(ctx context.Context, exchange *DumpedExchange) error
+
+func (f dumpSinkFunc) Dump(ctx context.Context, exchange *DumpedExchange) error {
+	return f(ctx, exchange)
+}
+
+func TestDumpSinks(t *testing.T) {
+	exchange := func(method string) *DumpedExchange {
+		return &DumpedExchange{Method: method, URL: "https://management.azure.com/subscriptions", StatusCode: http.StatusOK}
+	}
+
+	t.Run("ring buffer keeps the last exchanges", func(t *testing.T) {
+		sink := NewRingDumpSink(2)
+		for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+			require.NoError(t, sink.Dump(context.Background(), exchange(method)))
+		}
+		exchanges := sink.Exchanges()
+		require.Len(t, exchanges, 2)
+		assert.Equal(t, http.MethodPut, exchanges[0].Method)
+		assert.Equal(t, http.MethodDelete, exchanges[1].Method)
+	})
+
+	t.Run("file per exchange", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "dumps")
+		sink, err := NewFileDumpSink(dir)
+		require.NoError(t, err)
+		require.NoError(t, sink.Dump(context.Background(), exchange(http.MethodGet)))
+		require.NoError(t, sink.Dump(context.Background(), exchange(http.MethodGet)))
+
+		files, err := filepath.Glob(filepath.Join(dir, "*-GET.json"))
+		require.NoError(t, err)
+		require.Len(t, files, 2)
+		data, err := os.ReadFile(files[0])
+		require.NoError(t, err)
+		var dumped DumpedExchange
+		require.NoError(t, json.Unmarshal(data, &dumped))
+		assert.Equal(t, *exchange(http.MethodGet), dumped)
+	})
+
+	t.Run("slog", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		sink := NewSlogDumpSink(logger, slog.LevelDebug)
+		require.NoError(t, sink.Dump(context.Background(), exchange(http.MethodGet)))
+
+		var record struct {
+			Level    string `json:"level"`
+			Exchange struct {
+				Method     string `json:"method"`
+				URL        string `json:"url"`
+				StatusCode int    `json:"statusCode"`
+			} `json:"exchange"`
+		}
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+		assert.Equal(t, "DEBUG", record.Level)
+		assert.Equal(t, http.MethodGet, record.Exchange.Method)
+		assert.Equal(t, "https://management.azure.com/subscriptions", record.Exchange.URL)
+		assert.Equal(t, http.StatusOK, record.Exchange.StatusCode)
+	})
+}
@@ -0,0 +1,180 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+var (
+	// ErrResponseHeaderTimeout is wrapped by the error of a request whose response headers were not received
+	// within HTTPClientOptions.ResponseHeaderTimeout.
+	ErrResponseHeaderTimeout = errors.New("timeout awaiting response headers")
+	// ErrBodyReadIdleTimeout is wrapped by the error of a read of an HTTP/1.1 response body that received nothing
+	// within HTTPClientOptions.BodyReadIdleTimeout.
+	ErrBodyReadIdleTimeout = errors.New("timeout awaiting response body")
+)
+
+type responseHeaderTimeoutKey struct{}
+
+// WithResponseHeaderTimeout returns a context that overrides HTTPClientOptions.ResponseHeaderTimeout
+// for the requests sent with it. Zero disables the timeout.
+func WithResponseHeaderTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, responseHeaderTimeoutKey{}, timeout)
+}
+
+// watchdogRoundTripper fails the requests stuck on a connection that silently stopped receiving data.
+// HTTP/2 connections are health checked with pings, see configureHttp2TransportPing, HTTP/1.1 ones are not:
+// without the watchdog such requests hang until the context deadline.
+type watchdogRoundTripper struct {
+	next                  http.RoundTripper
+	responseHeaderTimeout time.Duration
+	bodyReadIdleTimeout   time.Duration
+}
+
+func (t *watchdogRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	headerTimeout := t.responseHeaderTimeout
+	if timeout, ok := req.Context().Value(responseHeaderTimeoutKey{}).(time.Duration); ok {
+		headerTimeout = timeout
+	}
+	if headerTimeout <= 0 && t.bodyReadIdleTimeout <= 0 {
+		return t.next.RoundTrip(req)
+	}
+
+	// canceling the context of the request makes the transport close its connection
+	ctx, cancel := context.WithCancelCause(req.Context())
+	var timer *headerTimer
+	if headerTimeout > 0 {
+		timer = &headerTimer{timeout: headerTimeout, cancel: cancel}
+		ctx = httptrace.WithClientTrace(ctx, timer.trace())
+	}
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if timer != nil {
+		timer.stop()
+	}
+	if err != nil {
+		if cause := context.Cause(ctx); errors.Is(cause, ErrResponseHeaderTimeout) {
+			err = cause
+		}
+		cancel(nil)
+		return resp, err
+	}
+
+	if t.bodyReadIdleTimeout > 0 && resp.ProtoMajor == 1 {
+		resp.Body = newWatchedBody(ctx, cancel, resp.Body, t.bodyReadIdleTimeout)
+		return resp, nil
+	}
+	// the context is released once the body is read or closed
+	resp.Body = &monitoredBody{ReadCloser: resp.Body, done: func() { cancel(nil) }}
+	return resp, nil
+}
+
+// headerTimer cancels the request if its response headers are not received within timeout once it's written.
+// The time to get a connection and to write the body doesn't count, HTTP/2 requests are not timed.
+type headerTimer struct {
+	timeout time.Duration
+	cancel  context.CancelCauseFunc
+
+	mu    sync.Mutex
+	http1 bool
+	timer *time.Timer
+	done  bool
+}
+
+func (h *headerTimer) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			h.http1 = !isHTTP2Conn(info.Conn)
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			// the response may come before the body is written
+			if !h.http1 || h.done || info.Err != nil || h.timer != nil {
+				return
+			}
+			h.timer = time.AfterFunc(h.timeout, func() {
+				h.cancel(fmt.Errorf("%w after %s", ErrResponseHeaderTimeout, h.timeout))
+			})
+		},
+	}
+}
+
+// stop stops the timer once the response headers are received or the request failed.
+func (h *headerTimer) stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.done = true
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+}
+
+// isHTTP2Conn tells if conn negotiated HTTP/2, its streams are health checked with pings.
+func isHTTP2Conn(conn net.Conn) bool {
+	tlsConn, ok := conn.(interface{ ConnectionState() tls.ConnectionState })
+	return ok && tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS
+}
+
+// watchedBody cancels the request if a read is blocked for longer than timeout.
+// The time the caller spends between reads doesn't count.
+type watchedBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newWatchedBody(ctx context.Context, cancel context.CancelCauseFunc, body io.ReadCloser, timeout time.Duration) *watchedBody {
+	b := &watchedBody{ReadCloser: body, ctx: ctx, cancel: cancel, timeout: timeout}
+	b.timer = time.AfterFunc(timeout, func() {
+		cancel(fmt.Errorf("%w after %s", ErrBodyReadIdleTimeout, timeout))
+	})
+	b.timer.Stop()
+	return b
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	if err != nil && err != io.EOF {
+		if cause := context.Cause(b.ctx); errors.Is(cause, ErrBodyReadIdleTimeout) {
+			err = cause
+		}
+	}
+	return n, err
+}
+
+func (b *watchedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.timer.Stop()
+	b.cancel(nil)
+	return err
+}
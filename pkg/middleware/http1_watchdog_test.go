@@ -0,0 +1,196 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchdogRoundTripper(t *testing.T) {
+	// newServer starts an HTTP/1.1 server, its handlers are released when the test ends
+	newServer := func(t *testing.T, handler func(w http.ResponseWriter, release <-chan struct{})) *httptest.Server {
+		release := make(chan struct{})
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handler(w, release)
+		}))
+		t.Cleanup(ts.Close)
+		t.Cleanup(func() { close(release) })
+		return ts
+	}
+
+	newClient := func(t *testing.T, headerTimeout, readIdleTimeout time.Duration) *http.Client {
+		opts := DefaultHTTPClientOptions()
+		opts.ResponseHeaderTimeout = headerTimeout
+		opts.BodyReadIdleTimeout = readIdleTimeout
+		client, err := NewHTTPClient(opts)
+		require.NoError(t, err)
+		return client
+	}
+
+	get := func(ctx context.Context, client *http.Client, url string) (string, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	t.Run("response headers that don't come in time fail the request", func(t *testing.T) {
+		ts := newServer(t, func(w http.ResponseWriter, release <-chan struct{}) {
+			<-release
+		})
+		_, err := get(context.Background(), newClient(t, 50*time.Millisecond, 0), ts.URL)
+		require.ErrorIs(t, err, ErrResponseHeaderTimeout)
+		assert.Equal(t, ArmErrorCodeResponseHeaderTimeout, transportErrorCode(err, context.Background()))
+	})
+
+	t.Run("the response header timeout can be overridden per request", func(t *testing.T) {
+		ts := newServer(t, func(w http.ResponseWriter, release <-chan struct{}) {
+			time.Sleep(200 * time.Millisecond)
+			_, _ = w.Write([]byte("ok"))
+		})
+		client := newClient(t, 50*time.Millisecond, 0)
+		body, err := get(WithResponseHeaderTimeout(context.Background(), 0), client, ts.URL)
+		require.NoError(t, err)
+		assert.Equal(t, "ok", body)
+
+		_, err = get(WithResponseHeaderTimeout(context.Background(), 10*time.Millisecond), client, ts.URL)
+		require.ErrorIs(t, err, ErrResponseHeaderTimeout)
+	})
+
+	t.Run("a body that stops receiving data fails the read", func(t *testing.T) {
+		ts := newServer(t, func(w http.ResponseWriter, release <-chan struct{}) {
+			_, _ = w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			<-release
+		})
+		body, err := get(context.Background(), newClient(t, 0, 50*time.Millisecond), ts.URL)
+		require.ErrorIs(t, err, ErrBodyReadIdleTimeout)
+		assert.Equal(t, "partial", body)
+		assert.Equal(t, ArmErrorCodeBodyReadIdleTimeout, transportErrorCode(err, context.Background()))
+	})
+
+	t.Run("a slow body that keeps receiving data is read", func(t *testing.T) {
+		ts := newServer(t, func(w http.ResponseWriter, release <-chan struct{}) {
+			for range 5 {
+				_, _ = w.Write([]byte("."))
+				w.(http.Flusher).Flush()
+				time.Sleep(20 * time.Millisecond)
+			}
+		})
+		body, err := get(context.Background(), newClient(t, 0, 200*time.Millisecond), ts.URL)
+		require.NoError(t, err)
+		assert.Equal(t, ".....", body)
+	})
+
+	t.Run("the time between reads doesn't count", func(t *testing.T) {
+		ts := newServer(t, func(w http.ResponseWriter, release <-chan struct{}) {
+			_, _ = w.Write([]byte(strings.Repeat(".", 10)))
+		})
+		resp, err := newClient(t, 0, 20*time.Millisecond).Get(ts.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		time.Sleep(100 * time.Millisecond)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Len(t, body, 10)
+	})
+
+	t.Run("the upload of the body doesn't count", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.Copy(io.Discard, r.Body)
+			_, _ = w.Write([]byte("uploaded"))
+		}))
+		t.Cleanup(ts.Close)
+		req, err := http.NewRequest(http.MethodPut, ts.URL, &slowReader{chunks: 5, delay: 30 * time.Millisecond})
+		require.NoError(t, err)
+		resp, err := newClient(t, 50*time.Millisecond, 0).Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "uploaded", string(body))
+	})
+
+	t.Run("HTTP/2 requests are not timed", func(t *testing.T) {
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(100 * time.Millisecond)
+			_, _ = w.Write([]byte("h2"))
+		}))
+		ts.EnableHTTP2 = true
+		ts.StartTLS()
+		t.Cleanup(ts.Close)
+
+		opts := DefaultHTTPClientOptions()
+		opts.ResponseHeaderTimeout = 20 * time.Millisecond
+		opts.TLSClientConfig = ts.Client().Transport.(*http.Transport).TLSClientConfig
+		client, err := NewHTTPClient(opts)
+		require.NoError(t, err)
+		resp, err := client.Get(ts.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, 2, resp.ProtoMajor)
+	})
+
+	t.Run("the timeouts are opt-in", func(t *testing.T) {
+		opts := DefaultHTTPClientOptions()
+		assert.Zero(t, opts.ResponseHeaderTimeout)
+		assert.Zero(t, opts.BodyReadIdleTimeout)
+	})
+
+	t.Run("the timeouts are reported to the collector", func(t *testing.T) {
+		ts := newServer(t, func(w http.ResponseWriter, release <-chan struct{}) {
+			_, _ = w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			<-release
+		})
+		var codes []ArmErrorCode
+		collector := &testCollector{
+			requestStarted: func(iReq *RequestInfo) {},
+			requestCompleted: func(iReq *RequestInfo, iResp *ResponseInfo) {
+				if iResp.Error != nil {
+					codes = append(codes, iResp.Error.Code)
+				}
+			},
+		}
+		pl := runtime.NewPipeline("test", "v1", runtime.PipelineOptions{}, &policy.ClientOptions{
+			Transport:        newClient(t, 0, 50*time.Millisecond),
+			Retry:            policy.RetryOptions{MaxRetries: -1},
+			PerRetryPolicies: []policy.Policy{&ArmRequestMetricPolicy{Collector: collector}},
+		})
+		req, err := runtime.NewRequest(context.Background(), http.MethodGet, ts.URL)
+		require.NoError(t, err)
+		_, err = pl.Do(req)
+		require.ErrorIs(t, err, ErrBodyReadIdleTimeout)
+		assert.Equal(t, []ArmErrorCode{ArmErrorCodeBodyReadIdleTimeout}, codes)
+	})
+}
+
+// slowReader returns chunks bytes, one every delay.
+type slowReader struct {
+	chunks int
+	delay  time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if r.chunks == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.delay)
+	r.chunks--
+	p[0] = '.'
+	return 1, nil
+}
@@ -4,34 +4,162 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"slices"
+	"strings"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 )
 
+// QueryParameter is a query parameter set by QueryParameterPolicy.
+type QueryParameter struct {
+	Name  string
+	Value string
+	// ValueFunc, if set, returns the value of the parameter for the request in place of Value, e.g. from its context.
+	// The parameter is not set if ok is false.
+	ValueFunc func(req *http.Request) (value string, ok bool)
+	// Replace replaces the values the query already has for the parameter, the value is appended otherwise.
+	Replace bool
+}
+
+// value returns the value of the parameter for req, and if it must be set.
+func (p *QueryParameter) value(req *http.Request) (string, bool) {
+	if p.ValueFunc != nil {
+		return p.ValueFunc(req)
+	}
+	return p.Value, true
+}
+
+// QueryParameterPolicy sets query parameters on the requests.
+// Name, Value and Replace configure a single parameter, Parameters configure more of them.
 type QueryParameterPolicy struct {
 	Name    string
 	Value   string
 	Replace bool
+
+	// Parameters are set after the one of Name, in order.
+	Parameters []QueryParameter
+	// Remove are the names of the parameters removed from the query, before the parameters are set.
+	Remove []string
+	// Match, if set, restricts the policy to the requests it matches.
+	Match RequestMatcher
+}
+
+// parameters returns the parameters to set, including the one of Name.
+func (p *QueryParameterPolicy) parameters() []QueryParameter {
+	if p.Name == "" {
+		return p.Parameters
+	}
+	return append([]QueryParameter{{Name: p.Name, Value: p.Value, Replace: p.Replace}}, p.Parameters...)
 }
 
 func (p *QueryParameterPolicy) Do(req *policy.Request) (*http.Response, error) {
-	if !p.Replace {
-		// append behavior
-		if req.Raw().URL.RawQuery != "" {
-			req.Raw().URL.RawQuery += "&"
-		}
+	rawReq := req.Raw()
+	if p.Match != nil && !p.Match(rawReq) {
+		return req.Next()
+	}
 
-		req.Raw().URL.RawQuery += url.QueryEscape(p.Name) + "=" + url.QueryEscape(p.Value)
+	params := p.parameters()
+	if len(p.Remove) == 0 && !slices.ContainsFunc(params, func(param QueryParameter) bool { return param.Replace }) {
+		// append behavior, the query is not parsed and is kept as is
+		for _, param := range params {
+			value, ok := param.value(rawReq)
+			if !ok {
+				continue
+			}
+			if rawReq.URL.RawQuery != "" {
+				rawReq.URL.RawQuery += "&"
+			}
+			rawReq.URL.RawQuery += url.QueryEscape(param.Name) + "=" + url.QueryEscape(value)
+		}
 		return req.Next()
 	}
 
 	// replace behavior
-	originalQueryParams, err := url.ParseQuery(req.Raw().URL.RawQuery)
+	originalQueryParams, err := url.ParseQuery(rawReq.URL.RawQuery)
 	if err != nil {
 		return nil, fmt.Errorf("cannot replace url query parameter due to parsing err: %w", err)
 	}
 
-	originalQueryParams.Set(p.Name, p.Value)
-	req.Raw().URL.RawQuery = originalQueryParams.Encode()
+	for _, name := range p.Remove {
+		originalQueryParams.Del(name)
+	}
+	for _, param := range params {
+		value, ok := param.value(rawReq)
+		if !ok {
+			continue
+		}
+		if param.Replace {
+			originalQueryParams.Set(param.Name, value)
+		} else {
+			originalQueryParams.Add(param.Name, value)
+		}
+	}
+	rawReq.URL.RawQuery = originalQueryParams.Encode()
 	return req.Next()
 }
+
+// RequestMatcher tells if a policy applies to a request.
+type RequestMatcher func(req *http.Request) bool
+
+// MatchAll returns a matcher of the requests all matchers match.
+func MatchAll(matchers ...RequestMatcher) RequestMatcher {
+	return func(req *http.Request) bool {
+		for _, match := range matchers {
+			if !match(req) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// MatchAny returns a matcher of the requests any of matchers matches.
+func MatchAny(matchers ...RequestMatcher) RequestMatcher {
+	return func(req *http.Request) bool {
+		for _, match := range matchers {
+			if match(req) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchMethods returns a matcher of the requests with one of methods.
+func MatchMethods(methods ...string) RequestMatcher {
+	return func(req *http.Request) bool {
+		return slices.ContainsFunc(methods, func(method string) bool { return strings.EqualFold(method, req.Method) })
+	}
+}
+
+// MatchHost returns a matcher of the requests to host, compared case-insensitively.
+// The port is compared only if host has one.
+func MatchHost(host string) RequestMatcher {
+	return func(req *http.Request) bool {
+		if req.URL == nil {
+			return false
+		}
+		return strings.EqualFold(host, req.URL.Host) || strings.EqualFold(host, req.URL.Hostname())
+	}
+}
+
+// MatchPathPrefix returns a matcher of the requests whose URL path starts with prefix, compared case-insensitively
+// like ARM does, e.g. /subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg.
+func MatchPathPrefix(prefix string) RequestMatcher {
+	return func(req *http.Request) bool {
+		if req.URL == nil || len(req.URL.Path) < len(prefix) {
+			return false
+		}
+		return strings.EqualFold(prefix, req.URL.Path[:len(prefix)])
+	}
+}
+
+// MatchResourceTypes returns a matcher of the ARM requests for one of resourceTypes, compared case-insensitively,
+// e.g. Microsoft.Compute/virtualMachines. The resource type of a request is the one of ClassifyArmRequest:
+// lists match the type of the collection.
+func MatchResourceTypes(resourceTypes ...string) RequestMatcher {
+	return func(req *http.Request) bool {
+		resourceType := ClassifyArmRequest(req).ResourceType
+		return resourceType != "" && slices.ContainsFunc(resourceTypes, func(t string) bool { return strings.EqualFold(t, resourceType) })
+	}
+}
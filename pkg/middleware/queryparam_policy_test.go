@@ -2,10 +2,12 @@ package middleware
 
 import (
 	"context"
+	"net/http"
 	"testing"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestQueryPolicyAppend(t *testing.T) {
@@ -83,3 +85,143 @@ func TestQueryPolicyAppendEmpty(t *testing.T) {
 
 	assert.Equal(t, req.Raw().URL.RawQuery, "foo=bar")
 }
+
+type queryPolicyTestKey struct{}
+
+func TestQueryPolicyParameters(t *testing.T) {
+	t.Parallel()
+
+	fromContext := func(req *http.Request) (string, bool) {
+		value, ok := req.Context().Value(queryPolicyTestKey{}).(string)
+		return value, ok
+	}
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		rawQuery string
+		policy   QueryParameterPolicy
+		expected string
+	}{
+		{
+			name:     "parameters are appended in order",
+			rawQuery: "foo=boo",
+			policy: QueryParameterPolicy{
+				Name:       "a",
+				Value:      "1",
+				Parameters: []QueryParameter{{Name: "c", Value: "3"}, {Name: "b", Value: "2"}},
+			},
+			expected: "foo=boo&a=1&c=3&b=2",
+		},
+		{
+			name:     "parameters are appended and replaced",
+			rawQuery: "foo=boo&bar=baz",
+			policy: QueryParameterPolicy{
+				Parameters: []QueryParameter{{Name: "foo", Value: "bar", Replace: true}, {Name: "bar", Value: "qux"}},
+			},
+			expected: "bar=baz&bar=qux&foo=bar",
+		},
+		{
+			name:     "parameters are removed",
+			rawQuery: "foo=boo&$skiptoken=abc&bar=baz",
+			policy: QueryParameterPolicy{
+				Remove:     []string{"$skiptoken", "missing"},
+				Parameters: []QueryParameter{{Name: "foo", Value: "bar"}},
+			},
+			expected: "bar=baz&foo=boo&foo=bar",
+		},
+		{
+			name:     "values are evaluated per request",
+			ctx:      context.WithValue(context.Background(), queryPolicyTestKey{}, "from-context"),
+			rawQuery: "foo=boo",
+			policy: QueryParameterPolicy{
+				Parameters: []QueryParameter{{Name: "foo", ValueFunc: fromContext, Replace: true}},
+			},
+			expected: "foo=from-context",
+		},
+		{
+			name:     "parameters without a value are not set",
+			rawQuery: "foo=boo",
+			policy: QueryParameterPolicy{
+				Parameters: []QueryParameter{{Name: "foo", ValueFunc: fromContext, Replace: true}, {Name: "bar", ValueFunc: fromContext}},
+			},
+			expected: "foo=boo",
+		},
+		{
+			name:     "requests that don't match are left as is",
+			rawQuery: "foo=boo",
+			policy: QueryParameterPolicy{
+				Name:  "foo",
+				Value: "bar",
+				Match: MatchMethods(http.MethodGet),
+			},
+			expected: "foo=boo",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := tt.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			req, err := runtime.NewRequest(ctx, http.MethodPut, "http://:13333/?"+tt.rawQuery)
+			require.NoError(t, err)
+
+			// here we expect an error
+			_, err = tt.policy.Do(req)
+			assert.Error(t, err, "no more policies")
+
+			assert.Equal(t, tt.expected, req.Raw().URL.RawQuery)
+		})
+	}
+}
+
+func TestRequestMatchers(t *testing.T) {
+	t.Parallel()
+
+	const vmURL = "https://management.azure.com/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm?api-version=2024-07-01"
+
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		matcher  RequestMatcher
+		expected bool
+	}{
+		{name: "method", method: http.MethodGet, url: vmURL, matcher: MatchMethods(http.MethodPut, "get"), expected: true},
+		{name: "other method", method: http.MethodDelete, url: vmURL, matcher: MatchMethods(http.MethodPut, http.MethodGet)},
+		{name: "host", method: http.MethodGet, url: vmURL, matcher: MatchHost("Management.Azure.com"), expected: true},
+		{name: "host and port", method: http.MethodGet, url: "https://localhost:8443/", matcher: MatchHost("localhost:8443"), expected: true},
+		{name: "other port", method: http.MethodGet, url: "https://localhost:8443/", matcher: MatchHost("localhost:443")},
+		{name: "path prefix", method: http.MethodGet, url: vmURL, matcher: MatchPathPrefix("/subscriptions/sub/resourcegroups/RG"), expected: true},
+		{name: "other path prefix", method: http.MethodGet, url: vmURL, matcher: MatchPathPrefix("/subscriptions/other")},
+		{name: "resource type", method: http.MethodGet, url: vmURL, matcher: MatchResourceTypes("microsoft.compute/virtualmachines"), expected: true},
+		{
+			name:     "resource type of a list",
+			method:   http.MethodGet,
+			url:      "https://management.azure.com/subscriptions/sub/providers/Microsoft.Compute/virtualMachines?api-version=2024-07-01",
+			matcher:  MatchResourceTypes("Microsoft.Compute/virtualMachines"),
+			expected: true,
+		},
+		{name: "other resource type", method: http.MethodGet, url: vmURL, matcher: MatchResourceTypes("Microsoft.Compute/disks")},
+		{
+			name:     "all",
+			method:   http.MethodPut,
+			url:      vmURL,
+			matcher:  MatchAll(MatchMethods(http.MethodPut), MatchResourceTypes("Microsoft.Compute/virtualMachines")),
+			expected: true,
+		},
+		{name: "not all", method: http.MethodGet, url: vmURL, matcher: MatchAll(MatchMethods(http.MethodPut), MatchHost("management.azure.com"))},
+		{name: "any", method: http.MethodGet, url: vmURL, matcher: MatchAny(MatchMethods(http.MethodPut), MatchHost("management.azure.com")), expected: true},
+		{name: "none", method: http.MethodGet, url: vmURL, matcher: MatchAny(MatchMethods(http.MethodPut), MatchHost("example.com"))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.url, nil)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, tt.matcher(req))
+		})
+	}
+}
@@ -0,0 +1,246 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go-extensions/internal/redact"
+	armerrors "github.com/Azure/azure-sdk-for-go-extensions/pkg/errors"
+)
+
+// ArmRequestSummary is what RecentRequestsCollector keeps of a request.
+type ArmRequestSummary struct {
+	// Time is the time the request was sent.
+	Time    time.Time     `json:"time"`
+	Latency time.Duration `json:"latency"`
+	Attempt int           `json:"attempt"`
+	Method  string        `json:"method"`
+	// URL is the URL of the request, only the api-version is kept from its query.
+	URL string `json:"url"`
+
+	SubscriptionID    string           `json:"subscriptionId,omitempty"`
+	ResourceGroupName string           `json:"resourceGroupName,omitempty"`
+	ResourceType      string           `json:"resourceType,omitempty"`
+	ResourceName      string           `json:"resourceName,omitempty"`
+	OperationKind     ArmOperationKind `json:"operationKind,omitempty"`
+
+	// StatusCode is 0 if the request failed with a transport error.
+	StatusCode    int                     `json:"statusCode,omitempty"`
+	ErrorCode     ArmErrorCode            `json:"errorCode,omitempty"`
+	ErrorMessage  string                  `json:"errorMessage,omitempty"`
+	ErrorCategory armerrors.ErrorCategory `json:"errorCategory,omitempty"`
+	RequestID     string                  `json:"requestId,omitempty"`
+	CorrelationID string                  `json:"correlationId,omitempty"`
+}
+
+func newArmRequestSummary(iReq *RequestInfo, iResp *ResponseInfo) ArmRequestSummary {
+	summary := ArmRequestSummary{
+		Time:          time.Now().Add(-iResp.Latency),
+		Latency:       iResp.Latency,
+		Attempt:       iReq.Attempt,
+		RequestID:     iResp.RequestId,
+		CorrelationID: iResp.CorrelationId,
+		ErrorCategory: iResp.ErrorCategory,
+	}
+	if iReq.Request != nil && iReq.Request.URL != nil {
+		summary.Method = iReq.Request.Method
+		summary.URL = redact.URL(iReq.Request.URL, redact.URLOptions{StripQuery: true, AllowedQueryParams: []string{"api-version"}})
+	}
+	if c := iReq.Classification; c != nil {
+		summary.SubscriptionID = c.SubscriptionID
+		summary.ResourceGroupName = c.ResourceGroupName
+		summary.ResourceType = c.ResourceType
+		summary.ResourceName = c.ResourceName
+		summary.OperationKind = c.OperationKind
+	}
+	if iResp.Response != nil {
+		summary.StatusCode = iResp.Response.StatusCode
+	}
+	if iResp.Error != nil {
+		summary.ErrorCode = iResp.Error.Code
+		summary.ErrorMessage = iResp.Error.Message
+		if summary.StatusCode == 0 {
+			summary.StatusCode = iResp.Error.StatusCode
+		}
+	}
+	return summary
+}
+
+// failed tells if the request failed, with an error response, even without an ARM error, or a transport error.
+func (s *ArmRequestSummary) failed() bool {
+	return s.StatusCode == 0 || s.StatusCode >= http.StatusBadRequest || s.ErrorCode != ""
+}
+
+// RecentRequestsFilter selects the summaries returned by RecentRequestsCollector.Requests.
+// Zero values don't filter.
+type RecentRequestsFilter struct {
+	// StatusCodes are the status codes of the requests to return, 0 for the transport errors.
+	StatusCodes []int
+	// FailedOnly returns the requests that failed, with an error response or a transport error.
+	FailedOnly bool
+	// ErrorCodes are the ArmErrorCodes of the requests to return.
+	ErrorCodes []ArmErrorCode
+	// ResourceType is the resource type of the requests to return, e.g. Microsoft.Compute/virtualMachines.
+	// It's compared case-insensitively.
+	ResourceType string
+	// Since and Until bound the time the requests were sent.
+	Since time.Time
+	Until time.Time
+	// Limit is the maximum number of requests to return.
+	Limit int
+}
+
+func (f *RecentRequestsFilter) match(s *ArmRequestSummary) bool {
+	if len(f.StatusCodes) > 0 && !slices.Contains(f.StatusCodes, s.StatusCode) {
+		return false
+	}
+	if f.FailedOnly && !s.failed() {
+		return false
+	}
+	if len(f.ErrorCodes) > 0 && !slices.Contains(f.ErrorCodes, s.ErrorCode) {
+		return false
+	}
+	if f.ResourceType != "" && !strings.EqualFold(f.ResourceType, s.ResourceType) {
+		return false
+	}
+	if !f.Since.IsZero() && s.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && s.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// RecentRequestsCollector is an ArmRequestMetricCollector that keeps the summaries of the last requests,
+// to see the last ARM calls of a process during an incident. It's an http.Handler serving them as JSON,
+// e.g. for a debug endpoint.
+type RecentRequestsCollector struct {
+	requests *ringBuffer[ArmRequestSummary]
+}
+
+var (
+	_ ArmRequestMetricCollector = (*RecentRequestsCollector)(nil)
+	_ http.Handler              = (*RecentRequestsCollector)(nil)
+)
+
+// NewRecentRequestsCollector returns a collector that keeps the last size requests, it panics if size is not positive.
+func NewRecentRequestsCollector(size int) *RecentRequestsCollector {
+	if size <= 0 {
+		panic("middleware: the size of a RecentRequestsCollector must be positive")
+	}
+	return &RecentRequestsCollector{requests: newRingBuffer[ArmRequestSummary](size)}
+}
+
+// RequestStarted implements ArmRequestMetricCollector, the requests are kept once completed.
+func (c *RecentRequestsCollector) RequestStarted(*RequestInfo) {}
+
+// RequestCompleted implements ArmRequestMetricCollector.
+func (c *RecentRequestsCollector) RequestCompleted(iReq *RequestInfo, iResp *ResponseInfo) {
+	c.requests.add(newArmRequestSummary(iReq, iResp))
+}
+
+// Requests returns the summaries of the requests kept that match filter, the most recent first.
+func (c *RecentRequestsCollector) Requests(filter RecentRequestsFilter) []ArmRequestSummary {
+	all := c.requests.all()
+	result := []ArmRequestSummary{}
+	for i := len(all) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(result) == filter.Limit {
+			break
+		}
+		if filter.match(&all[i]) {
+			result = append(result, all[i])
+		}
+	}
+	return result
+}
+
+// ServeHTTP serves the requests kept as a JSON array, the most recent first. The query parameters filter them,
+// see RecentRequestsFilter:
+//   - status: comma-separated status codes, e.g. status=429,503
+//   - failed: true to return the failed requests only
+//   - errorCode: comma-separated ArmErrorCodes, e.g. errorCode=ResourceNotFound,TryTimeout
+//   - resourceType: e.g. resourceType=Microsoft.Compute/virtualMachines
+//   - since and until: RFC 3339 times, since also accepts a duration before now, e.g. since=15m
+//   - limit: the maximum number of requests
+func (c *RecentRequestsCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	filter, err := parseRecentRequestsFilter(r, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(c.Requests(filter))
+}
+
+func parseRecentRequestsFilter(r *http.Request, now time.Time) (RecentRequestsFilter, error) {
+	query := r.URL.Query()
+	var filter RecentRequestsFilter
+	for _, value := range splitQueryValues(query.Get("status")) {
+		status, err := strconv.Atoi(value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid status %q", value)
+		}
+		filter.StatusCodes = append(filter.StatusCodes, status)
+	}
+	if value := query.Get("failed"); value != "" {
+		failed, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid failed %q", value)
+		}
+		filter.FailedOnly = failed
+	}
+	for _, value := range splitQueryValues(query.Get("errorCode")) {
+		filter.ErrorCodes = append(filter.ErrorCodes, ArmErrorCode(value))
+	}
+	filter.ResourceType = query.Get("resourceType")
+	if value := query.Get("since"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			filter.Since = now.Add(-d)
+		} else if filter.Since, err = time.Parse(time.RFC3339, value); err != nil {
+			return filter, fmt.Errorf("invalid since %q, expected a duration or an RFC 3339 time", value)
+		}
+	}
+	if value := query.Get("until"); value != "" {
+		var err error
+		if filter.Until, err = time.Parse(time.RFC3339, value); err != nil {
+			return filter, fmt.Errorf("invalid until %q, expected an RFC 3339 time", value)
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return filter, fmt.Errorf("invalid limit %q", value)
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
+
+func splitQueryValues(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool { return r == ',' })
+}
@@ -0,0 +1,167 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecentRequestsCollector(t *testing.T) {
+	const vmsURL = "https://management.azure.com/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm?api-version=2024-07-01&$skiptoken=abc"
+	const aksURL = "https://management.azure.com/subscriptions/sub/resourceGroups/rg/providers/Microsoft.ContainerService/managedClusters/aks?api-version=2024-09-01"
+
+	complete := func(c *RecentRequestsCollector, method, rawURL string, statusCode int, code ArmErrorCode) {
+		req, err := http.NewRequest(method, rawURL, nil)
+		require.NoError(t, err)
+		iReq := newRequestInfo(req, nil)
+		iReq.Attempt = 1
+		iResp := &ResponseInfo{Latency: time.Millisecond, RequestId: "request-id"}
+		if statusCode != 0 {
+			iResp.Response = &http.Response{StatusCode: statusCode}
+		}
+		if code != "" {
+			iResp.Error = &ArmError{Code: code, Message: "failed", StatusCode: statusCode}
+		}
+		c.RequestStarted(iReq)
+		c.RequestCompleted(iReq, iResp)
+	}
+
+	newCollector := func() *RecentRequestsCollector {
+		c := NewRecentRequestsCollector(3)
+		complete(c, http.MethodGet, vmsURL, http.StatusOK, "")
+		complete(c, http.MethodPut, aksURL, http.StatusTooManyRequests, "TooManyRequests")
+		complete(c, http.MethodGet, vmsURL, 0, ArmErrorCodeConnectionReset)
+		complete(c, http.MethodDelete, vmsURL, http.StatusNotFound, "ResourceNotFound")
+		return c
+	}
+
+	t.Run("the last requests are kept, the most recent first", func(t *testing.T) {
+		requests := newCollector().Requests(RecentRequestsFilter{})
+		require.Len(t, requests, 3)
+		assert.Equal(t, http.MethodDelete, requests[0].Method)
+		assert.Equal(t, http.MethodGet, requests[1].Method)
+		assert.Equal(t, http.MethodPut, requests[2].Method)
+
+		summary := requests[0]
+		assert.Equal(t, "https://management.azure.com/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm?api-version=2024-07-01", summary.URL)
+		assert.Equal(t, "sub", summary.SubscriptionID)
+		assert.Equal(t, "rg", summary.ResourceGroupName)
+		assert.Equal(t, "Microsoft.Compute/virtualMachines", summary.ResourceType)
+		assert.Equal(t, "vm", summary.ResourceName)
+		assert.Equal(t, ArmOperationDelete, summary.OperationKind)
+		assert.Equal(t, http.StatusNotFound, summary.StatusCode)
+		assert.Equal(t, ArmErrorCode("ResourceNotFound"), summary.ErrorCode)
+		assert.Equal(t, "failed", summary.ErrorMessage)
+		assert.Equal(t, "request-id", summary.RequestID)
+		assert.Equal(t, 1, summary.Attempt)
+		assert.Equal(t, time.Millisecond, summary.Latency)
+		assert.WithinDuration(t, time.Now(), summary.Time, time.Minute)
+	})
+
+	t.Run("requests are filtered", func(t *testing.T) {
+		c := newCollector()
+		tests := []struct {
+			name    string
+			filter  RecentRequestsFilter
+			methods []string
+		}{
+			{
+				name:    "status codes",
+				filter:  RecentRequestsFilter{StatusCodes: []int{http.StatusTooManyRequests, 0}},
+				methods: []string{http.MethodGet, http.MethodPut},
+			},
+			{
+				name:    "failed",
+				filter:  RecentRequestsFilter{FailedOnly: true},
+				methods: []string{http.MethodDelete, http.MethodGet, http.MethodPut},
+			},
+			{
+				name:    "error codes",
+				filter:  RecentRequestsFilter{ErrorCodes: []ArmErrorCode{ArmErrorCodeConnectionReset}},
+				methods: []string{http.MethodGet},
+			},
+			{
+				name:    "resource type",
+				filter:  RecentRequestsFilter{ResourceType: "microsoft.containerservice/managedclusters"},
+				methods: []string{http.MethodPut},
+			},
+			{
+				name:    "time window",
+				filter:  RecentRequestsFilter{Since: time.Now().Add(time.Hour)},
+				methods: []string{},
+			},
+			{
+				name:    "limit",
+				filter:  RecentRequestsFilter{FailedOnly: true, Limit: 2},
+				methods: []string{http.MethodDelete, http.MethodGet},
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				methods := []string{}
+				for _, summary := range c.Requests(tt.filter) {
+					methods = append(methods, summary.Method)
+				}
+				assert.Equal(t, tt.methods, methods)
+			})
+		}
+	})
+
+	t.Run("error responses without an ARM error code are failed", func(t *testing.T) {
+		c := NewRecentRequestsCollector(3)
+		complete(c, http.MethodGet, vmsURL, http.StatusOK, "")
+		// a 500 with an empty body has no ARM error code
+		complete(c, http.MethodPut, vmsURL, http.StatusInternalServerError, "")
+		requests := c.Requests(RecentRequestsFilter{FailedOnly: true})
+		require.Len(t, requests, 1)
+		assert.Equal(t, http.MethodPut, requests[0].Method)
+		assert.Equal(t, http.StatusInternalServerError, requests[0].StatusCode)
+	})
+
+	t.Run("requests are served as JSON", func(t *testing.T) {
+		ts := httptest.NewServer(newCollector())
+		defer ts.Close()
+
+		get := func(query url.Values) (*http.Response, []ArmRequestSummary) {
+			resp, err := http.Get(ts.URL + "?" + query.Encode())
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			var requests []ArmRequestSummary
+			if resp.StatusCode == http.StatusOK {
+				assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&requests))
+			}
+			return resp, requests
+		}
+
+		resp, requests := get(url.Values{"status": {"404,429"}, "since": {"5m"}, "limit": {"1"}})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Len(t, requests, 1)
+		assert.Equal(t, http.MethodDelete, requests[0].Method)
+
+		resp, requests = get(url.Values{"errorCode": {"TooManyRequests"}, "resourceType": {"Microsoft.ContainerService/managedClusters"}})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Len(t, requests, 1)
+		assert.Equal(t, http.MethodPut, requests[0].Method)
+
+		resp, requests = get(url.Values{"failed": {"true"}, "until": {time.Now().Add(-time.Hour).Format(time.RFC3339)}})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, requests)
+
+		for _, query := range []url.Values{{"status": {"ok"}}, {"since": {"yesterday"}}, {"limit": {"-1"}}, {"failed": {"maybe"}}} {
+			resp, _ := get(query)
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+		}
+
+		resp, err := http.Post(ts.URL, "application/json", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+}
@@ -0,0 +1,176 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import (
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+
+	armerrors "github.com/Azure/azure-sdk-for-go-extensions/pkg/errors"
+)
+
+// DefaultRetryBackoff is the base delay per error category used by RetryBackoffPolicy.
+// Categories without a delay use the exponential backoff of policy.RetryOptions.
+var DefaultRetryBackoff = map[armerrors.ErrorCategory]time.Duration{
+	// throttling quotas of ARM refill over a minute or so, retrying sooner is throttled again
+	armerrors.ErrorCategoryThrottled: 10 * time.Second,
+	// AnotherOperationInProgress: operations on the resource usually take more than a few seconds to complete
+	armerrors.ErrorCategoryConflict: 15 * time.Second,
+}
+
+// DefaultMaxRetryBackoff caps the delay of RetryBackoffPolicy, it matches the default MaxRetryDelay of policy.RetryOptions.
+const DefaultMaxRetryBackoff = 60 * time.Second
+
+// retryStatusCodes are the status codes the retry policy of azcore retries by default,
+// ShouldRetryResponse only narrows them down.
+var retryStatusCodes = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// ShouldRetryResponse decides whether a request is retried based on the classification of the ARM error, to be used as
+// policy.RetryOptions.ShouldRetry. The status codes retried by default by azcore are retried unless the error is
+// permanent, e.g. SkuNotAvailable or quota errors fail fast. AnotherOperationInProgress and RetryableError are
+// retried whatever their status code. Transport errors are retried.
+func ShouldRetryResponse(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	_, retry := classifyRetry(resp)
+	return retry
+}
+
+// classifyRetry returns the category of a response and whether it should be retried.
+func classifyRetry(resp *http.Response) (armerrors.ErrorCategory, bool) {
+	if resp == nil || resp.StatusCode < http.StatusBadRequest {
+		return armerrors.ErrorCategoryUnknown, false
+	}
+	// the code of the ArmError falls back to the one of the body if the response has no x-ms-error-code header
+	armErr := responseArmError(resp)
+	category := armerrors.ClassifyError(armErr)
+	if armErr != nil && (armErr.Code == armerrors.AnotherOperationInProgressErrorCode || armErr.Code == armerrors.RetryableErrorCode) {
+		return category, true
+	}
+	if !slices.Contains(retryStatusCodes, resp.StatusCode) {
+		return category, false
+	}
+	switch category {
+	case armerrors.ErrorCategoryThrottled, armerrors.ErrorCategoryTransient, armerrors.ErrorCategoryUnknown:
+		return category, true
+	}
+	return category, false
+}
+
+// responseArmError returns the ArmError of resp, the one ArmRequestMetricPolicy already parsed if the request went
+// through it, so that the response is classified once.
+func responseArmError(resp *http.Response) *ArmError {
+	if resp.Request != nil {
+		if armCtx := armRequestContextFrom(resp.Request.Context()); armCtx != nil {
+			return armCtx.armError(resp)
+		}
+	}
+	return parseArmErrorFromResponse(resp)
+}
+
+// RetryBackoffPolicy sets the delay of the next retry per error category. It must be added to the PerRetryPolicies,
+// and only takes effect for responses ShouldRetryResponse retries that carry no retry-after header.
+// The delay doubles on every try, up to MaxDelay. The response is left untouched: the policy waits at the start of
+// the next try for what remains of the delay once the retry policy of azcore has slept its own, so the per-try
+// timeout (policy.RetryOptions.TryTimeout), if any, must allow for MaxDelay.
+type RetryBackoffPolicy struct {
+	// Backoff is the base delay per error category, defaults to DefaultRetryBackoff.
+	Backoff map[armerrors.ErrorCategory]time.Duration
+	// MaxDelay is the maximum delay, defaults to DefaultMaxRetryBackoff.
+	MaxDelay time.Duration
+}
+
+// retryBackoff holds the time the next try of an operation must not start before, it's shared by the clones of the request.
+type retryBackoff struct {
+	notBefore time.Time
+}
+
+func (p *RetryBackoffPolicy) Do(req *policy.Request) (*http.Response, error) {
+	var backoff *retryBackoff
+	if !req.OperationValue(&backoff) {
+		backoff = &retryBackoff{}
+		req.SetOperationValue(backoff)
+	}
+	if wait := time.Until(backoff.notBefore); wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Raw().Context().Done():
+			timer.Stop()
+			return nil, req.Raw().Context().Err()
+		}
+	}
+	backoff.notBefore = time.Time{}
+	attempt, exitTry := enterTry(req)
+	defer exitTry()
+
+	resp, err := req.Next()
+	if err != nil || hasRetryAfter(resp) {
+		return resp, err
+	}
+	if delay, ok := p.delay(resp, attempt); ok {
+		backoff.notBefore = time.Now().Add(delay)
+	}
+	return resp, err
+}
+
+// delay returns the delay before the retry of resp, the attempt-th try of the operation.
+func (p *RetryBackoffPolicy) delay(resp *http.Response, attempt int) (time.Duration, bool) {
+	category, retry := classifyRetry(resp)
+	if !retry {
+		return 0, false
+	}
+	backoff := p.Backoff
+	if backoff == nil {
+		backoff = DefaultRetryBackoff
+	}
+	delay, ok := backoff[category]
+	if !ok || delay <= 0 {
+		return 0, false
+	}
+	maxDelay := p.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = DefaultMaxRetryBackoff
+	}
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxDelay), true
+}
+
+func hasRetryAfter(resp *http.Response) bool {
+	if resp == nil {
+		return false
+	}
+	for _, header := range []string{"Retry-After-Ms", "X-Ms-Retry-After-Ms", "Retry-After"} {
+		if resp.Header.Get(header) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+var _ policy.Policy = &RetryBackoffPolicy{}
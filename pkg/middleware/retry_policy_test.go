@@ -0,0 +1,233 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	azlog "github.com/Azure/azure-sdk-for-go/sdk/azcore/log"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	armerrors "github.com/Azure/azure-sdk-for-go-extensions/pkg/errors"
+)
+
+func newErrorResponse(statusCode int, code string) *http.Response {
+	body := `{"error":{"code":"` + code + `","message":"test message"}}`
+	return &http.Response{
+		StatusCode: statusCode,
+		Header:     http.Header{"X-Ms-Error-Code": []string{code}},
+		Body:       io.NopCloser(bytes.NewBufferString(body)),
+		Request:    &http.Request{Method: http.MethodPut, URL: &url.URL{Scheme: "https", Host: "management.azure.com", Path: "/subscriptions/12345"}},
+	}
+}
+
+// newBodyErrorResponse returns an error response without the x-ms-error-code header, its code is only in the body.
+func newBodyErrorResponse(statusCode int, code string) *http.Response {
+	resp := newErrorResponse(statusCode, code)
+	resp.Header.Del("X-Ms-Error-Code")
+	return resp
+}
+
+func TestShouldRetryResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		resp     *http.Response
+		err      error
+		expected bool
+	}{
+		{"transport error", nil, errors.New("connection reset by peer"), true},
+		{"success", &http.Response{StatusCode: http.StatusOK}, nil, false},
+		{"throttled", newErrorResponse(http.StatusTooManyRequests, armerrors.TooManyRequestsErrorCode), nil, true},
+		{"another operation in progress", newErrorResponse(http.StatusConflict, armerrors.AnotherOperationInProgressErrorCode), nil, true},
+		{"retryable error", newErrorResponse(http.StatusConflict, armerrors.RetryableErrorCode), nil, true},
+		{"retryable error in the body only", newBodyErrorResponse(http.StatusConflict, armerrors.RetryableErrorCode), nil, true},
+		{"another operation in progress in the body only", newBodyErrorResponse(http.StatusConflict, armerrors.AnotherOperationInProgressErrorCode), nil, true},
+		{"internal server error", newErrorResponse(http.StatusInternalServerError, "InternalServerError"), nil, true},
+		{"request timeout", &http.Response{StatusCode: http.StatusRequestTimeout, Body: http.NoBody}, nil, true},
+		{"not implemented", newErrorResponse(http.StatusNotImplemented, "NotImplemented"), nil, false},
+		{"http version not supported", &http.Response{StatusCode: http.StatusHTTPVersionNotSupported, Body: http.NoBody}, nil, false},
+		{"sku not available as conflict", newErrorResponse(http.StatusConflict, armerrors.SKUNotAvailableErrorCode), nil, false},
+		{"sku not available as bad request", newErrorResponse(http.StatusBadRequest, armerrors.SKUNotAvailableErrorCode), nil, false},
+		{"quota as service unavailable", newErrorResponse(http.StatusServiceUnavailable, armerrors.ResourceQuotaExceededErrorCode), nil, false},
+		{"conflict", newErrorResponse(http.StatusConflict, armerrors.ConflictErrorCode), nil, false},
+		{"not found", newErrorResponse(http.StatusNotFound, armerrors.ResourceNotFoundErrorCode), nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, ShouldRetryResponse(tt.resp, tt.err))
+		})
+	}
+}
+
+func TestRetryBackoffPolicy(t *testing.T) {
+	// newPipeline returns a pipeline sending to handler, the times of the tries seen by the server are appended to tries.
+	newPipeline := func(t *testing.T, handler http.HandlerFunc, backoff *RetryBackoffPolicy, tries *[]time.Time) (runtime.Pipeline, string) {
+		var mu sync.Mutex
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			*tries = append(*tries, time.Now())
+			mu.Unlock()
+			handler(w, r)
+		}))
+		t.Cleanup(ts.Close)
+
+		retryOpts := DefaultRetryOpts()
+		retryOpts.MaxRetries = 3
+		retryOpts.RetryDelay = time.Millisecond
+		// the responses are not changed by the policy
+		recorder := policyFunc(func(req *policy.Request) (*http.Response, error) {
+			resp, err := req.Next()
+			if resp != nil {
+				assert.Empty(t, resp.Header.Get("Retry-After-Ms"))
+			}
+			return resp, err
+		})
+		return runtime.NewPipeline("test", "v1", runtime.PipelineOptions{}, &policy.ClientOptions{
+			Retry:            retryOpts,
+			PerRetryPolicies: []policy.Policy{backoff, recorder},
+			Transport:        ts.Client(),
+		}), ts.URL
+	}
+	send := func(t *testing.T, pl runtime.Pipeline, endpoint string) *http.Response {
+		req, err := runtime.NewRequest(context.Background(), http.MethodPut, endpoint)
+		require.NoError(t, err)
+		resp, err := pl.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("delay per category doubles up to the maximum", func(t *testing.T) {
+		var tries []time.Time
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Ms-Error-Code", armerrors.AnotherOperationInProgressErrorCode)
+			w.WriteHeader(http.StatusConflict)
+		}
+		backoff := &RetryBackoffPolicy{
+			Backoff:  map[armerrors.ErrorCategory]time.Duration{armerrors.ErrorCategoryConflict: 20 * time.Millisecond},
+			MaxDelay: 50 * time.Millisecond,
+		}
+		pl, endpoint := newPipeline(t, handler, backoff, &tries)
+		resp := send(t, pl, endpoint)
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("Retry-After-Ms"))
+		require.Len(t, tries, 4)
+		for i, delay := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond} {
+			assert.GreaterOrEqual(t, tries[i+1].Sub(tries[i]), delay, "try %d", i+2)
+		}
+	})
+
+	t.Run("permanent failures are not retried", func(t *testing.T) {
+		var tries []time.Time
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Ms-Error-Code", armerrors.SKUNotAvailableErrorCode)
+			w.WriteHeader(http.StatusConflict)
+		}
+		pl, endpoint := newPipeline(t, handler, &RetryBackoffPolicy{}, &tries)
+		resp := send(t, pl, endpoint)
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+		assert.Len(t, tries, 1)
+	})
+
+	t.Run("not implemented is not retried", func(t *testing.T) {
+		var tries []time.Time
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+		pl, endpoint := newPipeline(t, handler, &RetryBackoffPolicy{}, &tries)
+		resp := send(t, pl, endpoint)
+		assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+		assert.Len(t, tries, 1)
+	})
+
+	t.Run("retry-after of the server is kept", func(t *testing.T) {
+		var tries []time.Time
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			if len(tries) == 1 {
+				w.Header().Set("X-Ms-Retry-After-Ms", "1")
+				w.Header().Set("X-Ms-Error-Code", armerrors.TooManyRequestsErrorCode)
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}
+		// the default backoff of throttling would wait 10 seconds
+		pl, endpoint := newPipeline(t, handler, &RetryBackoffPolicy{}, &tries)
+		resp := send(t, pl, endpoint)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Len(t, tries, 2)
+		assert.Less(t, tries[1].Sub(tries[0]), time.Second)
+	})
+
+	t.Run("the wait ends with the context", func(t *testing.T) {
+		var tries []time.Time
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Ms-Error-Code", armerrors.TooManyRequestsErrorCode)
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+		pl, endpoint := newPipeline(t, handler, &RetryBackoffPolicy{}, &tries)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		req, err := runtime.NewRequest(ctx, http.MethodPut, endpoint)
+		require.NoError(t, err)
+		started := time.Now()
+		_, err = pl.Do(req)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(started), 5*time.Second)
+		assert.Len(t, tries, 1)
+	})
+}
+
+func TestRetryClassifiesResponsesOnce(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("X-Ms-Error-Code", armerrors.TooManyRequestsErrorCode)
+			w.Header().Set("Retry-After-Ms", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	var responseErrors atomic.Int32
+	azlog.SetEvents(azlog.EventResponseError)
+	azlog.SetListener(func(event azlog.Event, msg string) {
+		responseErrors.Add(1)
+	})
+	defer azlog.SetListener(nil)
+	defer azlog.SetEvents()
+
+	retryOpts := DefaultRetryOpts()
+	retryOpts.MaxRetries = 1
+	pl := runtime.NewPipeline("test", "v1", runtime.PipelineOptions{}, &policy.ClientOptions{
+		Retry:            retryOpts,
+		PerRetryPolicies: []policy.Policy{&RetryBackoffPolicy{}, &ArmRequestMetricPolicy{}},
+		Transport:        ts.Client(),
+	})
+	req, err := runtime.NewRequest(context.Background(), http.MethodGet, ts.URL)
+	require.NoError(t, err)
+	resp, err := pl.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	// the metric policy, the backoff policy and ShouldRetryResponse share the parse of the throttled response
+	assert.Equal(t, int32(1), responseErrors.Load())
+}
+
+type policyFunc func(req *policy.Request) (*http.Response, error)
+
+func (f policyFunc) Do(req *policy.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,50 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package middleware
+
+import "sync"
+
+// ringBuffer keeps the last items added to it, it's safe for concurrent use.
+type ringBuffer[T any] struct {
+	mu    sync.Mutex
+	items []T
+	// next is the index of the oldest item once the buffer is full
+	next int
+	full bool
+}
+
+func newRingBuffer[T any](size int) *ringBuffer[T] {
+	return &ringBuffer[T]{items: make([]T, size)}
+}
+
+func (b *ringBuffer[T]) add(item T) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.items[b.next] = item
+	b.next = (b.next + 1) % len(b.items)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// all returns the items kept, the oldest first.
+func (b *ringBuffer[T]) all() []T {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.full {
+		return append([]T(nil), b.items[:b.next]...)
+	}
+	return append(append([]T(nil), b.items[b.next:]...), b.items[:b.next]...)
+}